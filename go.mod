@@ -2,11 +2,14 @@ module go-gsm
 
 go 1.22.5
 
-require go.bug.st/serial v1.6.2
+require (
+	github.com/sirupsen/logrus v1.9.3
+	go.bug.st/serial v1.6.2
+	golang.org/x/sys v0.20.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/creack/goselect v0.1.2 // indirect
-	github.com/sirupsen/logrus v1.9.3 // indirect
 	github.com/stretchr/testify v1.9.0 // indirect
-	golang.org/x/sys v0.20.0 // indirect
 )
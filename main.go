@@ -9,21 +9,18 @@ import (
 func main() {
 	ctx := context.Background()
 	logrus.InitLogrusLogger()
-	ports, errPorts := gsm.GetAvailablePorts()
-	if errPorts != nil {
-		panic(errPorts)
-	}
-	logrus.LogrusLoggerWithContext(&ctx).Debugf("Available ports: %v", ports)
-	// COM32, COM21, COM20
-	portName := "COM32"
-	port, errPort := gsm.CreatePort(portName, 115200)
-	if errPort != nil {
-		panic(errPort)
-	}
-	serial := gsm.NewSerial(&ctx, port, "ccc")
-	if err := serial.Open(); err != nil {
+	pool := gsm.NewModemPool(&ctx, gsm.PoolOptions{
+		BaudRate:  115200,
+		Supervise: true,
+	})
+	defer pool.Close()
+	modems, err := pool.Discover(ctx)
+	if err != nil {
 		panic(err)
 	}
+	for _, modem := range modems {
+		logrus.LogrusLoggerWithContext(&ctx).Infof("Modem %s: ICCID %s, IMEI %s, phone %s", modem.PortName, modem.ICCID, modem.IMEI, modem.Phone)
+	}
 	forever := make(chan struct{})
 	logrus.LogrusLoggerWithContext(&ctx).Info("Press Ctrl+C to exit")
 	<-forever
@@ -3,12 +3,23 @@ package gsm
 import (
 	"fmt"
 	"go-gsm/pkg/logrus"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
+// clipWait is how long a RING waits for its +CLIP before the call is
+// announced without a number
+var clipWait = 500 * time.Millisecond
+
 type CallObserver struct {
 	SerialSubject *SerialSubject
+	mu            sync.Mutex
+	// ringing is set from the first RING until NO CARRIER, announced once
+	// IncomingCall was published for it
+	ringing   bool
+	announced bool
 }
 
 func NewCallObserver(subject *SerialSubject) *CallObserver {
@@ -18,7 +29,7 @@ func NewCallObserver(subject *SerialSubject) *CallObserver {
 }
 
 func (c *CallObserver) isCallResponse(data string) bool {
-	allows := []string{"RING", "NO CARRIER"}
+	allows := []string{"RING", "NO CARRIER", "+CLIP:"}
 	for _, allow := range allows {
 		if strings.Contains(data, allow) {
 			return true
@@ -34,24 +45,95 @@ func (c *CallObserver) Update(data string) {
 		return
 	}
 	if data == "RING" {
+		c.mu.Lock()
+		first := !c.ringing
+		c.ringing = true
+		c.mu.Unlock()
+		if !first {
+			return
+		}
 		logrus.LogrusLoggerWithContext(c.SerialSubject.ctx).Info("Incoming call detected.")
-		_ = c.SerialSubject.Send("ATA")
-		time.Sleep(1 * time.Second)
-		command := fmt.Sprintf("AT+QAUDRD=1,\"%s.wav\",13,1", c.SerialSubject.portName)
-		logrus.LogrusLoggerWithContext(c.SerialSubject.ctx).Info(command)
-		_ = c.SerialSubject.Send(command)
+		time.AfterFunc(clipWait, func() { c.announce("") })
+		if c.SerialSubject.AutoAnswer() {
+			go c.answer()
+		}
+		return
+	}
+
+	if strings.HasPrefix(data, "+CLIP:") {
+		// +CLIP: "0912345678",129,"",0,"",0
+		fields := splitFields(strings.TrimPrefix(data, "+CLIP:"))
+		if len(fields) > 0 {
+			c.announce(fields[0])
+		}
 		return
 	}
 
 	if data == "NO CARRIER" {
 		logrus.LogrusLoggerWithContext(c.SerialSubject.ctx).Info("Call ended due to NO CARRIER or ERROR.")
-		_ = c.SerialSubject.Send("AT+QAUDRD=0")
-		time.Sleep(1 * time.Second)
-		command := fmt.Sprintf("AT+QFDWL=\"%s.wav\";\r", c.SerialSubject.portName)
-		logrus.LogrusLoggerWithContext(c.SerialSubject.ctx).Info(command)
-		if err := c.SerialSubject.Send(command); err != nil {
-			logrus.LogrusLoggerWithContext(c.SerialSubject.ctx).Errorf("Error downloading recording: %v", err)
+		c.mu.Lock()
+		c.ringing = false
+		c.announced = false
+		c.mu.Unlock()
+		c.SerialSubject.publish(CallEnded{PortName: c.SerialSubject.portName})
+		if c.SerialSubject.AutoAnswer() {
+			go c.saveRecording()
 		}
 		return
 	}
 }
+
+// announce publishes IncomingCall once per call
+func (c *CallObserver) announce(number string) {
+	c.mu.Lock()
+	if !c.ringing || c.announced {
+		c.mu.Unlock()
+		return
+	}
+	c.announced = true
+	c.mu.Unlock()
+	c.SerialSubject.publish(IncomingCall{PortName: c.SerialSubject.portName, Number: number})
+}
+
+// answer picks up the call and starts recording it
+func (c *CallObserver) answer() {
+	if err := c.SerialSubject.SendAndWaitOK("ATA"); err != nil {
+		logrus.LogrusLoggerWithContext(c.SerialSubject.ctx).Errorf("Error answering call: %v", err)
+		return
+	}
+	time.Sleep(1 * time.Second)
+	command := fmt.Sprintf("AT+QAUDRD=1,\"%s\",13,1", c.recordingName())
+	logrus.LogrusLoggerWithContext(c.SerialSubject.ctx).Info(command)
+	if err := c.SerialSubject.SendAndWaitOK(command); err != nil {
+		logrus.LogrusLoggerWithContext(c.SerialSubject.ctx).Errorf("Error starting recording: %v", err)
+	}
+}
+
+// saveRecording stops the recording and downloads it
+func (c *CallObserver) saveRecording() {
+	_ = c.SerialSubject.SendAndWaitOK("AT+QAUDRD=0")
+	time.Sleep(1 * time.Second)
+	name := c.recordingName()
+	data, err := c.SerialSubject.DownloadFile(c.SerialSubject.baseContext(), name)
+	if err != nil {
+		logrus.LogrusLoggerWithContext(c.SerialSubject.ctx).Errorf("Error downloading recording: %v", err)
+		return
+	}
+	logrus.LogrusLoggerWithContext(c.SerialSubject.ctx).Infof("Received recording %s, %d bytes", name, len(data))
+	c.SerialSubject.publish(RecordingReady{PortName: c.SerialSubject.portName, Name: name, Data: data})
+	if handler := c.SerialSubject.recordingHandler(); handler != nil {
+		handler(name, data)
+	}
+}
+
+// recordingName is the file recorded on the modem, named after the port
+// without its directory, e.g. "ttyUSB2.wav" for /dev/ttyUSB2
+func (c *CallObserver) recordingName() string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, filepath.Base(c.SerialSubject.portName))
+	return name + ".wav"
+}
@@ -0,0 +1,247 @@
+package gsm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-gsm/pkg/logrus"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultConcatTimeout is how long parts of a concatenated message are kept
+// waiting for the rest
+const DefaultConcatTimeout = 3 * time.Minute
+
+// ConcatPart is one received part of a concatenated message
+type ConcatPart struct {
+	Sender    string
+	Reference int
+	Total     int
+	Seq       int
+	Time      string
+	Text      string
+	Index     int
+	Received  time.Time
+}
+
+func (p ConcatPart) key() string {
+	return fmt.Sprintf("%s/%d/%d", p.Sender, p.Reference, p.Total)
+}
+
+// ConcatStore keeps the parts of incomplete messages, so they survive a
+// reconnect or a restart
+type ConcatStore interface {
+	Load() ([]ConcatPart, error)
+	// Save replaces what was saved with the parts still waiting
+	Save(parts []ConcatPart) error
+}
+
+// FileConcatStore saves parts as JSON to a file
+type FileConcatStore struct {
+	Path string
+}
+
+func (f FileConcatStore) Load() ([]ConcatPart, error) {
+	data, err := os.ReadFile(f.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var parts []ConcatPart
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Path, err)
+	}
+	return parts, nil
+}
+
+func (f FileConcatStore) Save(parts []ConcatPart) error {
+	data, err := json.Marshal(parts)
+	if err != nil {
+		return err
+	}
+	// Written aside and renamed so a crash never leaves half a file
+	tmp := f.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.Path)
+}
+
+// ConcatOptions configures reassembly of concatenated messages, zero values
+// take the defaults
+type ConcatOptions struct {
+	// Timeout after the first part before the message is published with
+	// the parts received so far, DefaultConcatTimeout by default
+	Timeout time.Duration
+	// Store keeps waiting parts, nil keeps them in memory only
+	Store ConcatStore
+}
+
+// reassembler joins the parts of concatenated messages. Only PDU mode
+// shows the user data header, text mode publishes every part on its own.
+type reassembler struct {
+	subject *SerialSubject
+	mu      sync.Mutex
+	opts    ConcatOptions
+	pending map[string][]ConcatPart
+	timers  map[string]*time.Timer
+}
+
+func newReassembler(s *SerialSubject) *reassembler {
+	return &reassembler{
+		subject: s,
+		opts:    ConcatOptions{Timeout: DefaultConcatTimeout},
+		pending: map[string][]ConcatPart{},
+		timers:  map[string]*time.Timer{},
+	}
+}
+
+// SetConcat configures reassembly and restores the parts left in the store
+func (s *SerialSubject) SetConcat(opts ConcatOptions) error {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultConcatTimeout
+	}
+	var parts []ConcatPart
+	if opts.Store != nil {
+		var err error
+		if parts, err = opts.Store.Load(); err != nil {
+			return err
+		}
+	}
+	r := s.concat
+	r.mu.Lock()
+	r.opts = opts
+	var complete []SMSReceived
+	for _, part := range parts {
+		if event, ok := r.addLocked(part); ok {
+			complete = append(complete, event)
+		}
+	}
+	r.mu.Unlock()
+	for _, event := range complete {
+		s.publish(event)
+	}
+	return nil
+}
+
+// add keeps a part and publishes the message once every part arrived
+func (r *reassembler) add(part ConcatPart) {
+	r.mu.Lock()
+	event, ok := r.addLocked(part)
+	r.save()
+	r.mu.Unlock()
+	if ok {
+		r.subject.publish(event)
+	}
+}
+
+func (r *reassembler) addLocked(part ConcatPart) (SMSReceived, bool) {
+	key := part.key()
+	parts := r.pending[key]
+	for i, p := range parts {
+		if p.Seq == part.Seq {
+			// Retransmitted part
+			parts = append(parts[:i], parts[i+1:]...)
+			break
+		}
+	}
+	parts = append(parts, part)
+	if len(parts) >= part.Total {
+		return r.finishLocked(key, parts), true
+	}
+	r.pending[key] = parts
+	if _, ok := r.timers[key]; !ok {
+		wait := time.Until(parts[0].Received.Add(r.opts.Timeout))
+		r.timers[key] = time.AfterFunc(wait, func() { r.expire(key) })
+	}
+	return SMSReceived{}, false
+}
+
+// expire publishes what arrived of a message whose parts stopped coming
+func (r *reassembler) expire(key string) {
+	r.mu.Lock()
+	parts, ok := r.pending[key]
+	select {
+	case <-r.subject.closed:
+		// Kept in the store for the next subject
+		ok = false
+	default:
+	}
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	event := r.finishLocked(key, parts)
+	r.save()
+	r.mu.Unlock()
+	r.subject.publish(event)
+}
+
+func (r *reassembler) finishLocked(key string, parts []ConcatPart) SMSReceived {
+	delete(r.pending, key)
+	if timer, ok := r.timers[key]; ok {
+		timer.Stop()
+		delete(r.timers, key)
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Seq < parts[j].Seq })
+	first := parts[0]
+	event := SMSReceived{
+		PortName:  r.subject.portName,
+		Sender:    first.Sender,
+		Time:      first.Time,
+		Index:     first.Index,
+		Reference: first.Reference,
+		Parts:     first.Total,
+	}
+	var text strings.Builder
+	seq := 1
+	for _, part := range parts {
+		for ; seq < part.Seq; seq++ {
+			event.Missing = append(event.Missing, seq)
+		}
+		seq = part.Seq + 1
+		text.WriteString(part.Text)
+		event.Indexes = append(event.Indexes, part.Index)
+	}
+	for ; seq <= first.Total; seq++ {
+		event.Missing = append(event.Missing, seq)
+	}
+	event.Text = text.String()
+	log := logrus.LogrusLoggerWithContext(r.subject.ctx)
+	if len(event.Missing) > 0 {
+		log.Warnf("SMS from %s incomplete, parts %v of %d missing: %s", event.Sender, event.Missing, event.Parts, event.Text)
+	} else {
+		log.Infof("SMS from %s at %s in %d parts: %s", event.Sender, event.Time, event.Parts, event.Text)
+	}
+	return event
+}
+
+// save writes the waiting parts to the store
+func (r *reassembler) save() {
+	if r.opts.Store == nil {
+		return
+	}
+	parts := make([]ConcatPart, 0, len(r.pending))
+	for _, p := range r.pending {
+		parts = append(parts, p...)
+	}
+	if err := r.opts.Store.Save(parts); err != nil {
+		logrus.LogrusLoggerWithContext(r.subject.ctx).Errorf("Error saving SMS parts: %v", err)
+	}
+}
+
+// stop cancels the timeouts, waiting parts stay in the store
+func (r *reassembler) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, timer := range r.timers {
+		timer.Stop()
+		delete(r.timers, key)
+	}
+}
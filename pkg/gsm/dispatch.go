@@ -0,0 +1,251 @@
+package gsm
+
+import (
+	"context"
+	"go-gsm/pkg/logrus"
+	"sync"
+)
+
+// OverflowPolicy decides what happens to an event when a subscriber's queue
+// is full
+type OverflowPolicy int
+
+const (
+	// OverflowDrop discards the new event
+	OverflowDrop OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest queued event to make room
+	OverflowDropOldest
+	// OverflowBlock waits for room. It stalls the modem reader until the
+	// subscriber catches up, only use it for handlers that never block.
+	OverflowBlock
+
+	// overflowGrow never drops nor blocks, the queue grows instead. It is
+	// for the library's own URC handlers, which must see every URC and may
+	// wait for the reader themselves.
+	overflowGrow OverflowPolicy = -1
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowBlock:
+		return "block"
+	case overflowGrow:
+		return "grow"
+	}
+	return "drop"
+}
+
+// DefaultSubscriberBuffer is the queue length of a subscriber without
+// WithBuffer
+var DefaultSubscriberBuffer = 64
+
+type subscribeOptions struct {
+	buffer   int
+	overflow OverflowPolicy
+}
+
+// SubscribeOption configures the queue of a subscriber or observer
+type SubscribeOption func(*subscribeOptions)
+
+// WithBuffer sets how many events may wait for a slow subscriber
+func WithBuffer(size int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.buffer = size
+	}
+}
+
+// WithOverflow sets what happens when the queue is full, OverflowDrop by
+// default
+func WithOverflow(policy OverflowPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.overflow = policy
+	}
+}
+
+// subscriber owns a queue and the goroutine draining it into handler, so a
+// slow or panicking handler only affects itself
+type subscriber struct {
+	ctx      *context.Context
+	handler  func(any)
+	queue    chan any
+	overflow OverflowPolicy
+	stop     chan struct{}
+	stopOnce sync.Once
+	// backlog holds the items of overflowGrow, queue then only wakes run
+	mu      sync.Mutex
+	backlog []any
+	// onStop runs on the subscriber goroutine after the last delivery
+	onStop func()
+}
+
+func newSubscriber(ctx *context.Context, opts []SubscribeOption) *subscriber {
+	options := subscribeOptions{buffer: DefaultSubscriberBuffer}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.buffer < 1 {
+		options.buffer = 1
+	}
+	return &subscriber{
+		ctx:      ctx,
+		queue:    make(chan any, options.buffer),
+		overflow: options.overflow,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (sub *subscriber) run() {
+	if sub.onStop != nil {
+		defer sub.onStop()
+	}
+	for {
+		select {
+		case <-sub.stop:
+			return
+		case item := <-sub.queue:
+			if sub.overflow != overflowGrow {
+				sub.deliver(item)
+				continue
+			}
+			for _, item := range sub.takeBacklog() {
+				select {
+				case <-sub.stop:
+					return
+				default:
+				}
+				sub.deliver(item)
+			}
+		}
+	}
+}
+
+// takeBacklog empties the backlog of an overflowGrow subscriber
+func (sub *subscriber) takeBacklog() []any {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	items := sub.backlog
+	sub.backlog = nil
+	return items
+}
+
+// deliver calls the handler, a panic is logged and the subscriber carries on
+func (sub *subscriber) deliver(item any) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.LogrusLoggerWithContext(sub.ctx).Errorf("Subscriber panicked on %T: %v", item, r)
+		}
+	}()
+	sub.handler(item)
+}
+
+// enqueue applies the overflow policy, it only blocks with OverflowBlock
+func (sub *subscriber) enqueue(item any) {
+	switch sub.overflow {
+	case overflowGrow:
+		sub.mu.Lock()
+		sub.backlog = append(sub.backlog, item)
+		sub.mu.Unlock()
+		select {
+		case sub.queue <- nil:
+		default:
+			// run is already woken and takes the whole backlog
+		}
+	case OverflowBlock:
+		select {
+		case sub.queue <- item:
+		case <-sub.stop:
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case sub.queue <- item:
+				return
+			case <-sub.stop:
+				return
+			default:
+			}
+			select {
+			case dropped := <-sub.queue:
+				logrus.LogrusLoggerWithContext(sub.ctx).Warnf("Subscriber queue full, dropped %T", dropped)
+			default:
+			}
+		}
+	default:
+		select {
+		case sub.queue <- item:
+		case <-sub.stop:
+		default:
+			logrus.LogrusLoggerWithContext(sub.ctx).Warnf("Subscriber queue full, dropped %T", item)
+		}
+	}
+}
+
+func (sub *subscriber) close() {
+	sub.stopOnce.Do(func() { close(sub.stop) })
+}
+
+// eventBus fans items out to subscribers
+type eventBus struct {
+	mu          sync.RWMutex
+	nextID      int
+	subscribers map[int]*subscriber
+	closed      bool
+}
+
+// Subscription is returned by Subscribe, call Unsubscribe to stop receiving
+type Subscription struct {
+	bus *eventBus
+	id  int
+	sub *subscriber
+}
+
+// Unsubscribe stops delivery, events still queued are discarded. It is safe
+// to call more than once and from the handler itself.
+func (s *Subscription) Unsubscribe() {
+	s.bus.mu.Lock()
+	delete(s.bus.subscribers, s.id)
+	s.bus.mu.Unlock()
+	s.sub.close()
+}
+
+// add starts a subscriber, on a closed bus it is stopped right away
+func (b *eventBus) add(sub *subscriber) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	go sub.run()
+	if b.closed {
+		sub.close()
+		return &Subscription{bus: b, sub: sub}
+	}
+	if b.subscribers == nil {
+		b.subscribers = make(map[int]*subscriber)
+	}
+	b.nextID++
+	b.subscribers[b.nextID] = sub
+	return &Subscription{bus: b, id: b.nextID, sub: sub}
+}
+
+func (b *eventBus) publish(item any) {
+	b.mu.RLock()
+	subscribers := make([]*subscriber, 0, len(b.subscribers))
+	for _, sub := range b.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	b.mu.RUnlock()
+	for _, sub := range subscribers {
+		sub.enqueue(item)
+	}
+}
+
+// close stops every subscriber
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for id, sub := range b.subscribers {
+		sub.close()
+		delete(b.subscribers, id)
+	}
+}
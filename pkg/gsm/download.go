@@ -0,0 +1,165 @@
+package gsm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrChecksumMismatch is returned when a downloaded file doesn't match the
+// checksum reported by the modem
+var ErrChecksumMismatch = errors.New("file checksum mismatch")
+
+// DownloadTimeout bounds a whole file download
+var DownloadTimeout = 2 * time.Minute
+
+// ufsChecksum is the Quectel UFS checksum, XOR of every 16-bit big endian
+// word, computed over a stream
+type ufsChecksum struct {
+	sum     uint16
+	odd     bool
+	pending byte
+}
+
+func (c *ufsChecksum) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if c.odd {
+			c.sum ^= uint16(c.pending)<<8 | uint16(b)
+		} else {
+			c.pending = b
+		}
+		c.odd = !c.odd
+	}
+	return len(p), nil
+}
+
+// Sum16 returns the checksum, a dangling byte counts as a high byte
+func (c *ufsChecksum) Sum16() uint16 {
+	if c.odd {
+		return c.sum ^ uint16(c.pending)<<8
+	}
+	return c.sum
+}
+
+// rawTransfer is the binary phase of a command, between CONNECT and the
+// result lines
+type rawTransfer struct {
+	w io.Writer
+	// remaining is -1 when CONNECT didn't announce a length, the data is
+	// then held until the trailer line is found
+	remaining int
+	trailer   string
+	held      []byte
+	err       error
+}
+
+// feed consumes raw bytes from the front of buffer and returns what is left
+// for line parsing, done reports the end of the binary phase
+func (r *rawTransfer) feed(buffer string) (rest string, done bool) {
+	if r.remaining >= 0 {
+		n := len(buffer)
+		if n > r.remaining {
+			n = r.remaining
+		}
+		if n > 0 && r.err == nil {
+			_, r.err = io.WriteString(r.w, buffer[:n])
+		}
+		r.remaining -= n
+		return buffer[n:], r.remaining == 0
+	}
+	data := append(r.held, buffer...)
+	if i := bytes.Index(data, []byte(r.trailer)); i != -1 {
+		r.held = data[:i]
+		return string(data[i:]), true
+	}
+	r.held = data
+	return "", false
+}
+
+// parseConnectLength reads the length of "CONNECT <n>", -1 when absent
+func parseConnectLength(line string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "CONNECT")))
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// parseTransferResult reads "+QFDWL: <size>,<checksum>" style trailers
+func parseTransferResult(line, prefix string) (int, uint16, error) {
+	parts := strings.Split(strings.TrimSpace(strings.TrimPrefix(line, prefix)), ",")
+	if len(parts) < 2 {
+		return 0, 0, fmt.Errorf("malformed transfer result %q", line)
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed transfer result %q", line)
+	}
+	sum, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 16, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed transfer result %q", line)
+	}
+	return size, uint16(sum), nil
+}
+
+// DownloadFile reads a file from the modem storage with AT+QFDWL. The data
+// is read in raw mode after CONNECT, then size and checksum are verified.
+func (s *SerialSubject) DownloadFile(ctx context.Context, name string) ([]byte, error) {
+	var data bytes.Buffer
+	if _, err := s.downloadTo(ctx, name, &data); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+func (s *SerialSubject) downloadTo(ctx context.Context, name string, w io.Writer) (int, error) {
+	var sum ufsChecksum
+	var counter countingWriter
+	raw := &rawTransfer{w: io.MultiWriter(w, &sum, &counter), trailer: "+QFDWL:"}
+	response, err := s.ExecContext(ctx, Command{
+		Line:    fmt.Sprintf("AT+QFDWL=\"%s\"", name),
+		Prefix:  "+QFDWL:",
+		Timeout: DownloadTimeout,
+		raw:     raw,
+	})
+	if err != nil {
+		return counter.n, err
+	}
+	if raw.err != nil {
+		return counter.n, raw.err
+	}
+	size, checksum, err := parseTransferResult(response.First(), "+QFDWL:")
+	if err != nil {
+		return counter.n, err
+	}
+	if raw.held != nil {
+		// Length was not announced, the trailer tells where the data ends
+		if size > len(raw.held) {
+			return counter.n, fmt.Errorf("%s: modem reported %d bytes, received %d", name, size, len(raw.held))
+		}
+		if _, err := raw.w.Write(raw.held[:size]); err != nil {
+			return counter.n, err
+		}
+	}
+	if counter.n != size {
+		return counter.n, fmt.Errorf("%s: modem reported %d bytes, received %d", name, size, counter.n)
+	}
+	if sum.Sum16() != checksum {
+		return counter.n, fmt.Errorf("%w: %s: got %04x, modem reported %04x", ErrChecksumMismatch, name, sum.Sum16(), checksum)
+	}
+	return counter.n, nil
+}
+
+type countingWriter struct {
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += len(p)
+	return len(p), nil
+}
@@ -0,0 +1,66 @@
+package gsm
+
+import (
+	"context"
+	"strings"
+)
+
+// EchoMode is whether the modem echoes commands back, see ATE
+type EchoMode int32
+
+const (
+	// EchoUnknown until ATE0 or ATE1 was answered or an echo was seen
+	EchoUnknown EchoMode = iota
+	EchoOn
+	EchoOff
+)
+
+func (e EchoMode) String() string {
+	switch e {
+	case EchoOn:
+		return "on"
+	case EchoOff:
+		return "off"
+	}
+	return "unknown"
+}
+
+// Echo returns the echo mode the subject assumes. With echo on, responses
+// are only accepted once the echo of their command was received.
+func (s *SerialSubject) Echo() EchoMode {
+	return EchoMode(s.echo.Load())
+}
+
+// SetEcho switches command echo with ATE1 or ATE0
+func (s *SerialSubject) SetEcho(ctx context.Context, on bool) error {
+	command := "ATE0"
+	if on {
+		command = "ATE1"
+	}
+	_, err := s.ExecContext(ctx, Command{Line: command})
+	return err
+}
+
+func (s *SerialSubject) setEcho(mode EchoMode) {
+	s.echo.Store(int32(mode))
+}
+
+// echoAfter returns the echo mode a successful command leaves behind
+func echoAfter(command string) (EchoMode, bool) {
+	switch upper := strings.ToUpper(strings.TrimSpace(command)); {
+	case upper == "ATE0", upper == "ATE":
+		return EchoOff, true
+	case upper == "ATE1":
+		return EchoOn, true
+	case upper == "ATZ", strings.HasPrefix(upper, "AT&F"):
+		// Back to the stored profile, usually echo on
+		return EchoUnknown, true
+	}
+	return EchoUnknown, false
+}
+
+// isEchoOf reports whether line is the echo of command, modems echo the
+// command as typed and terminate it with a bare CR
+func isEchoOf(line, command string) bool {
+	return strings.EqualFold(strings.TrimSpace(line), strings.TrimSpace(command))
+}
@@ -0,0 +1,262 @@
+package gsm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CMEError is a "+CME ERROR" mobile equipment error (3GPP TS 27.007 9.2)
+type CMEError struct {
+	// Code is -1 when the modem reported a text we don't know the code of
+	Code int
+	Text string
+}
+
+func (e *CMEError) Error() string {
+	return fmt.Sprintf("+CME ERROR %d: %s", e.Code, e.Text)
+}
+
+// Is matches CME errors by code, so errors.Is(err, ErrSIMNotInserted) works
+// for both numeric and verbose (AT+CMEE=2) reports
+func (e *CMEError) Is(target error) bool {
+	t, ok := target.(*CMEError)
+	return ok && t.Code == e.Code
+}
+
+// CMSError is a "+CMS ERROR" message service failure (3GPP TS 27.005 3.2.5)
+type CMSError struct {
+	Code int
+	Text string
+}
+
+func (e *CMSError) Error() string {
+	return fmt.Sprintf("+CMS ERROR %d: %s", e.Code, e.Text)
+}
+
+// Is matches CMS errors by code
+func (e *CMSError) Is(target error) bool {
+	t, ok := target.(*CMSError)
+	return ok && t.Code == e.Code
+}
+
+// Common equipment errors, compare with errors.Is
+var (
+	ErrOperationNotAllowed   = &CMEError{Code: 3, Text: cmeErrors[3]}
+	ErrOperationNotSupported = &CMEError{Code: 4, Text: cmeErrors[4]}
+	ErrSIMNotInserted        = &CMEError{Code: 10, Text: cmeErrors[10]}
+	ErrSIMPINRequired        = &CMEError{Code: 11, Text: cmeErrors[11]}
+	ErrSIMPUKRequired        = &CMEError{Code: 12, Text: cmeErrors[12]}
+	ErrSIMFailure            = &CMEError{Code: 13, Text: cmeErrors[13]}
+	ErrSIMBusy               = &CMEError{Code: 14, Text: cmeErrors[14]}
+	ErrIncorrectPassword     = &CMEError{Code: 16, Text: cmeErrors[16]}
+	ErrMemoryFull            = &CMEError{Code: 20, Text: cmeErrors[20]}
+	ErrNotFound              = &CMEError{Code: 22, Text: cmeErrors[22]}
+	ErrNoNetworkService      = &CMEError{Code: 30, Text: cmeErrors[30]}
+	ErrNetworkTimeout        = &CMEError{Code: 31, Text: cmeErrors[31]}
+	ErrFileNotFound          = &CMEError{Code: 405, Text: cmeErrors[405]}
+	ErrDriveFull             = &CMEError{Code: 403, Text: cmeErrors[403]}
+)
+
+// Common message service errors, compare with errors.Is
+var (
+	ErrInvalidPDU           = &CMSError{Code: 304, Text: cmsErrors[304]}
+	ErrInvalidTextParameter = &CMSError{Code: 305, Text: cmsErrors[305]}
+	ErrSMSSIMNotInserted    = &CMSError{Code: 310, Text: cmsErrors[310]}
+	ErrInvalidMemoryIndex   = &CMSError{Code: 321, Text: cmsErrors[321]}
+	ErrSMSMemoryFull        = &CMSError{Code: 322, Text: cmsErrors[322]}
+	ErrSMSCAddressUnknown   = &CMSError{Code: 330, Text: cmsErrors[330]}
+	ErrSMSNoNetworkService  = &CMSError{Code: 331, Text: cmsErrors[331]}
+	ErrSMSNetworkTimeout    = &CMSError{Code: 332, Text: cmsErrors[332]}
+)
+
+// cmeErrors are the 3GPP TS 27.007 codes plus the Quectel file system range
+var cmeErrors = map[int]string{
+	0:   "phone failure",
+	1:   "no connection to phone",
+	2:   "phone-adaptor link reserved",
+	3:   "operation not allowed",
+	4:   "operation not supported",
+	5:   "PH-SIM PIN required",
+	6:   "PH-FSIM PIN required",
+	7:   "PH-FSIM PUK required",
+	10:  "SIM not inserted",
+	11:  "SIM PIN required",
+	12:  "SIM PUK required",
+	13:  "SIM failure",
+	14:  "SIM busy",
+	15:  "SIM wrong",
+	16:  "incorrect password",
+	17:  "SIM PIN2 required",
+	18:  "SIM PUK2 required",
+	20:  "memory full",
+	21:  "invalid index",
+	22:  "not found",
+	23:  "memory failure",
+	24:  "text string too long",
+	25:  "invalid characters in text string",
+	26:  "dial string too long",
+	27:  "invalid characters in dial string",
+	30:  "no network service",
+	31:  "network timeout",
+	32:  "network not allowed - emergency calls only",
+	40:  "network personalization PIN required",
+	41:  "network personalization PUK required",
+	42:  "network subset personalization PIN required",
+	43:  "network subset personalization PUK required",
+	44:  "service provider personalization PIN required",
+	45:  "service provider personalization PUK required",
+	46:  "corporate personalization PIN required",
+	47:  "corporate personalization PUK required",
+	100: "unknown",
+	103: "illegal MS",
+	106: "illegal ME",
+	107: "GPRS services not allowed",
+	111: "PLMN not allowed",
+	112: "location area not allowed",
+	113: "roaming not allowed in this location area",
+	132: "service option not supported",
+	133: "requested service option not subscribed",
+	134: "service option temporarily out of order",
+	148: "unspecified GPRS error",
+	149: "PDP authentication failure",
+	150: "invalid mobile class",
+	// Quectel UFS
+	400: "invalid input value",
+	401: "larger than the size of the file",
+	402: "read zero byte",
+	403: "drive full",
+	405: "file not found",
+	406: "invalid file name",
+	407: "file already existed",
+	409: "fail to write the file",
+	410: "fail to open the file",
+	411: "fail to read the file",
+	413: "reach the max number of file allowed to be opened",
+	414: "the file read-only",
+	416: "invalid file descriptor",
+	417: "fail to list the file",
+	418: "fail to delete the file",
+	419: "fail to get disk info",
+	420: "no space",
+	421: "time out",
+	423: "file too large",
+	425: "invalid parameter",
+	426: "file already opened",
+}
+
+// cmsErrors are the 3GPP TS 27.005 / 24.011 / 23.040 codes plus the
+// Quectel extensions above 511
+var cmsErrors = map[int]string{
+	1:   "unassigned (unallocated) number",
+	8:   "operator determined barring",
+	10:  "call barred",
+	21:  "short message transfer rejected",
+	27:  "destination out of service",
+	28:  "unidentified subscriber",
+	29:  "facility rejected",
+	30:  "unknown subscriber",
+	38:  "network out of order",
+	41:  "temporary failure",
+	42:  "congestion",
+	47:  "resources unavailable, unspecified",
+	50:  "requested facility not subscribed",
+	69:  "requested facility not implemented",
+	81:  "invalid short message transfer reference value",
+	95:  "invalid message, unspecified",
+	96:  "invalid mandatory information",
+	97:  "message type non-existent or not implemented",
+	98:  "message not compatible with short message protocol state",
+	99:  "information element non-existent or not implemented",
+	111: "protocol error, unspecified",
+	127: "interworking, unspecified",
+	128: "telematic interworking not supported",
+	129: "short message type 0 not supported",
+	130: "cannot replace short message",
+	143: "unspecified TP-PID error",
+	144: "data coding scheme (alphabet) not supported",
+	145: "message class not supported",
+	159: "unspecified TP-DCS error",
+	160: "command cannot be actioned",
+	161: "command unsupported",
+	175: "unspecified TP-Command error",
+	176: "TPDU not supported",
+	192: "SC busy",
+	193: "no SC subscription",
+	194: "SC system failure",
+	195: "invalid SME address",
+	196: "destination SME barred",
+	197: "SM rejected-duplicate SM",
+	198: "TP-VPF not supported",
+	199: "TP-VP not supported",
+	208: "D0 SIM SMS storage full",
+	209: "no SMS storage capability in SIM",
+	210: "error in MS",
+	211: "memory capacity exceeded",
+	212: "SIM application toolkit busy",
+	213: "SIM data download error",
+	255: "unspecified error cause",
+	300: "ME failure",
+	301: "SMS service of ME reserved",
+	302: "operation not allowed",
+	303: "operation not supported",
+	304: "invalid PDU mode parameter",
+	305: "invalid text mode parameter",
+	310: "SIM not inserted",
+	311: "SIM PIN required",
+	312: "PH-SIM PIN required",
+	313: "SIM failure",
+	314: "SIM busy",
+	315: "SIM wrong",
+	316: "SIM PUK required",
+	317: "SIM PIN2 required",
+	318: "SIM PUK2 required",
+	320: "memory failure",
+	321: "invalid memory index",
+	322: "memory full",
+	330: "SMSC address unknown",
+	331: "no network service",
+	332: "network timeout",
+	340: "no +CNMA acknowledgement expected",
+	500: "unknown error",
+	// Quectel
+	512: "SIM not ready",
+	513: "message length exceeds",
+	514: "invalid request parameters",
+	515: "ME storage failure",
+	517: "invalid service mode",
+	528: "more message to send state error",
+	529: "MO SMS is not allow",
+	530: "GPRS is suspended",
+	531: "ME storage full",
+}
+
+// parseModemError decodes a "+CME ERROR:" or "+CMS ERROR:" line, both the
+// numeric and the verbose form
+func parseModemError(line string) (error, bool) {
+	switch {
+	case strings.HasPrefix(line, "+CME ERROR:"):
+		code, text := lookupError(strings.TrimPrefix(line, "+CME ERROR:"), cmeErrors)
+		return &CMEError{Code: code, Text: text}, true
+	case strings.HasPrefix(line, "+CMS ERROR:"):
+		code, text := lookupError(strings.TrimPrefix(line, "+CMS ERROR:"), cmsErrors)
+		return &CMSError{Code: code, Text: text}, true
+	}
+	return nil, false
+}
+
+func lookupError(value string, table map[int]string) (int, string) {
+	value = strings.TrimSpace(value)
+	if code, err := strconv.Atoi(value); err == nil {
+		if text, ok := table[code]; ok {
+			return code, text
+		}
+		return code, "unknown error"
+	}
+	for code, text := range table {
+		if strings.EqualFold(text, value) {
+			return code, text
+		}
+	}
+	return -1, value
+}
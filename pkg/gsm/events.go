@@ -0,0 +1,167 @@
+package gsm
+
+// Event is published on a SerialSubject's event bus
+type Event interface {
+	EventName() string
+}
+
+// SMSReceived is a received text message
+type SMSReceived struct {
+	PortName string
+	Sender   string
+	// Time is the service centre timestamp as reported by the modem
+	Time string
+	Text string
+	// Index is the storage index, -1 for messages routed directly (+CMT)
+	Index int
+	// Parts is the number of parts of a concatenated message and Reference
+	// its reference, both 0 for single messages
+	Parts     int
+	Reference int
+	// Indexes are the storage indexes of the parts that arrived, in order
+	Indexes []int
+	// Missing lists the parts that did not arrive before the timeout
+	Missing []int
+}
+
+// IncomingCall is published once per call, Number is empty when the
+// network withholds it or caller ID is disabled
+type IncomingCall struct {
+	PortName string
+	Number   string
+}
+
+// CallEnded is published when the remote party hangs up
+type CallEnded struct {
+	PortName string
+}
+
+// RecordingReady carries a call recording downloaded from the modem
+type RecordingReady struct {
+	PortName string
+	Name     string
+	Data     []byte
+}
+
+// SignalChanged is published when the signal quality changes. RSSI is the
+// raw +CSQ value (0-31, 99 unknown), Level is 0-5 bars.
+type SignalChanged struct {
+	PortName string
+	RSSI     int
+	Level    int
+}
+
+// USSDResponse is a network USSD reply, Status is the <m> field of +CUSD
+type USSDResponse struct {
+	PortName string
+	Status   int
+	Text     string
+}
+
+// RegistrationStatus is the <stat> of +CREG
+type RegistrationStatus int
+
+const (
+	NotRegistered RegistrationStatus = iota
+	RegisteredHome
+	Searching
+	RegistrationDenied
+	RegistrationUnknown
+	RegisteredRoaming
+)
+
+func (r RegistrationStatus) String() string {
+	switch r {
+	case NotRegistered:
+		return "not registered"
+	case RegisteredHome:
+		return "registered, home network"
+	case Searching:
+		return "searching"
+	case RegistrationDenied:
+		return "registration denied"
+	case RegisteredRoaming:
+		return "registered, roaming"
+	}
+	return "unknown"
+}
+
+// Registered reports whether the modem can use the network
+func (r RegistrationStatus) Registered() bool {
+	return r == RegisteredHome || r == RegisteredRoaming
+}
+
+// RegistrationChanged is published on +CREG URCs, LAC and CellID are hex
+// and only filled with AT+CREG=2
+type RegistrationChanged struct {
+	PortName string
+	Status   RegistrationStatus
+	LAC      string
+	CellID   string
+}
+
+func (SMSReceived) EventName() string         { return "sms_received" }
+func (IncomingCall) EventName() string        { return "incoming_call" }
+func (CallEnded) EventName() string           { return "call_ended" }
+func (RecordingReady) EventName() string      { return "recording_ready" }
+func (SignalChanged) EventName() string       { return "signal_changed" }
+func (USSDResponse) EventName() string        { return "ussd_response" }
+func (RegistrationChanged) EventName() string { return "registration_changed" }
+func (ConnectionEvent) EventName() string     { return "connection" }
+
+// Subscribe calls handler for every event published by the subject. The
+// handler runs on its own goroutine, see SubscribeOption for what happens
+// when it falls behind.
+func (s *SerialSubject) Subscribe(handler func(Event), opts ...SubscribeOption) *Subscription {
+	sub := newSubscriber(s.ctx, opts)
+	sub.handler = func(item any) { handler(item.(Event)) }
+	return s.events.add(sub)
+}
+
+// SubscribeChan delivers events to a channel with the given buffer. The
+// channel is closed on Unsubscribe or when the subject is closed.
+func (s *SerialSubject) SubscribeChan(buffer int, opts ...SubscribeOption) (<-chan Event, *Subscription) {
+	ch := make(chan Event, buffer)
+	sub := newSubscriber(s.ctx, opts)
+	sub.handler = func(item any) {
+		select {
+		case ch <- item.(Event):
+		case <-sub.stop:
+		}
+	}
+	sub.onStop = func() { close(ch) }
+	return ch, s.events.add(sub)
+}
+
+// On subscribes to one event type:
+//
+//	gsm.On(subject, func(e gsm.SMSReceived) { ... })
+func On[T Event](s *SerialSubject, handler func(T), opts ...SubscribeOption) *Subscription {
+	return s.Subscribe(func(event Event) {
+		if typed, ok := event.(T); ok {
+			handler(typed)
+		}
+	}, opts...)
+}
+
+// publish queues an event for every subscriber
+func (s *SerialSubject) publish(event Event) {
+	s.events.publish(event)
+}
+
+// Attach adds an observer receiving every raw line not consumed by a
+// command. Prefer Subscribe for typed events.
+func (s *SerialSubject) Attach(observer SerialObserver, opts ...SubscribeOption) {
+	s.attach(observer, opts...)
+}
+
+// Detach removes an observer added with Attach
+func (s *SerialSubject) Detach(observer SerialObserver) {
+	s.mu.Lock()
+	sub, ok := s.observers[observer]
+	delete(s.observers, observer)
+	s.mu.Unlock()
+	if ok {
+		sub.Unsubscribe()
+	}
+}
@@ -0,0 +1,452 @@
+package gsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-gsm/pkg/logrus"
+	"io"
+	"strings"
+	"time"
+)
+
+// DefaultCommandTimeout bounds commands that don't set their own Timeout
+var DefaultCommandTimeout = 5 * time.Second
+
+// ErrCommandTimeout is returned when no final result code arrived in time
+var ErrCommandTimeout = errors.New("timeout waiting for final result code")
+
+// ErrShortPayload is returned when a payload ends before the size the
+// modem was told to expect
+var ErrShortPayload = errors.New("short payload")
+
+// EscapeGuardTime is the silence before and after the +++ that takes the
+// modem out of data mode
+var EscapeGuardTime = time.Second
+
+// Command is one AT command executed through the SerialSubject queue
+type Command struct {
+	// Line is written to the port, CRLF is appended
+	Line string
+	// Prefix selects the intermediate lines that belong to this command,
+	// e.g. "+CSQ". Empty accepts every line that is not a known URC.
+	Prefix string
+	// Timeout for the final result code, DefaultCommandTimeout when zero
+	Timeout time.Duration
+	// raw switches the reader to binary mode after CONNECT
+	raw *rawTransfer
+	// payload is written to the port after CONNECT, or after prompt
+	payload io.Reader
+	// payloadSize is the byte count announced in Line, a shorter payload
+	// is aborted with +++
+	payloadSize int
+	// prompt such as ">" of AT+CMGS, it ends without CRLF
+	prompt string
+	// bare also accepts lines without "+" beside those with Prefix, for
+	// commands some modems answer either way such as AT+CGSN
+	bare bool
+}
+
+// Response holds the intermediate lines and final result code of a command
+type Response struct {
+	Lines []string
+	Final string
+}
+
+// First returns the first intermediate line or an empty string
+func (r *Response) First() string {
+	if r == nil || len(r.Lines) == 0 {
+		return ""
+	}
+	return r.Lines[0]
+}
+
+// CommandError is returned when the modem answers with a failing final
+// result code. Err holds the decoded *CMEError or *CMSError, if any.
+type CommandError struct {
+	Command string
+	Result  string
+	Err     error
+}
+
+func (e *CommandError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("command %q failed: %v", e.Command, e.Err)
+	}
+	return fmt.Sprintf("command %q failed: %s", e.Command, e.Result)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// unsolicited lines must never be swallowed by a waiting command
+var unsolicited = []string{"RING", "NO CARRIER"}
+
+// callResults are the V.250 final result codes of ATD and ATA beside OK
+// and ERROR
+var callResults = []string{"NO CARRIER", "BUSY", "NO ANSWER", "NO DIALTONE"}
+
+// isCallCommand reports whether command dials or answers
+func isCallCommand(command string) bool {
+	upper := strings.ToUpper(strings.TrimSpace(command))
+	return upper == "ATA" || strings.HasPrefix(upper, "ATD")
+}
+
+// pendingCommand is the command currently waiting for its final result code
+type pendingCommand struct {
+	cmd      Command
+	lines    []string
+	matched  bool
+	finished bool
+	// written is set right before the command goes out, nothing received
+	// earlier can be its response. With echo on, nothing before the echo.
+	written bool
+	echo    EchoMode
+	echoed  bool
+	// transfer is set while raw data is being received
+	connected bool
+	transfer  *rawTransfer
+	// connect is closed when the modem is ready for the payload
+	connect chan struct{}
+	done    chan commandResult
+	// resync discards final result codes until its Prefix line, they answer
+	// a command that timed out
+	resync    bool
+	discarded int
+}
+
+type commandResult struct {
+	response *Response
+	err      error
+}
+
+// feed offers a received line to the command, it reports whether the line
+// belongs to the command's response
+func (p *pendingCommand) feed(line string) bool {
+	if p.finished || !p.written {
+		return false
+	}
+	if !p.echoed && isEchoOf(line, p.cmd.Line) {
+		p.echoed = true
+		return true
+	}
+	if p.echo == EchoOn && !p.echoed {
+		// A URC or a late answer to a command that timed out
+		return false
+	}
+	if isCallCommand(p.cmd.Line) {
+		for _, result := range callResults {
+			if line == result {
+				p.finish(nil, &CommandError{Command: p.cmd.Line, Result: line})
+				// NO CARRIER also ends the call for the call observer
+				return line != "NO CARRIER"
+			}
+		}
+	}
+	if _, modemErr := parseModemError(line); p.resync && !p.matched && (line == "OK" || line == "ERROR" || modemErr) {
+		p.discarded++
+		return true
+	}
+	switch {
+	case line == "OK":
+		p.finish(&Response{Lines: p.lines, Final: line}, nil)
+		return true
+	case line == "ERROR":
+		p.finish(nil, &CommandError{Command: p.cmd.Line, Result: line})
+		return true
+	}
+	if err, ok := parseModemError(line); ok {
+		p.finish(nil, &CommandError{Command: p.cmd.Line, Result: line, Err: err})
+		return true
+	}
+	if p.cmd.raw != nil && !p.connected && strings.HasPrefix(line, "CONNECT") {
+		p.connected = true
+		p.cmd.raw.remaining = parseConnectLength(line)
+		p.transfer = p.cmd.raw
+		return true
+	}
+	if p.cmd.payload != nil && p.cmd.prompt == "" && !p.connected && strings.HasPrefix(line, "CONNECT") {
+		p.connected = true
+		close(p.connect)
+		return true
+	}
+	for _, urc := range unsolicited {
+		if line == urc {
+			return false
+		}
+	}
+	if p.cmd.prompt != "" && p.connected && !p.matched && !strings.HasPrefix(line, "+") {
+		// Echo of the text typed after the prompt
+		return true
+	}
+	if p.cmd.Prefix != "" {
+		if strings.HasPrefix(line, p.cmd.Prefix) {
+			p.matched = true
+			p.lines = append(p.lines, line)
+			return true
+		}
+		// Text following a matched line is its payload (SMS body, file list)
+		if (p.matched || p.cmd.bare) && !strings.HasPrefix(line, "+") {
+			p.lines = append(p.lines, line)
+			return true
+		}
+		return false
+	}
+	if strings.HasPrefix(line, "+") {
+		return false
+	}
+	p.lines = append(p.lines, line)
+	return true
+}
+
+func (p *pendingCommand) finish(response *Response, err error) {
+	p.finished = true
+	p.done <- commandResult{response: response, err: err}
+}
+
+// Exec queues a command and waits for its final result code. Commands are
+// executed one at a time in the order they were submitted.
+func (s *SerialSubject) Exec(cmd Command) (*Response, error) {
+	return s.ExecContext(s.baseContext(), cmd)
+}
+
+// ExecContext is Exec aborting when ctx is done, both while queued and
+// while waiting for the modem
+func (s *SerialSubject) ExecContext(ctx context.Context, cmd Command) (*Response, error) {
+	select {
+	case s.cmdSlot <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.closed:
+		return nil, ErrClosed
+	}
+	defer func() { <-s.cmdSlot }()
+	lost := s.Lost()
+	if s.stale {
+		if err := s.resync(ctx, lost); err != nil {
+			return nil, err
+		}
+	}
+
+	timeout := cmd.Timeout
+	if timeout <= 0 {
+		timeout = DefaultCommandTimeout
+	}
+	pending := &pendingCommand{cmd: cmd, echo: s.Echo(), done: make(chan commandResult, 1), connect: make(chan struct{})}
+	s.setPending(pending)
+	defer s.setPending(nil)
+
+	s.cmdMu.Lock()
+	pending.written = true
+	s.cmdMu.Unlock()
+	if err := s.Send(cmd.Line); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	connect := pending.connect
+	for {
+		select {
+		case result := <-pending.done:
+			s.timeouts.Store(0)
+			s.learnEcho(pending, result.err == nil)
+			if result.err == nil {
+				s.learnSMSMode(cmd.Line)
+			}
+			return result.response, result.err
+		case <-connect:
+			connect = nil
+			written, err := s.writePayload(cmd.payload)
+			if err == nil && written < int64(cmd.payloadSize) {
+				err = fmt.Errorf("%w: %s: %d of %d bytes", ErrShortPayload, cmd.Line, written, cmd.payloadSize)
+			}
+			if err != nil {
+				if written < int64(cmd.payloadSize) {
+					// The modem still waits for the rest, its answer to
+					// the escape is left for the next command's resync
+					s.escapeData()
+					s.stale = true
+				}
+				return nil, err
+			}
+		case <-ctx.Done():
+			s.abortPrompt(pending)
+			s.cmdMu.Lock()
+			echoed := pending.echoed
+			s.cmdMu.Unlock()
+			// The next command resyncs first, the caller won't wait for it
+			s.stale = !echoed
+			return nil, ctx.Err()
+		case <-s.closed:
+			return nil, ErrClosed
+		case <-lost:
+			return nil, ErrDisconnected
+		case <-timer.C:
+			s.noteTimeout()
+			s.learnEcho(pending, false)
+			s.abortPrompt(pending)
+			s.cmdMu.Lock()
+			echoed := pending.echoed
+			s.cmdMu.Unlock()
+			// Without the echo a late answer would be taken for the next
+			// command's, it resyncs first
+			s.stale = !echoed
+			return nil, fmt.Errorf("%w: %s", ErrCommandTimeout, cmd.Line)
+		}
+	}
+}
+
+// resyncTimeout bounds the AT+CMEE? of resync
+const resyncTimeout = 2 * time.Second
+
+// resync waits for the modem to answer AT+CMEE? before the command holding
+// cmdSlot is sent. The modem answers in order, so final result codes before
+// +CMEE: belong to the command that gave up and are discarded. Without an
+// answer the subject stays stale and the command fails.
+func (s *SerialSubject) resync(ctx context.Context, lost <-chan struct{}) error {
+	pending := &pendingCommand{
+		cmd:     Command{Line: "AT+CMEE?", Prefix: "+CMEE:"},
+		echo:    s.Echo(),
+		resync:  true,
+		done:    make(chan commandResult, 1),
+		connect: make(chan struct{}),
+	}
+	s.setPending(pending)
+	defer s.setPending(nil)
+	s.cmdMu.Lock()
+	pending.written = true
+	s.cmdMu.Unlock()
+	if err := s.Send(pending.cmd.Line); err != nil {
+		return err
+	}
+	timer := time.NewTimer(resyncTimeout)
+	defer timer.Stop()
+	select {
+	case <-pending.done:
+		s.cmdMu.Lock()
+		discarded := pending.discarded
+		s.cmdMu.Unlock()
+		if discarded > 0 {
+			logrus.LogrusLoggerWithContext(s.ctx).Warnf("Discarded %d late result codes", discarded)
+		}
+		s.stale = false
+		return nil
+	case <-timer.C:
+		s.noteTimeout()
+		return fmt.Errorf("%w: %s to resync", ErrCommandTimeout, pending.cmd.Line)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.closed:
+		return ErrClosed
+	case <-lost:
+		return ErrDisconnected
+	}
+}
+
+// learnEcho updates the echo mode from what a command saw: the echo of a
+// command means echo is on, a command that got nothing while waiting for
+// its echo suggests it was turned off behind our back
+func (s *SerialSubject) learnEcho(p *pendingCommand, ok bool) {
+	s.cmdMu.Lock()
+	echoed := p.echoed
+	s.cmdMu.Unlock()
+	if mode, changes := echoAfter(p.cmd.Line); changes && ok {
+		s.setEcho(mode)
+		return
+	}
+	switch {
+	case echoed && p.echo != EchoOn:
+		s.setEcho(EchoOn)
+	case !echoed && p.echo == EchoOn && !ok:
+		logrus.LogrusLoggerWithContext(s.ctx).Warnf("No echo for %s, echo may be off", p.cmd.Line)
+		s.setEcho(EchoUnknown)
+	}
+}
+
+// noteTimeout counts consecutive timeouts and wakes the watchdog
+func (s *SerialSubject) noteTimeout() {
+	s.timeouts.Add(1)
+	select {
+	case s.timedOut <- struct{}{}:
+	default:
+	}
+}
+
+// writePayload streams data to the port after CONNECT
+func (s *SerialSubject) writePayload(payload io.Reader) (int64, error) {
+	s.connMu.Lock()
+	port := s.port
+	s.connMu.Unlock()
+	return io.Copy(port, payload)
+}
+
+// escapeData sends +++ between guard times so the modem leaves data mode
+func (s *SerialSubject) escapeData() {
+	s.connMu.Lock()
+	port := s.port
+	s.connMu.Unlock()
+	time.Sleep(EscapeGuardTime)
+	_, _ = port.Write([]byte("+++"))
+	time.Sleep(EscapeGuardTime)
+}
+
+func (s *SerialSubject) setPending(p *pendingCommand) {
+	s.cmdMu.Lock()
+	s.pending = p
+	s.cmdMu.Unlock()
+}
+
+// feedRaw passes received bytes to a binary transfer in progress and
+// returns the bytes left for line parsing, ok is false in line mode
+func (s *SerialSubject) feedRaw(buffer string) (rest string, ok bool) {
+	s.cmdMu.Lock()
+	defer s.cmdMu.Unlock()
+	if s.pending == nil || s.pending.transfer == nil {
+		return buffer, false
+	}
+	rest, done := s.pending.transfer.feed(buffer)
+	if done {
+		s.pending.transfer = nil
+	}
+	return rest, true
+}
+
+// feedPrompt detects the prompt of the waiting command, which is not
+// terminated by CRLF, and returns the bytes after it
+func (s *SerialSubject) feedPrompt(buffer string) (rest string, ok bool) {
+	s.cmdMu.Lock()
+	defer s.cmdMu.Unlock()
+	p := s.pending
+	if p == nil || p.cmd.prompt == "" || p.connected || p.finished || !p.written {
+		return buffer, false
+	}
+	if p.echo == EchoOn && !p.echoed || !strings.HasPrefix(buffer, p.cmd.prompt) {
+		return buffer, false
+	}
+	p.connected = true
+	close(p.connect)
+	return strings.TrimPrefix(buffer[len(p.cmd.prompt):], " "), true
+}
+
+// abortPrompt sends ESC so a modem left at the prompt of a command that
+// gave up does not take the next command as its text
+func (s *SerialSubject) abortPrompt(p *pendingCommand) {
+	if p.cmd.prompt == "" {
+		return
+	}
+	s.connMu.Lock()
+	port := s.port
+	s.connMu.Unlock()
+	_, _ = port.Write([]byte{0x1B})
+}
+
+// dispatchResponse hands a line to the waiting command, if any
+func (s *SerialSubject) dispatchResponse(line string) bool {
+	s.cmdMu.Lock()
+	defer s.cmdMu.Unlock()
+	if s.pending == nil {
+		return false
+	}
+	return s.pending.feed(line)
+}
@@ -0,0 +1,220 @@
+//go:build linux
+
+package gsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.bug.st/serial"
+	"golang.org/x/sys/unix"
+)
+
+var termiosRates = map[int]uint32{
+	1200: unix.B1200, 2400: unix.B2400, 4800: unix.B4800, 9600: unix.B9600,
+	19200: unix.B19200, 38400: unix.B38400, 57600: unix.B57600,
+	115200: unix.B115200, 230400: unix.B230400, 460800: unix.B460800,
+	500000: unix.B500000, 576000: unix.B576000, 921600: unix.B921600,
+	1000000: unix.B1000000, 1152000: unix.B1152000, 1500000: unix.B1500000,
+	2000000: unix.B2000000, 3000000: unix.B3000000, 4000000: unix.B4000000,
+}
+
+// rtsctsPort is a tty with CRTSCTS set. go.bug.st/serial clears it on every
+// SetMode, so the port is driven directly through termios.
+type rtsctsPort struct {
+	file *os.File
+	conn syscall.RawConn
+
+	mu      sync.Mutex
+	timeout time.Duration
+}
+
+func openRTSCTS(portName string, mode *serial.Mode) (serial.Port, error) {
+	fd, err := unix.Open(portName, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", portName, err)
+	}
+	if err := unix.IoctlSetInt(fd, unix.TIOCEXCL, 0); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("%s: %w", portName, err)
+	}
+	// Non-blocking descriptors go through the runtime poller, which gives
+	// Read deadlines and lets Close unblock a pending Read
+	file := os.NewFile(uintptr(fd), portName)
+	conn, err := file.SyscallConn()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	port := &rtsctsPort{file: file, conn: conn, timeout: serial.NoTimeout}
+	if err := port.SetMode(mode); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return port, nil
+}
+
+// control runs f on the descriptor
+func (p *rtsctsPort) control(f func(fd int) error) error {
+	var ferr error
+	if err := p.conn.Control(func(fd uintptr) { ferr = f(int(fd)) }); err != nil {
+		return err
+	}
+	return ferr
+}
+
+func (p *rtsctsPort) SetMode(mode *serial.Mode) error {
+	rate, ok := termiosRates[mode.BaudRate]
+	if !ok {
+		return fmt.Errorf("%w: baud rate %d", ErrPortOption, mode.BaudRate)
+	}
+	sizes := map[int]uint32{5: unix.CS5, 6: unix.CS6, 7: unix.CS7, 8: unix.CS8}
+	size, ok := sizes[mode.DataBits]
+	if !ok {
+		return fmt.Errorf("%w: %d data bits", ErrPortOption, mode.DataBits)
+	}
+	err := p.control(func(fd int) error {
+		if err := makeRaw(fd); err != nil {
+			return err
+		}
+		termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+		if err != nil {
+			return err
+		}
+		termios.Cflag &^= unix.CBAUD | unix.CIBAUD | unix.CSIZE | unix.PARENB | unix.PARODD | unix.CMSPAR | unix.CSTOPB
+		termios.Cflag |= rate | size | unix.CLOCAL | unix.CREAD | unix.CRTSCTS
+		termios.Iflag &^= unix.INPCK | unix.IXOFF | unix.IXANY
+		switch mode.Parity {
+		case serial.NoParity:
+		case serial.OddParity:
+			termios.Cflag |= unix.PARENB | unix.PARODD
+		case serial.EvenParity:
+			termios.Cflag |= unix.PARENB
+		case serial.MarkParity:
+			termios.Cflag |= unix.PARENB | unix.PARODD | unix.CMSPAR
+		case serial.SpaceParity:
+			termios.Cflag |= unix.PARENB | unix.CMSPAR
+		default:
+			return fmt.Errorf("%w: parity %d", ErrPortOption, mode.Parity)
+		}
+		if mode.Parity != serial.NoParity {
+			termios.Iflag |= unix.INPCK
+		}
+		switch mode.StopBits {
+		case serial.OneStopBit:
+		case serial.TwoStopBits:
+			termios.Cflag |= unix.CSTOPB
+		default:
+			return fmt.Errorf("%w: stop bits %d", ErrPortOption, mode.StopBits)
+		}
+		return unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+	})
+	if err != nil {
+		return err
+	}
+	if mode.InitialStatusBits != nil {
+		return p.SetDTR(mode.InitialStatusBits.DTR)
+	}
+	return nil
+}
+
+// Read returns 0, nil when the read timeout expires, like serial.Port
+func (p *rtsctsPort) Read(buf []byte) (int, error) {
+	p.mu.Lock()
+	timeout := p.timeout
+	p.mu.Unlock()
+	deadline := time.Time{}
+	if timeout >= 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := p.file.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	n, err := p.file.Read(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, nil
+	}
+	return n, err
+}
+
+func (p *rtsctsPort) Write(buf []byte) (int, error) {
+	return p.file.Write(buf)
+}
+
+func (p *rtsctsPort) Drain() error {
+	return p.control(func(fd int) error {
+		return unix.IoctlSetInt(fd, unix.TCSBRK, 1)
+	})
+}
+
+func (p *rtsctsPort) ResetInputBuffer() error {
+	return p.control(func(fd int) error {
+		return unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCIFLUSH)
+	})
+}
+
+func (p *rtsctsPort) ResetOutputBuffer() error {
+	return p.control(func(fd int) error {
+		return unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCOFLUSH)
+	})
+}
+
+func (p *rtsctsPort) SetDTR(dtr bool) error {
+	return p.control(func(fd int) error {
+		request := uint(unix.TIOCMBIC)
+		if dtr {
+			request = unix.TIOCMBIS
+		}
+		return unix.IoctlSetPointerInt(fd, request, unix.TIOCM_DTR)
+	})
+}
+
+// SetRTS fails, the UART raises and drops RTS itself
+func (p *rtsctsPort) SetRTS(bool) error {
+	return fmt.Errorf("%w: RTS is driven by hardware flow control", ErrPortOption)
+}
+
+func (p *rtsctsPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	var status int
+	err := p.control(func(fd int) error {
+		var err error
+		status, err = unix.IoctlGetInt(fd, unix.TIOCMGET)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &serial.ModemStatusBits{
+		CTS: status&unix.TIOCM_CTS != 0,
+		DSR: status&unix.TIOCM_DSR != 0,
+		RI:  status&unix.TIOCM_RI != 0,
+		DCD: status&unix.TIOCM_CD != 0,
+	}, nil
+}
+
+func (p *rtsctsPort) SetReadTimeout(timeout time.Duration) error {
+	p.mu.Lock()
+	p.timeout = timeout
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *rtsctsPort) Close() error {
+	return p.file.Close()
+}
+
+func (p *rtsctsPort) Break(d time.Duration) error {
+	if err := p.control(func(fd int) error {
+		return unix.IoctlSetInt(fd, unix.TIOCSBRK, 0)
+	}); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return p.control(func(fd int) error {
+		return unix.IoctlSetInt(fd, unix.TIOCCBRK, 0)
+	})
+}
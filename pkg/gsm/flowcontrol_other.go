@@ -0,0 +1,15 @@
+//go:build !linux && !windows
+
+package gsm
+
+import (
+	"fmt"
+	"runtime"
+
+	"go.bug.st/serial"
+)
+
+// openRTSCTS is implemented on Linux and Windows
+func openRTSCTS(portName string, mode *serial.Mode) (serial.Port, error) {
+	return nil, fmt.Errorf("hardware flow control is not supported on %s", runtime.GOOS)
+}
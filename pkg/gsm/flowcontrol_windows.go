@@ -0,0 +1,217 @@
+//go:build windows
+
+package gsm
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+
+	"go.bug.st/serial"
+	"golang.org/x/sys/windows"
+)
+
+// DCB bit fields and GetCommModemStatus bits missing from x/sys/windows
+const (
+	dcbBinary         = 0x00000001
+	dcbParity         = 0x00000002
+	dcbOutxCtsFlow    = 0x00000004
+	dcbOutxDsrFlow    = 0x00000008
+	dcbDtrControlMask = 0x00000030
+	dcbDsrSensitivity = 0x00000040
+	dcbOutX           = 0x00000100
+	dcbInX            = 0x00000200
+	dcbRtsControlMask = 0x00003000
+	dcbAbortOnError   = 0x00004000
+
+	msCTSOn  = 0x0010
+	msDSROn  = 0x0020
+	msRingOn = 0x0040
+	msRLSDOn = 0x0080
+
+	maxDWORD = 0xFFFFFFFF
+)
+
+// rtsctsPort is a COM port with RTS handshaking and CTS output flow control.
+// go.bug.st/serial disables both on every SetMode, so the DCB is set here.
+type rtsctsPort struct {
+	handle windows.Handle
+}
+
+func openRTSCTS(portName string, mode *serial.Mode) (serial.Port, error) {
+	path, err := windows.UTF16PtrFromString(`\\.\` + portName)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := windows.CreateFile(path, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil,
+		windows.OPEN_EXISTING, windows.FILE_FLAG_OVERLAPPED, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", portName, err)
+	}
+	port := &rtsctsPort{handle: handle}
+	if err := port.SetMode(mode); err != nil {
+		_ = windows.CloseHandle(handle)
+		return nil, err
+	}
+	if err := port.SetReadTimeout(serial.NoTimeout); err != nil {
+		_ = windows.CloseHandle(handle)
+		return nil, err
+	}
+	return port, nil
+}
+
+func (p *rtsctsPort) SetMode(mode *serial.Mode) error {
+	if mode.BaudRate <= 0 {
+		return fmt.Errorf("%w: baud rate %d", ErrPortOption, mode.BaudRate)
+	}
+	if mode.DataBits < 5 || mode.DataBits > 8 {
+		return fmt.Errorf("%w: %d data bits", ErrPortOption, mode.DataBits)
+	}
+	var dcb windows.DCB
+	dcb.DCBlength = uint32(unsafe.Sizeof(dcb))
+	if err := windows.GetCommState(p.handle, &dcb); err != nil {
+		return err
+	}
+	dcb.BaudRate = uint32(mode.BaudRate)
+	dcb.ByteSize = uint8(mode.DataBits)
+	switch mode.Parity {
+	case serial.NoParity:
+		dcb.Parity = windows.NOPARITY
+	case serial.OddParity:
+		dcb.Parity = windows.ODDPARITY
+	case serial.EvenParity:
+		dcb.Parity = windows.EVENPARITY
+	case serial.MarkParity:
+		dcb.Parity = windows.MARKPARITY
+	case serial.SpaceParity:
+		dcb.Parity = windows.SPACEPARITY
+	default:
+		return fmt.Errorf("%w: parity %d", ErrPortOption, mode.Parity)
+	}
+	switch mode.StopBits {
+	case serial.OneStopBit:
+		dcb.StopBits = windows.ONESTOPBIT
+	case serial.OnePointFiveStopBits:
+		dcb.StopBits = windows.ONE5STOPBITS
+	case serial.TwoStopBits:
+		dcb.StopBits = windows.TWOSTOPBITS
+	default:
+		return fmt.Errorf("%w: stop bits %d", ErrPortOption, mode.StopBits)
+	}
+
+	dtr := uint32(windows.DTR_CONTROL_ENABLE)
+	if mode.InitialStatusBits != nil && !mode.InitialStatusBits.DTR {
+		dtr = windows.DTR_CONTROL_DISABLE
+	}
+	dcb.Flags &^= dcbParity | dcbOutxDsrFlow | dcbDtrControlMask | dcbDsrSensitivity |
+		dcbOutX | dcbInX | dcbRtsControlMask | dcbAbortOnError
+	dcb.Flags |= dcbBinary | dcbOutxCtsFlow | dtr<<4 | windows.RTS_CONTROL_HANDSHAKE<<12
+	if mode.Parity != serial.NoParity {
+		dcb.Flags |= dcbParity
+	}
+	return windows.SetCommState(p.handle, &dcb)
+}
+
+// overlapped runs an overlapped ReadFile or WriteFile to completion
+func (p *rtsctsPort) overlapped(start func(done *uint32, ov *windows.Overlapped) error) (int, error) {
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(event)
+	ov := &windows.Overlapped{HEvent: event}
+	var done uint32
+	err = start(&done, ov)
+	if err == windows.ERROR_IO_PENDING {
+		err = windows.GetOverlappedResult(p.handle, ov, &done, true)
+	}
+	return int(done), err
+}
+
+// Read returns 0, nil when the read timeout expires, like serial.Port
+func (p *rtsctsPort) Read(buf []byte) (int, error) {
+	return p.overlapped(func(done *uint32, ov *windows.Overlapped) error {
+		return windows.ReadFile(p.handle, buf, done, ov)
+	})
+}
+
+func (p *rtsctsPort) Write(buf []byte) (int, error) {
+	return p.overlapped(func(done *uint32, ov *windows.Overlapped) error {
+		return windows.WriteFile(p.handle, buf, done, ov)
+	})
+}
+
+func (p *rtsctsPort) Drain() error {
+	return windows.FlushFileBuffers(p.handle)
+}
+
+func (p *rtsctsPort) ResetInputBuffer() error {
+	return windows.PurgeComm(p.handle, windows.PURGE_RXCLEAR|windows.PURGE_RXABORT)
+}
+
+func (p *rtsctsPort) ResetOutputBuffer() error {
+	return windows.PurgeComm(p.handle, windows.PURGE_TXCLEAR|windows.PURGE_TXABORT)
+}
+
+func (p *rtsctsPort) SetDTR(dtr bool) error {
+	function := uint32(windows.CLRDTR)
+	if dtr {
+		function = windows.SETDTR
+	}
+	return windows.EscapeCommFunction(p.handle, function)
+}
+
+// SetRTS fails, the UART raises and drops RTS itself
+func (p *rtsctsPort) SetRTS(bool) error {
+	return fmt.Errorf("%w: RTS is driven by hardware flow control", ErrPortOption)
+}
+
+func (p *rtsctsPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	var status uint32
+	if err := windows.GetCommModemStatus(p.handle, &status); err != nil {
+		return nil, err
+	}
+	return &serial.ModemStatusBits{
+		CTS: status&msCTSOn != 0,
+		DSR: status&msDSROn != 0,
+		RI:  status&msRingOn != 0,
+		DCD: status&msRLSDOn != 0,
+	}, nil
+}
+
+// SetReadTimeout makes ReadFile return as soon as a byte arrives, or after
+// timeout with nothing read
+func (p *rtsctsPort) SetReadTimeout(timeout time.Duration) error {
+	constant := uint32(maxDWORD - 1)
+	if timeout >= 0 {
+		ms := timeout.Milliseconds()
+		if ms <= 0 && timeout > 0 {
+			ms = 1
+		}
+		if ms < int64(constant) {
+			constant = uint32(ms)
+		}
+	}
+	timeouts := &windows.CommTimeouts{
+		ReadIntervalTimeout:        maxDWORD,
+		ReadTotalTimeoutMultiplier: maxDWORD,
+		ReadTotalTimeoutConstant:   constant,
+	}
+	if timeout == 0 {
+		// Return immediately with whatever is buffered
+		timeouts.ReadTotalTimeoutMultiplier = 0
+	}
+	return windows.SetCommTimeouts(p.handle, timeouts)
+}
+
+func (p *rtsctsPort) Close() error {
+	return windows.CloseHandle(p.handle)
+}
+
+func (p *rtsctsPort) Break(d time.Duration) error {
+	if err := windows.SetCommBreak(p.handle); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return windows.ClearCommBreak(p.handle)
+}
@@ -0,0 +1,222 @@
+package gsm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileInfo describes a file in the modem storage
+type FileInfo struct {
+	Name string
+	Size int64
+}
+
+// StorageInfo is the space of a modem storage in bytes
+type StorageInfo struct {
+	Free  int64
+	Total int64
+}
+
+// FileMode is the open mode of AT+QFOPEN
+type FileMode int
+
+const (
+	// FileReadWrite opens or creates a file for reading and writing
+	FileReadWrite FileMode = 0
+	// FileTruncate creates or clears a file for reading and writing
+	FileTruncate FileMode = 1
+	// FileReadOnly opens an existing file read-only
+	FileReadOnly FileMode = 2
+)
+
+// FileChunkSize is the size of each AT+QFREAD/AT+QFWRITE transfer
+var FileChunkSize = 1024
+
+// ListFiles lists files matching pattern ("*" for all) with AT+QFLST
+func (s *SerialSubject) ListFiles(ctx context.Context, pattern string) ([]FileInfo, error) {
+	if pattern == "" {
+		pattern = "*"
+	}
+	response, err := s.ExecContext(ctx, Command{Line: fmt.Sprintf("AT+QFLST=\"%s\"", pattern), Prefix: "+QFLST:"})
+	if err != nil {
+		return nil, err
+	}
+	files := make([]FileInfo, 0, len(response.Lines))
+	for _, line := range response.Lines {
+		// +QFLST: "UFS:call.wav",1234
+		value := strings.TrimSpace(strings.TrimPrefix(line, "+QFLST:"))
+		i := strings.LastIndex(value, ",")
+		if i == -1 {
+			continue
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(value[i+1:]), 10, 64)
+		if err != nil {
+			continue
+		}
+		name := strings.TrimPrefix(strings.Trim(value[:i], "\""), "UFS:")
+		files = append(files, FileInfo{Name: name, Size: size})
+	}
+	return files, nil
+}
+
+// FreeSpace returns the free and total size of a storage ("UFS", "RAM")
+// with AT+QFLDS
+func (s *SerialSubject) FreeSpace(ctx context.Context, storage string) (StorageInfo, error) {
+	if storage == "" {
+		storage = "UFS"
+	}
+	data, err := s.SendAndGetDataContext(ctx, "+QFLDS:", fmt.Sprintf("AT+QFLDS=\"%s\"", storage), DefaultCommandTimeout)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	parts := strings.Split(strings.TrimSpace(strings.TrimPrefix(data, "+QFLDS:")), ",")
+	if len(parts) < 2 {
+		return StorageInfo{}, fmt.Errorf("malformed storage info %q", data)
+	}
+	free, errFree := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+	total, errTotal := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+	if errFree != nil || errTotal != nil {
+		return StorageInfo{}, fmt.Errorf("malformed storage info %q", data)
+	}
+	return StorageInfo{Free: free, Total: total}, nil
+}
+
+// UploadFile writes size bytes from r to the modem storage with AT+QFUPL
+// and verifies the checksum the modem computed. When r ends early the
+// upload is aborted with ErrShortPayload.
+func (s *SerialSubject) UploadFile(ctx context.Context, name string, r io.Reader, size int) error {
+	var sum ufsChecksum
+	payload := io.TeeReader(io.LimitReader(r, int64(size)), &sum)
+	timeout := DownloadTimeout
+	response, err := s.ExecContext(ctx, Command{
+		Line:        fmt.Sprintf("AT+QFUPL=\"%s\",%d,%d", name, size, int(timeout.Seconds())),
+		Prefix:      "+QFUPL:",
+		Timeout:     timeout,
+		payload:     payload,
+		payloadSize: size,
+	})
+	if err != nil {
+		return err
+	}
+	uploaded, checksum, err := parseTransferResult(response.First(), "+QFUPL:")
+	if err != nil {
+		return err
+	}
+	if uploaded != size {
+		return fmt.Errorf("%s: modem stored %d bytes, sent %d", name, uploaded, size)
+	}
+	if checksum != sum.Sum16() {
+		return fmt.Errorf("%w: %s: sent %04x, modem reported %04x", ErrChecksumMismatch, name, sum.Sum16(), checksum)
+	}
+	return nil
+}
+
+// DownloadFileTo streams a file from the modem storage to w with AT+QFDWL
+func (s *SerialSubject) DownloadFileTo(ctx context.Context, name string, w io.Writer) (int, error) {
+	return s.downloadTo(ctx, name, w)
+}
+
+// DeleteFile deletes a file, "*" deletes every file, with AT+QFDEL
+func (s *SerialSubject) DeleteFile(ctx context.Context, name string) error {
+	return s.SendAndWaitOKContext(ctx, fmt.Sprintf("AT+QFDEL=\"%s\"", name))
+}
+
+// ModemFile is a file opened on the modem with AT+QFOPEN, for files too
+// large to transfer in one go
+type ModemFile struct {
+	subject *SerialSubject
+	ctx     context.Context
+	handle  int
+	Name    string
+}
+
+// OpenFile opens a file in the modem storage, ctx bounds every later
+// operation on the file
+func (s *SerialSubject) OpenFile(ctx context.Context, name string, mode FileMode) (*ModemFile, error) {
+	data, err := s.SendAndGetDataContext(ctx, "+QFOPEN:", fmt.Sprintf("AT+QFOPEN=\"%s\",%d", name, mode), DefaultCommandTimeout)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(data, "+QFOPEN:")))
+	if err != nil {
+		return nil, fmt.Errorf("malformed file handle %q", data)
+	}
+	return &ModemFile{subject: s, ctx: ctx, handle: handle, Name: name}, nil
+}
+
+// Read reads the next chunk with AT+QFREAD, io.EOF at the end of the file
+func (f *ModemFile) Read(p []byte) (int, error) {
+	length := len(p)
+	if length > FileChunkSize {
+		length = FileChunkSize
+	}
+	if length == 0 {
+		return 0, nil
+	}
+	var data bytes.Buffer
+	_, err := f.subject.ExecContext(f.ctx, Command{
+		Line:    fmt.Sprintf("AT+QFREAD=%d,%d", f.handle, length),
+		Timeout: 30 * time.Second,
+		raw:     &rawTransfer{w: &data},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if data.Len() == 0 {
+		return 0, io.EOF
+	}
+	return copy(p, data.Bytes()), nil
+}
+
+// Write writes p in chunks with AT+QFWRITE
+func (f *ModemFile) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > FileChunkSize {
+			chunk = chunk[:FileChunkSize]
+		}
+		data, err := f.subject.ExecContext(f.ctx, Command{
+			Line:    fmt.Sprintf("AT+QFWRITE=%d,%d", f.handle, len(chunk)),
+			Prefix:  "+QFWRITE:",
+			Timeout: 30 * time.Second,
+			payload: bytes.NewReader(chunk),
+		})
+		if err != nil {
+			return written, err
+		}
+		// +QFWRITE: <written_length>,<total_length>
+		parts := strings.Split(strings.TrimPrefix(data.First(), "+QFWRITE:"), ",")
+		n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return written, fmt.Errorf("malformed write result %q", data.First())
+		}
+		written += n
+		if n < len(chunk) {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// Seek moves the file pointer with AT+QFSEEK and returns the new position
+func (f *ModemFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.subject.SendAndWaitOKContext(f.ctx, fmt.Sprintf("AT+QFSEEK=%d,%d,%d", f.handle, offset, whence)); err != nil {
+		return 0, err
+	}
+	data, err := f.subject.SendAndGetDataContext(f.ctx, "+QFPOSITION:", fmt.Sprintf("AT+QFPOSITION=%d", f.handle), DefaultCommandTimeout)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(data, "+QFPOSITION:")), 10, 64)
+}
+
+// Close releases the file handle with AT+QFCLOSE
+func (f *ModemFile) Close() error {
+	return f.subject.SendAndWaitOKContext(f.ctx, fmt.Sprintf("AT+QFCLOSE=%d", f.handle))
+}
@@ -0,0 +1,111 @@
+package gsm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// gsm7Basic is the GSM 03.38 default alphabet
+var gsm7Basic = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+// gsm7Extension is reached through the escape septet 0x1B
+var gsm7Extension = map[byte]rune{
+	0x0A: '\f',
+	0x14: '^',
+	0x28: '{',
+	0x29: '}',
+	0x2F: '\\',
+	0x3C: '[',
+	0x3D: '~',
+	0x3E: ']',
+	0x40: '|',
+	0x65: '€',
+}
+
+const gsm7Escape = 0x1B
+
+// unpackSeptets reads count septets packed into octets, skipping the
+// first skip bits that belong to a user data header
+func unpackSeptets(data []byte, skip, count int) []byte {
+	septets := make([]byte, 0, count)
+	for i := 0; i < count; i++ {
+		bit := skip + i*7
+		index := bit / 8
+		if index >= len(data) {
+			break
+		}
+		shift := uint(bit % 8)
+		value := uint16(data[index]) >> shift
+		if shift > 1 && index+1 < len(data) {
+			value |= uint16(data[index+1]) << (8 - shift)
+		}
+		septets = append(septets, byte(value&0x7F))
+	}
+	return septets
+}
+
+// decodeGSM7 maps septets to text
+func decodeGSM7(septets []byte) string {
+	var text strings.Builder
+	for i := 0; i < len(septets); i++ {
+		septet := septets[i]
+		if septet == gsm7Escape && i+1 < len(septets) {
+			i++
+			if r, ok := gsm7Extension[septets[i]]; ok {
+				text.WriteRune(r)
+				continue
+			}
+			// Unknown extensions fall back to the basic character
+			septet = septets[i]
+		}
+		text.WriteRune(gsm7Basic[septet])
+	}
+	return text.String()
+}
+
+// encodeGSM7 maps text to septets, extension characters take two
+func encodeGSM7(text string) ([]byte, error) {
+	septets := make([]byte, 0, len(text))
+	for _, r := range text {
+		if septet, ok := gsm7Reverse[r]; ok {
+			septets = append(septets, septet)
+			continue
+		}
+		if septet, ok := gsm7ExtensionReverse[r]; ok {
+			septets = append(septets, gsm7Escape, septet)
+			continue
+		}
+		return nil, fmt.Errorf("%w: %q is not in the GSM 7-bit alphabet", ErrPDU, r)
+	}
+	return septets, nil
+}
+
+// packSeptets packs septets into octets starting at bit skip, the octets
+// before it are left zero for a user data header
+func packSeptets(septets []byte, skip int) []byte {
+	out := make([]byte, (skip+len(septets)*7+7)/8)
+	for i, septet := range septets {
+		bit := skip + i*7
+		index := bit / 8
+		shift := uint(bit % 8)
+		out[index] |= septet << shift
+		if shift > 1 {
+			out[index+1] |= septet >> (8 - shift)
+		}
+	}
+	return out
+}
+
+var gsm7Reverse, gsm7ExtensionReverse = func() (map[rune]byte, map[rune]byte) {
+	basic := make(map[rune]byte, len(gsm7Basic))
+	for i, r := range gsm7Basic {
+		if i != gsm7Escape {
+			basic[r] = byte(i)
+		}
+	}
+	extension := make(map[rune]byte, len(gsm7Extension))
+	for septet, r := range gsm7Extension {
+		extension[r] = septet
+	}
+	return basic, extension
+}()
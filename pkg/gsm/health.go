@@ -0,0 +1,250 @@
+package gsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-gsm/pkg/logrus"
+	"sync"
+	"time"
+)
+
+// HealthStatus summarizes the recent samples of a Monitor
+type HealthStatus int
+
+const (
+	// HealthUnknown until the first sample, or without a monitor
+	HealthUnknown HealthStatus = iota
+	HealthOK
+	// HealthDegraded answers AT but has weak signal, no registration or
+	// missed a few polls
+	HealthDegraded
+	// HealthDead stopped answering
+	HealthDead
+)
+
+func (h HealthStatus) String() string {
+	switch h {
+	case HealthOK:
+		return "ok"
+	case HealthDegraded:
+		return "degraded"
+	case HealthDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// HealthSample is one poll of a Monitor
+type HealthSample struct {
+	Time time.Time
+	// Alive is whether the liveness AT was answered, Latency how fast
+	Alive        bool
+	Latency      time.Duration
+	RSSI         int
+	Signal       int
+	Registration RegistrationStatus
+	// Err is the first failed command of the poll
+	Err error
+}
+
+// HealthChanged is published when the status of a Monitor changes
+type HealthChanged struct {
+	PortName string
+	Status   HealthStatus
+	Previous HealthStatus
+	// Reason explains the new status, e.g. "signal 0/5"
+	Reason string
+	Sample HealthSample
+}
+
+func (HealthChanged) EventName() string { return "health_changed" }
+
+// MonitorOptions configures a Monitor, zero values take the defaults
+type MonitorOptions struct {
+	// Interval between polls, 30s by default
+	Interval time.Duration
+	// Timeout of each polled command, DefaultCommandTimeout by default
+	Timeout time.Duration
+	// History is how many samples are kept, 120 by default
+	History int
+	// MinSignal in bars below which the modem is degraded, 1 by default
+	MinSignal int
+	// DeadAfter consecutive unanswered polls mark the modem dead, 3 by
+	// default
+	DeadAfter int
+}
+
+// Monitor polls liveness, signal and registration of a modem in the
+// background
+type Monitor struct {
+	subject *SerialSubject
+	opts    MonitorOptions
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	mu       sync.RWMutex
+	history  []HealthSample
+	status   HealthStatus
+	failures int
+}
+
+// StartMonitor starts polling until ctx is done, Stop is called or the
+// subject is closed. A running monitor of the subject is stopped first.
+func (s *SerialSubject) StartMonitor(ctx context.Context, opts MonitorOptions) *Monitor {
+	if opts.Interval <= 0 {
+		opts.Interval = 30 * time.Second
+	}
+	if opts.History <= 0 {
+		opts.History = 120
+	}
+	if opts.MinSignal <= 0 {
+		opts.MinSignal = 1
+	}
+	if opts.DeadAfter <= 0 {
+		opts.DeadAfter = 3
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	m := &Monitor{subject: s, opts: opts, cancel: cancel, done: make(chan struct{})}
+	s.mu.Lock()
+	previous := s.monitor
+	s.monitor = m
+	s.mu.Unlock()
+	if previous != nil {
+		previous.Stop()
+	}
+	go m.run(ctx)
+	return m
+}
+
+// Health returns the status of the subject's monitor, HealthUnknown when
+// none was started
+func (s *SerialSubject) Health() HealthStatus {
+	s.mu.RLock()
+	m := s.monitor
+	s.mu.RUnlock()
+	if m == nil {
+		return HealthUnknown
+	}
+	return m.Health()
+}
+
+// Stop ends polling and waits for the poll in progress
+func (m *Monitor) Stop() {
+	m.cancel()
+	<-m.done
+}
+
+// Health returns the current status
+func (m *Monitor) Health() HealthStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
+
+// History returns the kept samples, oldest first
+func (m *Monitor) History() []HealthSample {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]HealthSample(nil), m.history...)
+}
+
+func (m *Monitor) run(ctx context.Context) {
+	defer close(m.done)
+	ticker := time.NewTicker(m.opts.Interval)
+	defer ticker.Stop()
+	for {
+		m.record(m.poll(ctx))
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.subject.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll takes one sample
+func (m *Monitor) poll(ctx context.Context) HealthSample {
+	s := m.subject
+	sample := HealthSample{Time: time.Now(), RSSI: 99}
+	start := time.Now()
+	if _, err := s.ExecContext(ctx, Command{Line: "AT", Timeout: m.opts.Timeout}); err != nil {
+		sample.Err = err
+		return sample
+	}
+	sample.Alive = true
+	sample.Latency = time.Since(start)
+
+	response, err := s.ExecContext(ctx, Command{Line: "AT+CSQ", Prefix: "+CSQ", Timeout: m.opts.Timeout})
+	if err != nil {
+		sample.Err = err
+	} else if rssi, ok := parseCSQ(response.First()); ok {
+		sample.RSSI = rssi
+		s.setSignal(rssi)
+	}
+	sample.Signal = signalLevel(sample.RSSI)
+
+	response, err = s.ExecContext(ctx, Command{Line: "AT+CREG?", Prefix: "+CREG", Timeout: m.opts.Timeout})
+	if err != nil {
+		if sample.Err == nil {
+			sample.Err = err
+		}
+	} else if event, ok := parseCREG(response.First()); ok {
+		sample.Registration = event.Status
+		if s.Info().Registration != event.Status {
+			s.setRegistration(event)
+		}
+	}
+	return sample
+}
+
+// record keeps a sample and publishes the status when it changed
+func (m *Monitor) record(sample HealthSample) {
+	if errors.Is(sample.Err, context.Canceled) {
+		return
+	}
+	m.mu.Lock()
+	m.history = append(m.history, sample)
+	if len(m.history) > m.opts.History {
+		m.history = m.history[len(m.history)-m.opts.History:]
+	}
+	if sample.Alive {
+		m.failures = 0
+	} else {
+		m.failures++
+	}
+	status, reason := m.evaluate(sample)
+	previous := m.status
+	m.status = status
+	m.mu.Unlock()
+	if status == previous {
+		return
+	}
+	logrus.LogrusLoggerWithContext(m.subject.ctx).Warnf("Modem %s is %s: %s", m.subject.portName, status, reason)
+	m.subject.publish(HealthChanged{
+		PortName: m.subject.portName,
+		Status:   status,
+		Previous: previous,
+		Reason:   reason,
+		Sample:   sample,
+	})
+}
+
+// evaluate derives the status from the latest sample and the failure count
+func (m *Monitor) evaluate(sample HealthSample) (HealthStatus, string) {
+	switch {
+	case m.failures >= m.opts.DeadAfter:
+		return HealthDead, fmt.Sprintf("%d polls unanswered: %v", m.failures, sample.Err)
+	case !sample.Alive:
+		return HealthDegraded, fmt.Sprintf("no response: %v", sample.Err)
+	case !sample.Registration.Registered():
+		return HealthDegraded, sample.Registration.String()
+	case sample.Signal < m.opts.MinSignal:
+		return HealthDegraded, fmt.Sprintf("signal %d/5", sample.Signal)
+	case sample.Err != nil:
+		return HealthDegraded, sample.Err.Error()
+	}
+	return HealthOK, fmt.Sprintf("signal %d/5, %s", sample.Signal, sample.Registration)
+}
@@ -0,0 +1,173 @@
+package gsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-gsm/pkg/logrus"
+	"strings"
+	"time"
+)
+
+// ModemInfo is a snapshot of what is known about a modem and its SIM
+type ModemInfo struct {
+	PortName     string
+	IMEI         string
+	IMSI         string
+	ICCID        string
+	Manufacturer string
+	Model        string
+	Firmware     string
+	// Operator is the name reported by COPS, Network its normalized form
+	// such as "Viettel"
+	Operator string
+	Network  string
+	// MSISDN is empty when the SIM does not store its own number
+	MSISDN string
+	// RSSI is the raw +CSQ value, Signal 0-5 bars
+	RSSI         int
+	Signal       int
+	Registration RegistrationStatus
+	// UpdatedAt is when RefreshInfo last completed
+	UpdatedAt time.Time
+}
+
+// Info returns a consistent copy of the modem information. Fields are
+// filled by the init profile, URCs and RefreshInfo.
+func (s *SerialSubject) Info() ModemInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info := s.info
+	info.PortName = s.portName
+	return info
+}
+
+// updateInfo changes the snapshot under the lock
+func (s *SerialSubject) updateInfo(update func(info *ModemInfo)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(&s.info)
+}
+
+// imeiCommand reads the IMEI, answered bare or as +CGSN: <imei>
+var imeiCommand = Command{Line: "AT+CGSN", Prefix: "+CGSN", bare: true}
+
+func parseIMEI(r *Response) string {
+	return strings.Trim(strings.TrimSpace(strings.TrimPrefix(r.First(), "+CGSN:")), `"`)
+}
+
+// infoQuery reads one identity field
+type infoQuery struct {
+	command Command
+	apply   func(info *ModemInfo, response *Response)
+}
+
+var infoQueries = []infoQuery{
+	{imeiCommand, func(info *ModemInfo, r *Response) {
+		info.IMEI = parseIMEI(r)
+	}},
+	{Command{Line: "AT+CIMI"}, func(info *ModemInfo, r *Response) {
+		info.IMSI = strings.TrimSpace(r.First())
+	}},
+	{Command{Line: "AT+CCID", Prefix: "+CCID"}, func(info *ModemInfo, r *Response) {
+		info.ICCID = parseCCID(r.First())
+	}},
+	{Command{Line: "ATI"}, func(info *ModemInfo, r *Response) {
+		// Quectel
+		// EC25
+		// Revision: EC25EFAR06A06M4G
+		for i, line := range r.Lines {
+			switch {
+			case strings.HasPrefix(line, "Revision:"):
+				if info.Firmware == "" {
+					info.Firmware = strings.TrimSpace(strings.TrimPrefix(line, "Revision:"))
+				}
+			case i == 0:
+				info.Manufacturer = strings.TrimSpace(line)
+			case i == 1:
+				info.Model = strings.TrimSpace(line)
+			}
+		}
+	}},
+	{Command{Line: "AT+CGMR", Prefix: "+CGMR", bare: true}, func(info *ModemInfo, r *Response) {
+		if firmware := strings.TrimSpace(strings.TrimPrefix(r.First(), "+CGMR:")); firmware != "" {
+			info.Firmware = firmware
+		}
+	}},
+	{Command{Line: "AT+COPS?", Prefix: "+COPS"}, func(info *ModemInfo, r *Response) {
+		info.Operator = parseOperator(r.First())
+		info.Network = extractNetwork(r.First())
+	}},
+	{Command{Line: "AT+CNUM", Prefix: "+CNUM"}, func(info *ModemInfo, r *Response) {
+		info.MSISDN = extractNumber(r.First())
+	}},
+	{Command{Line: "AT+CSQ", Prefix: "+CSQ"}, func(info *ModemInfo, r *Response) {
+		if rssi, ok := parseCSQ(r.First()); ok {
+			info.RSSI = rssi
+			info.Signal = signalLevel(rssi)
+		}
+	}},
+	{Command{Line: "AT+CREG?", Prefix: "+CREG"}, func(info *ModemInfo, r *Response) {
+		if event, ok := parseCREG(r.First()); ok {
+			info.Registration = event.Status
+		}
+	}},
+}
+
+// RefreshInfo queries every identity field and returns the new snapshot.
+// A failing query keeps the previous value of its field and is reported in
+// the joined error.
+func (s *SerialSubject) RefreshInfo(ctx context.Context) (ModemInfo, error) {
+	var errs []error
+	for _, query := range infoQueries {
+		response, err := s.ExecContext(ctx, query.command)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, ErrClosed) || errors.Is(err, ErrDisconnected) {
+				return s.Info(), err
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", query.command.Line, err))
+			continue
+		}
+		s.updateInfo(func(info *ModemInfo) { query.apply(info, response) })
+	}
+	s.updateInfo(func(info *ModemInfo) { info.UpdatedAt = time.Now() })
+	return s.Info(), errors.Join(errs...)
+}
+
+// RefreshInfoEvery calls RefreshInfo at every interval until ctx is done or
+// the subject is closed
+func (s *SerialSubject) RefreshInfoEvery(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.closed:
+				return
+			case <-ticker.C:
+			}
+			if _, err := s.RefreshInfo(ctx); err != nil {
+				logrus.LogrusLoggerWithContext(s.ctx).Warnf("Refreshing info of %s: %v", s.portName, err)
+			}
+		}
+	}()
+}
+
+// parseCCID strips the prefix of +CCID or +QCCID
+func parseCCID(line string) string {
+	if index := strings.Index(line, ":"); index != -1 {
+		line = line[index+1:]
+	}
+	return strings.Trim(strings.TrimSpace(line), "\"")
+}
+
+// parseOperator returns the quoted name of +COPS: <mode>,<format>,"<oper>"
+func parseOperator(line string) string {
+	fields := splitFields(strings.TrimPrefix(line, "+COPS:"))
+	if len(fields) < 3 {
+		return ""
+	}
+	return fields[2]
+}
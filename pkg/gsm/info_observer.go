@@ -17,7 +17,7 @@ func NewInfoObserver(subject *SerialSubject) *InfoObserver {
 }
 
 func (u *InfoObserver) isInfoResponse(data string) bool {
-	allows := []string{"+CSQ:", "+CCID:"}
+	allows := []string{"+CSQ:", "+CCID:", "+CREG:"}
 	for _, allow := range allows {
 		if strings.Contains(data, allow) {
 			return true
@@ -32,19 +32,79 @@ func (u *InfoObserver) Update(data string) {
 	}
 	if strings.Contains(data, "+CSQ:") {
 		// Tín hiệu mạng
-		signalStr := strings.TrimSpace(strings.Split(data, "+CSQ:")[1])
-		signalStr = strings.Split(signalStr, ",")[0]
-		signal, err := strconv.Atoi(signalStr)
-		if err != nil {
+		rssi, ok := parseCSQ(data)
+		if !ok {
 			return
 		}
-		signal = (signal * 5) / 31
-		u.SerialSubject.signal = signal
-		logrus.LogrusLoggerWithContext(u.SerialSubject.ctx).Infof("Signal strength: %d", signal)
+		u.SerialSubject.setSignal(rssi)
+		logrus.LogrusLoggerWithContext(u.SerialSubject.ctx).Infof("Signal strength: %d", signalLevel(rssi))
 	}
 	if strings.Contains(data, "+CCID:") {
 		// ICCID
-		u.SerialSubject.ccid = strings.TrimSpace(strings.Split(data, "+CCID:")[1])
-		logrus.LogrusLoggerWithContext(u.SerialSubject.ctx).Infof("ICCID: %s", u.SerialSubject.ccid)
+		ccid := parseCCID(data)
+		u.SerialSubject.updateInfo(func(info *ModemInfo) { info.ICCID = ccid })
+		logrus.LogrusLoggerWithContext(u.SerialSubject.ctx).Infof("ICCID: %s", ccid)
 	}
+	if strings.HasPrefix(data, "+CREG:") {
+		if event, ok := parseCREG(data); ok {
+			logrus.LogrusLoggerWithContext(u.SerialSubject.ctx).Infof("Registration: %s", event.Status)
+			u.SerialSubject.setRegistration(event)
+		}
+	}
+}
+
+// setSignal stores a +CSQ reading and publishes SignalChanged when it moved
+func (s *SerialSubject) setSignal(rssi int) {
+	signal := signalLevel(rssi)
+	changed := false
+	s.updateInfo(func(info *ModemInfo) {
+		changed = info.RSSI != rssi
+		info.RSSI = rssi
+		info.Signal = signal
+	})
+	if changed {
+		s.publish(SignalChanged{PortName: s.portName, RSSI: rssi, Level: signal})
+	}
+}
+
+// setRegistration stores a +CREG status and publishes it
+func (s *SerialSubject) setRegistration(event RegistrationChanged) {
+	event.PortName = s.portName
+	s.updateInfo(func(info *ModemInfo) { info.Registration = event.Status })
+	s.publish(event)
+}
+
+// parseCREG reads both the URC, +CREG: <stat>[,<lac>,<ci>], and the
+// AT+CREG? response, +CREG: <n>,<stat>[,<lac>,<ci>]. The second field is a
+// one digit <stat> only in the response, <lac> is four hex digits.
+func parseCREG(line string) (RegistrationChanged, bool) {
+	fields := splitFields(strings.TrimPrefix(line, "+CREG:"))
+	if len(fields) == 2 || len(fields) >= 4 && len(fields[1]) == 1 {
+		fields = fields[1:]
+	}
+	stat, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return RegistrationChanged{}, false
+	}
+	event := RegistrationChanged{Status: RegistrationStatus(stat)}
+	if len(fields) >= 3 {
+		event.LAC = fields[1]
+		event.CellID = fields[2]
+	}
+	return event, true
+}
+
+// parseCSQ returns the <rssi> of +CSQ: <rssi>,<ber>
+func parseCSQ(line string) (int, bool) {
+	fields := splitFields(line[strings.Index(line, ":")+1:])
+	rssi, err := strconv.Atoi(fields[0])
+	return rssi, err == nil
+}
+
+// signalLevel maps an RSSI to 0-5 bars, 99 is unknown
+func signalLevel(rssi int) int {
+	if rssi == 99 {
+		return 0
+	}
+	return (rssi * 5) / 31
 }
@@ -0,0 +1,862 @@
+package gsm
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// ErrPDU is returned for malformed or unsupported PDUs
+var ErrPDU = errors.New("invalid PDU")
+
+// MessageType is the TP-MTI of a PDU
+type MessageType byte
+
+const (
+	MessageDeliver      MessageType = 0x00
+	MessageSubmit       MessageType = 0x01
+	MessageStatusReport MessageType = 0x02
+)
+
+func (m MessageType) String() string {
+	switch m {
+	case MessageDeliver:
+		return "SMS-DELIVER"
+	case MessageSubmit:
+		return "SMS-SUBMIT"
+	case MessageStatusReport:
+		return "SMS-STATUS-REPORT"
+	}
+	return "reserved"
+}
+
+// PDU is a decoded *Deliver, *Submit or *StatusReport
+type PDU interface {
+	Type() MessageType
+	// Encode returns the hex PDU including the SMSC address and the length
+	// in octets of the TPDU without it, as AT+CMGS expects
+	Encode() (string, int, error)
+}
+
+// NumberType is the type of number of an address
+type NumberType byte
+
+const (
+	TypeUnknown       NumberType = 0
+	TypeInternational NumberType = 1
+	TypeNational      NumberType = 2
+	TypeNetwork       NumberType = 3
+	TypeSubscriber    NumberType = 4
+	TypeAlphanumeric  NumberType = 5
+	TypeAbbreviated   NumberType = 6
+)
+
+// Address is a phone number or an alphanumeric sender
+type Address struct {
+	// Number holds the digits without "+", or the alphanumeric text
+	Number string
+	Type   NumberType
+	// Plan is the numbering plan, 1 (ISDN/E.164) for phone numbers
+	Plan byte
+}
+
+// ParseAddress guesses the type of a number: "+84..." is international,
+// digits only unknown and anything else alphanumeric
+func ParseAddress(number string) Address {
+	switch {
+	case strings.HasPrefix(number, "+"):
+		return Address{Number: number[1:], Type: TypeInternational, Plan: 1}
+	case strings.Trim(number, "0123456789*#") == "":
+		return Address{Number: number, Type: TypeUnknown, Plan: 1}
+	}
+	return Address{Number: number, Type: TypeAlphanumeric}
+}
+
+// String formats the address, international numbers get a "+"
+func (a Address) String() string {
+	if a.Type == TypeInternational && a.Number != "" {
+		return "+" + a.Number
+	}
+	return a.Number
+}
+
+func (a Address) typeOctet() byte {
+	return 0x80 | byte(a.Type&0x07)<<4 | a.Plan&0x0F
+}
+
+// Alphabet is the character set of the user data
+type Alphabet int
+
+const (
+	AlphabetGSM7 Alphabet = iota
+	Alphabet8Bit
+	AlphabetUCS2
+)
+
+func (a Alphabet) String() string {
+	switch a {
+	case Alphabet8Bit:
+		return "8-bit"
+	case AlphabetUCS2:
+		return "UCS2"
+	}
+	return "GSM 7-bit"
+}
+
+// DCS is the TP-Data-Coding-Scheme
+type DCS byte
+
+// DCSFor returns the general data coding without class for an alphabet
+func DCSFor(alphabet Alphabet) DCS {
+	switch alphabet {
+	case Alphabet8Bit:
+		return 0x04
+	case AlphabetUCS2:
+		return 0x08
+	}
+	return 0x00
+}
+
+// Alphabet returns the character set the scheme selects
+func (d DCS) Alphabet() Alphabet {
+	switch {
+	case d&0xC0 == 0x00, d&0xC0 == 0x40:
+		// General data coding, bits 3-2 are the alphabet
+		switch (d >> 2) & 0x03 {
+		case 1:
+			return Alphabet8Bit
+		case 2:
+			return AlphabetUCS2
+		}
+	case d&0xF0 == 0xE0:
+		return AlphabetUCS2
+	case d&0xF0 == 0xF0:
+		if d&0x04 != 0 {
+			return Alphabet8Bit
+		}
+	}
+	return AlphabetGSM7
+}
+
+// Class returns the message class, 0 is a flash message
+func (d DCS) Class() (int, bool) {
+	if d&0xC0 == 0x00 && d&0x10 != 0 || d&0xF0 == 0xF0 {
+		return int(d & 0x03), true
+	}
+	return 0, false
+}
+
+// Compressed reports whether the user data is compressed, which is not
+// supported
+func (d DCS) Compressed() bool {
+	return d&0xC0 == 0x00 && d&0x20 != 0
+}
+
+// ValidityFormat is the TP-VPF of an SMS-SUBMIT
+type ValidityFormat byte
+
+const (
+	ValidityNone     ValidityFormat = 0
+	ValidityEnhanced ValidityFormat = 1
+	ValidityRelative ValidityFormat = 2
+	ValidityAbsolute ValidityFormat = 3
+)
+
+// ValidityPeriod is how long the SMSC keeps trying to deliver a message
+type ValidityPeriod struct {
+	Format ValidityFormat
+	// Relative is rounded up to what the format can express, at most 63
+	// weeks
+	Relative time.Duration
+	Absolute time.Time
+	// Enhanced is kept as received, it is rarely used
+	Enhanced [7]byte
+}
+
+// RelativeValidity is a ValidityPeriod of d
+func RelativeValidity(d time.Duration) ValidityPeriod {
+	return ValidityPeriod{Format: ValidityRelative, Relative: d}
+}
+
+// encodeRelative maps a duration to the TP-VP octet, 23.040 9.2.3.12.1
+func encodeRelative(d time.Duration) byte {
+	switch {
+	case d <= 12*time.Hour:
+		return byte(max(ceilDiv(d, 5*time.Minute)-1, 0))
+	case d <= 24*time.Hour:
+		return byte(143 + ceilDiv(d-12*time.Hour, 30*time.Minute))
+	case d <= 30*24*time.Hour:
+		return byte(166 + ceilDiv(d, 24*time.Hour))
+	case d <= 63*7*24*time.Hour:
+		return byte(192 + ceilDiv(d, 7*24*time.Hour))
+	}
+	return 255
+}
+
+func decodeRelative(v byte) time.Duration {
+	switch {
+	case v <= 143:
+		return time.Duration(int(v)+1) * 5 * time.Minute
+	case v <= 167:
+		return 12*time.Hour + time.Duration(int(v)-143)*30*time.Minute
+	case v <= 196:
+		return time.Duration(int(v)-166) * 24 * time.Hour
+	}
+	return time.Duration(int(v)-192) * 7 * 24 * time.Hour
+}
+
+func ceilDiv(d, unit time.Duration) int {
+	return int((d + unit - 1) / unit)
+}
+
+// InformationElement is one entry of a user data header
+type InformationElement struct {
+	ID   byte
+	Data []byte
+}
+
+// Information element identifiers for concatenated messages
+const (
+	IEConcat8  byte = 0x00
+	IEConcat16 byte = 0x08
+)
+
+// UserDataHeader holds the information elements preceding the user data
+type UserDataHeader []InformationElement
+
+// ConcatHeader returns the header of part seq (1-based) of total parts,
+// references above 255 use the 16-bit element
+func ConcatHeader(reference, total, seq int) UserDataHeader {
+	if reference > 0xFF {
+		return UserDataHeader{{ID: IEConcat16, Data: []byte{byte(reference >> 8), byte(reference), byte(total), byte(seq)}}}
+	}
+	return UserDataHeader{{ID: IEConcat8, Data: []byte{byte(reference), byte(total), byte(seq)}}}
+}
+
+// Concat returns the concatenation info, ok is false for single messages
+func (h UserDataHeader) Concat() (reference, total, seq int, ok bool) {
+	for _, ie := range h {
+		switch {
+		case ie.ID == IEConcat8 && len(ie.Data) == 3:
+			return int(ie.Data[0]), int(ie.Data[1]), int(ie.Data[2]), true
+		case ie.ID == IEConcat16 && len(ie.Data) == 4:
+			return int(ie.Data[0])<<8 | int(ie.Data[1]), int(ie.Data[2]), int(ie.Data[3]), true
+		}
+	}
+	return 0, 0, 0, false
+}
+
+// encode returns the header with its length octet, nil when empty
+func (h UserDataHeader) encode() []byte {
+	if len(h) == 0 {
+		return nil
+	}
+	out := []byte{0}
+	for _, ie := range h {
+		out = append(out, ie.ID, byte(len(ie.Data)))
+		out = append(out, ie.Data...)
+	}
+	out[0] = byte(len(out) - 1)
+	return out
+}
+
+func decodeUDH(data []byte) (UserDataHeader, error) {
+	var header UserDataHeader
+	for i := 0; i < len(data); {
+		if i+2 > len(data) || i+2+int(data[i+1]) > len(data) {
+			return nil, fmt.Errorf("%w: user data header", ErrPDU)
+		}
+		length := int(data[i+1])
+		header = append(header, InformationElement{ID: data[i], Data: append([]byte(nil), data[i+2:i+2+length]...)})
+		i += 2 + length
+	}
+	return header, nil
+}
+
+// Deliver is an SMS-DELIVER, a message received from the network
+type Deliver struct {
+	SMSC Address
+	// MoreMessages is set when the SMSC has more messages waiting
+	MoreMessages bool
+	ReplyPath    bool
+	// StatusReport is set when the sender asked for a status report
+	StatusReport bool
+	Originator   Address
+	PID          byte
+	DCS          DCS
+	Timestamp    time.Time
+	UDH          UserDataHeader
+	// Text is the decoded user data, Data the raw user data of 8-bit
+	// messages
+	Text string
+	Data []byte
+}
+
+func (*Deliver) Type() MessageType { return MessageDeliver }
+
+// Submit is an SMS-SUBMIT, a message sent to the network
+type Submit struct {
+	// SMSC is left empty to use the one configured on the SIM
+	SMSC             Address
+	RejectDuplicates bool
+	// StatusReportRequest asks the SMSC for an SMS-STATUS-REPORT
+	StatusReportRequest bool
+	ReplyPath           bool
+	// Reference is the TP-MR, modems replace it with their own counter
+	Reference   byte
+	Destination Address
+	PID         byte
+	DCS         DCS
+	Validity    ValidityPeriod
+	UDH         UserDataHeader
+	// Text is encoded in the alphabet of DCS, Data is sent as is for 8-bit
+	Text string
+	Data []byte
+}
+
+func (*Submit) Type() MessageType { return MessageSubmit }
+
+// TPStatus is the TP-ST of a status report
+type TPStatus byte
+
+// Delivered reports whether the message reached the recipient
+func (s TPStatus) Delivered() bool { return s <= 0x02 }
+
+// Pending reports whether the SMSC is still trying
+func (s TPStatus) Pending() bool { return s >= 0x20 && s <= 0x3F }
+
+// Failed reports whether the SMSC gave up
+func (s TPStatus) Failed() bool { return s >= 0x40 }
+
+// Expired reports whether the validity period ran out
+func (s TPStatus) Expired() bool { return s == 0x46 }
+
+// StatusReport is an SMS-STATUS-REPORT about a submitted message
+type StatusReport struct {
+	SMSC         Address
+	MoreMessages bool
+	// Reference is the TP-MR of the submitted message
+	Reference byte
+	Recipient Address
+	// Timestamp is when the SMSC received the message, Discharge when
+	// Status was reached
+	Timestamp time.Time
+	Discharge time.Time
+	Status    TPStatus
+}
+
+func (*StatusReport) Type() MessageType { return MessageStatusReport }
+
+// DecodePDU decodes a hex PDU starting with the SMSC address, as listed by
+// AT+CMGR and AT+CMGL or pushed with +CMT and +CDS in PDU mode
+func DecodePDU(hexPDU string) (PDU, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(hexPDU))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPDU, err)
+	}
+	r := &pduReader{data: data}
+	smsc, err := r.smsc()
+	if err != nil {
+		return nil, err
+	}
+	first, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch MessageType(first & 0x03) {
+	case MessageDeliver:
+		return r.deliver(smsc, first)
+	case MessageSubmit:
+		return r.submit(smsc, first)
+	case MessageStatusReport:
+		return r.statusReport(smsc, first)
+	}
+	return nil, fmt.Errorf("%w: reserved message type", ErrPDU)
+}
+
+// pduReader walks the octets of a PDU
+type pduReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *pduReader) byte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, fmt.Errorf("%w: truncated at octet %d", ErrPDU, r.pos)
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *pduReader) bytes(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, fmt.Errorf("%w: truncated at octet %d", ErrPDU, r.pos)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// smsc reads the SMSC address, its length counts octets including the type
+func (r *pduReader) smsc() (Address, error) {
+	length, err := r.byte()
+	if err != nil || length == 0 {
+		return Address{}, err
+	}
+	data, err := r.bytes(int(length))
+	if err != nil {
+		return Address{}, err
+	}
+	return decodeAddress(data[1:], (int(length)-1)*2, data[0]), nil
+}
+
+// address reads a TP address, its length counts useful semi-octets
+func (r *pduReader) address() (Address, error) {
+	digits, err := r.byte()
+	if err != nil {
+		return Address{}, err
+	}
+	typ, err := r.byte()
+	if err != nil {
+		return Address{}, err
+	}
+	data, err := r.bytes((int(digits) + 1) / 2)
+	if err != nil {
+		return Address{}, err
+	}
+	return decodeAddress(data, int(digits), typ), nil
+}
+
+func (r *pduReader) timestamp() (time.Time, error) {
+	data, err := r.bytes(7)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return decodeSCTS(data), nil
+}
+
+// userData reads TP-UDL and TP-UD
+func (r *pduReader) userData(udhi bool, dcs DCS) (UserDataHeader, string, []byte, error) {
+	length, err := r.byte()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if dcs.Compressed() {
+		return nil, "", nil, fmt.Errorf("%w: compressed user data", ErrPDU)
+	}
+	data := r.data[r.pos:]
+	var header UserDataHeader
+	headerLength := 0
+	if udhi {
+		if len(data) == 0 || int(data[0])+1 > len(data) {
+			return nil, "", nil, fmt.Errorf("%w: user data header", ErrPDU)
+		}
+		headerLength = int(data[0]) + 1
+		if header, err = decodeUDH(data[1:headerLength]); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	if dcs.Alphabet() == AlphabetGSM7 {
+		skip := (headerLength*8 + 6) / 7
+		if (int(length)*7+7)/8 > len(data) || int(length) < skip {
+			return nil, "", nil, fmt.Errorf("%w: user data length %d", ErrPDU, length)
+		}
+		r.pos = len(r.data)
+		return header, decodeGSM7(unpackSeptets(data, skip*7, int(length)-skip)), nil, nil
+	}
+	if int(length) > len(data) || int(length) < headerLength {
+		return nil, "", nil, fmt.Errorf("%w: user data length %d", ErrPDU, length)
+	}
+	r.pos += int(length)
+	body := data[headerLength:length]
+	if dcs.Alphabet() == AlphabetUCS2 {
+		return header, decodeUCS2Bytes(body), nil, nil
+	}
+	return header, string(body), append([]byte(nil), body...), nil
+}
+
+func (r *pduReader) deliver(smsc Address, first byte) (*Deliver, error) {
+	d := &Deliver{
+		SMSC:         smsc,
+		MoreMessages: first&0x04 == 0,
+		StatusReport: first&0x20 != 0,
+		ReplyPath:    first&0x80 != 0,
+	}
+	var err error
+	if d.Originator, err = r.address(); err != nil {
+		return nil, err
+	}
+	if d.PID, err = r.byte(); err != nil {
+		return nil, err
+	}
+	dcs, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	d.DCS = DCS(dcs)
+	if d.Timestamp, err = r.timestamp(); err != nil {
+		return nil, err
+	}
+	d.UDH, d.Text, d.Data, err = r.userData(first&0x40 != 0, d.DCS)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (r *pduReader) submit(smsc Address, first byte) (*Submit, error) {
+	s := &Submit{
+		SMSC:                smsc,
+		RejectDuplicates:    first&0x04 != 0,
+		StatusReportRequest: first&0x20 != 0,
+		ReplyPath:           first&0x80 != 0,
+	}
+	var err error
+	if s.Reference, err = r.byte(); err != nil {
+		return nil, err
+	}
+	if s.Destination, err = r.address(); err != nil {
+		return nil, err
+	}
+	if s.PID, err = r.byte(); err != nil {
+		return nil, err
+	}
+	dcs, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	s.DCS = DCS(dcs)
+	s.Validity.Format = ValidityFormat((first >> 3) & 0x03)
+	switch s.Validity.Format {
+	case ValidityRelative:
+		v, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		s.Validity.Relative = decodeRelative(v)
+	case ValidityAbsolute:
+		if s.Validity.Absolute, err = r.timestamp(); err != nil {
+			return nil, err
+		}
+	case ValidityEnhanced:
+		data, err := r.bytes(7)
+		if err != nil {
+			return nil, err
+		}
+		copy(s.Validity.Enhanced[:], data)
+	}
+	s.UDH, s.Text, s.Data, err = r.userData(first&0x40 != 0, s.DCS)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (r *pduReader) statusReport(smsc Address, first byte) (*StatusReport, error) {
+	s := &StatusReport{SMSC: smsc, MoreMessages: first&0x04 == 0}
+	var err error
+	if s.Reference, err = r.byte(); err != nil {
+		return nil, err
+	}
+	if s.Recipient, err = r.address(); err != nil {
+		return nil, err
+	}
+	if s.Timestamp, err = r.timestamp(); err != nil {
+		return nil, err
+	}
+	if s.Discharge, err = r.timestamp(); err != nil {
+		return nil, err
+	}
+	status, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	// Optional parameters after TP-ST carry nothing we use
+	s.Status = TPStatus(status)
+	return s, nil
+}
+
+// pduWriter builds a PDU
+type pduWriter struct {
+	data []byte
+}
+
+func (w *pduWriter) smsc(a Address) error {
+	if a.Number == "" {
+		w.data = append(w.data, 0x00)
+		return nil
+	}
+	digits, err := encodeDigits(a.Number)
+	if err != nil {
+		return err
+	}
+	w.data = append(w.data, byte(len(digits)+1), a.typeOctet())
+	w.data = append(w.data, digits...)
+	return nil
+}
+
+func (w *pduWriter) address(a Address) error {
+	if a.Type == TypeAlphanumeric {
+		septets, err := encodeGSM7(a.Number)
+		if err != nil {
+			return err
+		}
+		packed := packSeptets(septets, 0)
+		w.data = append(w.data, byte((len(septets)*7+3)/4), a.typeOctet())
+		w.data = append(w.data, packed...)
+		return nil
+	}
+	digits, err := encodeDigits(a.Number)
+	if err != nil {
+		return err
+	}
+	w.data = append(w.data, byte(len(a.Number)), a.typeOctet())
+	w.data = append(w.data, digits...)
+	return nil
+}
+
+// userData appends TP-UDL and TP-UD
+func (w *pduWriter) userData(header UserDataHeader, dcs DCS, text string, data []byte) error {
+	udh := header.encode()
+	switch dcs.Alphabet() {
+	case AlphabetGSM7:
+		septets, err := encodeGSM7(text)
+		if err != nil {
+			return err
+		}
+		fill := (len(udh)*8 + 6) / 7
+		total := fill + len(septets)
+		if total > 160 {
+			return fmt.Errorf("%w: %d septets of user data", ErrPDU, total)
+		}
+		packed := packSeptets(septets, fill*7)
+		copy(packed, udh)
+		w.data = append(w.data, byte(total))
+		w.data = append(w.data, packed...)
+		return nil
+	case AlphabetUCS2:
+		data = encodeUCS2Bytes(text)
+	}
+	if len(udh)+len(data) > 140 {
+		return fmt.Errorf("%w: %d octets of user data", ErrPDU, len(udh)+len(data))
+	}
+	w.data = append(w.data, byte(len(udh)+len(data)))
+	w.data = append(w.data, udh...)
+	w.data = append(w.data, data...)
+	return nil
+}
+
+// encode returns the hex PDU and the TPDU length without the SMSC
+func (w *pduWriter) encode() (string, int) {
+	smsc := int(w.data[0]) + 1
+	return strings.ToUpper(hex.EncodeToString(w.data)), len(w.data) - smsc
+}
+
+// Encode builds the PDU for AT+CMGS
+func (s *Submit) Encode() (string, int, error) {
+	w := &pduWriter{}
+	if err := w.smsc(s.SMSC); err != nil {
+		return "", 0, err
+	}
+	first := byte(MessageSubmit) | byte(s.Validity.Format&0x03)<<3
+	if s.RejectDuplicates {
+		first |= 0x04
+	}
+	if s.StatusReportRequest {
+		first |= 0x20
+	}
+	if len(s.UDH) > 0 {
+		first |= 0x40
+	}
+	if s.ReplyPath {
+		first |= 0x80
+	}
+	w.data = append(w.data, first, s.Reference)
+	if err := w.address(s.Destination); err != nil {
+		return "", 0, err
+	}
+	w.data = append(w.data, s.PID, byte(s.DCS))
+	switch s.Validity.Format {
+	case ValidityRelative:
+		w.data = append(w.data, encodeRelative(s.Validity.Relative))
+	case ValidityAbsolute:
+		w.data = append(w.data, encodeSCTS(s.Validity.Absolute)...)
+	case ValidityEnhanced:
+		w.data = append(w.data, s.Validity.Enhanced[:]...)
+	}
+	if err := w.userData(s.UDH, s.DCS, s.Text, s.Data); err != nil {
+		return "", 0, err
+	}
+	hexPDU, length := w.encode()
+	return hexPDU, length, nil
+}
+
+// Encode builds the PDU, used to emulate a network
+func (d *Deliver) Encode() (string, int, error) {
+	w := &pduWriter{}
+	if err := w.smsc(d.SMSC); err != nil {
+		return "", 0, err
+	}
+	first := byte(MessageDeliver)
+	if !d.MoreMessages {
+		first |= 0x04
+	}
+	if d.StatusReport {
+		first |= 0x20
+	}
+	if len(d.UDH) > 0 {
+		first |= 0x40
+	}
+	if d.ReplyPath {
+		first |= 0x80
+	}
+	w.data = append(w.data, first)
+	if err := w.address(d.Originator); err != nil {
+		return "", 0, err
+	}
+	w.data = append(w.data, d.PID, byte(d.DCS))
+	w.data = append(w.data, encodeSCTS(d.Timestamp)...)
+	if err := w.userData(d.UDH, d.DCS, d.Text, d.Data); err != nil {
+		return "", 0, err
+	}
+	hexPDU, length := w.encode()
+	return hexPDU, length, nil
+}
+
+// Encode builds the PDU, used to emulate a network
+func (s *StatusReport) Encode() (string, int, error) {
+	w := &pduWriter{}
+	if err := w.smsc(s.SMSC); err != nil {
+		return "", 0, err
+	}
+	first := byte(MessageStatusReport)
+	if !s.MoreMessages {
+		first |= 0x04
+	}
+	w.data = append(w.data, first, s.Reference)
+	if err := w.address(s.Recipient); err != nil {
+		return "", 0, err
+	}
+	w.data = append(w.data, encodeSCTS(s.Timestamp)...)
+	w.data = append(w.data, encodeSCTS(s.Discharge)...)
+	w.data = append(w.data, byte(s.Status))
+	hexPDU, length := w.encode()
+	return hexPDU, length, nil
+}
+
+// decodeAddress reads semi-octet digits, or packed GSM 7-bit for
+// alphanumeric senders
+func decodeAddress(data []byte, digits int, typ byte) Address {
+	address := Address{Type: NumberType((typ >> 4) & 0x07), Plan: typ & 0x0F}
+	if address.Type == TypeAlphanumeric {
+		address.Number = decodeGSM7(unpackSeptets(data, 0, digits*4/7))
+		return address
+	}
+	address.Number = swapSemiOctets(data, digits)
+	return address
+}
+
+// swapSemiOctets reads BCD digits with the low nibble first, F is padding
+func swapSemiOctets(data []byte, digits int) string {
+	const semiOctets = "0123456789*#abc"
+	var out strings.Builder
+	for _, b := range data {
+		for _, nibble := range []byte{b & 0x0F, b >> 4} {
+			if out.Len() >= digits || nibble == 0x0F {
+				break
+			}
+			out.WriteByte(semiOctets[nibble])
+		}
+	}
+	return out.String()
+}
+
+// encodeDigits packs digits low nibble first, padding with F
+func encodeDigits(number string) ([]byte, error) {
+	out := make([]byte, (len(number)+1)/2)
+	for i := 0; i < len(number); i++ {
+		nibble := strings.IndexByte("0123456789*#abc", number[i])
+		if nibble == -1 {
+			return nil, fmt.Errorf("%w: %q is not a phone number", ErrPDU, number)
+		}
+		if i%2 == 0 {
+			out[i/2] = 0xF0 | byte(nibble)
+		} else {
+			out[i/2] = out[i/2]&0x0F | byte(nibble)<<4
+		}
+	}
+	return out, nil
+}
+
+// decodeSCTS reads a service centre timestamp, the zone is in quarters of
+// an hour
+func decodeSCTS(data []byte) time.Time {
+	digits := swapSemiOctets(data[:6], 12)
+	field := func(i int) int {
+		return int(digits[i]-'0')*10 + int(digits[i+1]-'0')
+	}
+	if len(digits) < 12 || strings.Trim(digits, "0123456789") != "" {
+		return time.Time{}
+	}
+	zone := data[6]
+	quarters := int(zone&0x07)*10 + int(zone>>4)
+	if zone&0x08 != 0 {
+		quarters = -quarters
+	}
+	location := time.FixedZone("", quarters*15*60)
+	return time.Date(2000+field(0), time.Month(field(2)), field(4), field(6), field(8), field(10), 0, location)
+}
+
+func encodeSCTS(t time.Time) []byte {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	_, offset := t.Zone()
+	quarters := offset / (15 * 60)
+	var sign byte
+	if quarters < 0 {
+		sign = 0x08
+		quarters = -quarters
+	}
+	bcd := func(v int) byte {
+		return byte(v%10)<<4 | byte(v/10%10)
+	}
+	return []byte{
+		bcd(t.Year() % 100), bcd(int(t.Month())), bcd(t.Day()),
+		bcd(t.Hour()), bcd(t.Minute()), bcd(t.Second()),
+		bcd(quarters) | sign,
+	}
+}
+
+// formatSCTS formats a timestamp like text mode, "yy/MM/dd,hh:mm:ss±zz"
+func formatSCTS(t time.Time) string {
+	_, offset := t.Zone()
+	quarters := offset / (15 * 60)
+	sign := "+"
+	if quarters < 0 {
+		sign = "-"
+		quarters = -quarters
+	}
+	return fmt.Sprintf("%s%s%02d", t.Format("06/01/02,15:04:05"), sign, quarters)
+}
+
+func decodeUCS2Bytes(data []byte) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+	}
+	return string(utf16.Decode(units))
+}
+
+func encodeUCS2Bytes(text string) []byte {
+	units := utf16.Encode([]rune(text))
+	out := make([]byte, 0, len(units)*2)
+	for _, unit := range units {
+		out = append(out, byte(unit>>8), byte(unit))
+	}
+	return out
+}
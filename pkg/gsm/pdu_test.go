@@ -0,0 +1,145 @@
+package gsm_test
+
+import (
+	"errors"
+	"go-gsm/pkg/gsm"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecodeDeliver(t *testing.T) {
+	pdu, err := gsm.DecodePDU("07911326040000F0040B911346610089F60000208062917314820CC8F71D14969741F977FD07")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver, ok := pdu.(*gsm.Deliver)
+	if !ok {
+		t.Fatalf("decoded %s", pdu.Type())
+	}
+	zone := time.FixedZone("", 7*3600)
+	if deliver.SMSC.String() != "+31624000000" || deliver.Originator.String() != "+31641600986" ||
+		deliver.DCS.Alphabet() != gsm.AlphabetGSM7 || deliver.Text != "How are you?" ||
+		!deliver.Timestamp.Equal(time.Date(2002, 8, 26, 19, 37, 41, 0, zone)) {
+		t.Errorf("got %+v", deliver)
+	}
+}
+
+func TestEncodeSubmit(t *testing.T) {
+	submit := &gsm.Submit{
+		Destination: gsm.ParseAddress("+46708251358"),
+		Validity:    gsm.RelativeValidity(4 * 24 * time.Hour),
+		Text:        "hellohello",
+	}
+	pdu, length, err := submit.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0011000B916407281553F80000AA0AE8329BFD4697D9EC37"; pdu != want || length != 23 {
+		t.Errorf("got %s (%d), want %s (23)", pdu, length, want)
+	}
+}
+
+func TestPDURoundTrip(t *testing.T) {
+	zone := time.FixedZone("", -5*3600)
+	stamp := time.Date(2024, 10, 17, 10, 30, 0, 0, zone)
+	tests := []gsm.PDU{
+		&gsm.Deliver{
+			SMSC:         gsm.ParseAddress("+84980200030"),
+			MoreMessages: true,
+			Originator:   gsm.ParseAddress("Viettel"),
+			DCS:          gsm.DCSFor(gsm.AlphabetUCS2),
+			Timestamp:    stamp,
+			UDH:          gsm.ConcatHeader(0x1234, 3, 2),
+			Text:         "Khuyến mãi 50% 🎉",
+		},
+		&gsm.Deliver{
+			Originator: gsm.Address{Number: "0900000000", Type: gsm.TypeNational, Plan: 1},
+			PID:        0x40,
+			DCS:        gsm.DCSFor(gsm.Alphabet8Bit),
+			Timestamp:  stamp,
+			Text:       "\x00\x01\xff",
+			Data:       []byte{0x00, 0x01, 0xff},
+		},
+		&gsm.Submit{
+			StatusReportRequest: true,
+			RejectDuplicates:    true,
+			Reference:           42,
+			Destination:         gsm.ParseAddress("+84900000000"),
+			Validity:            gsm.ValidityPeriod{Format: gsm.ValidityAbsolute, Absolute: stamp},
+			UDH:                 gsm.ConcatHeader(7, 2, 1),
+			Text:                "{braces} [and] ~tilde~ €5",
+		},
+		&gsm.Submit{
+			Destination: gsm.ParseAddress("123"),
+			Validity:    gsm.RelativeValidity(30 * time.Minute),
+			Text:        "ok",
+		},
+		&gsm.StatusReport{
+			Reference: 42,
+			Recipient: gsm.ParseAddress("+84900000000"),
+			Timestamp: stamp,
+			Discharge: stamp.Add(time.Minute),
+			Status:    0x00,
+		},
+	}
+	for _, want := range tests {
+		pdu, _, err := want.Encode()
+		if err != nil {
+			t.Fatalf("encode %+v: %v", want, err)
+		}
+		got, err := gsm.DecodePDU(pdu)
+		if err != nil {
+			t.Fatalf("decode %s: %v", pdu, err)
+		}
+		if !reflect.DeepEqual(normalize(got), normalize(want)) {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", pdu, got, want)
+		}
+	}
+}
+
+// normalize makes timestamps comparable with DeepEqual
+func normalize(pdu gsm.PDU) gsm.PDU {
+	switch p := pdu.(type) {
+	case *gsm.Deliver:
+		c := *p
+		c.Timestamp = c.Timestamp.UTC()
+		return &c
+	case *gsm.Submit:
+		c := *p
+		c.Validity.Absolute = c.Validity.Absolute.UTC()
+		return &c
+	case *gsm.StatusReport:
+		c := *p
+		c.Timestamp, c.Discharge = c.Timestamp.UTC(), c.Discharge.UTC()
+		return &c
+	}
+	return pdu
+}
+
+func TestConcatHeader(t *testing.T) {
+	for _, reference := range []int{0x42, 0x1234} {
+		reference2, total, seq, ok := gsm.ConcatHeader(reference, 4, 3).Concat()
+		if !ok || reference2 != reference || total != 4 || seq != 3 {
+			t.Errorf("got %d %d/%d %v for reference %d", reference2, seq, total, ok, reference)
+		}
+	}
+	if _, _, _, ok := gsm.UserDataHeader(nil).Concat(); ok {
+		t.Error("empty header reports concatenation")
+	}
+}
+
+func TestDecodePDURejectsTruncated(t *testing.T) {
+	for _, pdu := range []string{"", "07911326", "07911326040000F0040B911346610089F6000020806291731482", "zz"} {
+		if _, err := gsm.DecodePDU(pdu); !errors.Is(err, gsm.ErrPDU) {
+			t.Errorf("%q: got %v", pdu, err)
+		}
+	}
+}
+
+func TestSubmitRejectsTextOutsideAlphabet(t *testing.T) {
+	submit := &gsm.Submit{Destination: gsm.ParseAddress("+84900000000"), Text: "chữ"}
+	if _, _, err := submit.Encode(); !errors.Is(err, gsm.ErrPDU) {
+		t.Errorf("got %v", err)
+	}
+}
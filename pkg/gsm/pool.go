@@ -0,0 +1,355 @@
+package gsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-gsm/pkg/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PoolOptions configures a ModemPool
+type PoolOptions struct {
+	BaudRate int
+	// PortOptions are applied after BaudRate when opening ports, e.g.
+	// WithAutoBaud for boards shipping at different rates
+	PortOptions []PortOption
+	// ProbeTimeout bounds the AT probe of each port
+	ProbeTimeout time.Duration
+	// Ports lists candidate ports, GetAvailablePorts by default
+	Ports func() ([]string, error)
+	// Open opens a port by name, CreatePortWithOptions by default
+	Open func(portName string) (Transport, error)
+	// Supervise reopens modems that drop off the bus
+	Supervise bool
+	// Profile replaces DefaultProfile for every modem
+	Profile *InitProfile
+	// Monitor starts a health monitor on every modem when set
+	Monitor *MonitorOptions
+	// Watchdog starts a watchdog on every modem when set, its Dial
+	// defaults to Open unless Supervise is set
+	Watchdog *WatchdogOptions
+}
+
+// PoolModem is one modem managed by a ModemPool
+type PoolModem struct {
+	PortName string
+	ICCID    string
+	IMEI     string
+	Phone    string
+	Subject  *SerialSubject
+	cancel   context.CancelFunc
+}
+
+// ModemPool discovers every modem attached to the host and keeps one opened
+// SerialSubject per modem
+type ModemPool struct {
+	ctx    *context.Context
+	opts   PoolOptions
+	mu     sync.RWMutex
+	modems map[string]*PoolModem
+}
+
+// NewModemPool creates an empty pool, call Discover to fill it
+func NewModemPool(ctx *context.Context, opts PoolOptions) *ModemPool {
+	if opts.BaudRate == 0 {
+		opts.BaudRate = 115200
+	}
+	if opts.ProbeTimeout <= 0 {
+		opts.ProbeTimeout = time.Second
+	}
+	if opts.Ports == nil {
+		opts.Ports = GetAvailablePorts
+	}
+	if opts.Open == nil {
+		portOptions := append([]PortOption{WithBaudRate(opts.BaudRate)}, opts.PortOptions...)
+		opts.Open = func(portName string) (Transport, error) {
+			return CreatePortWithOptions(portName, portOptions...)
+		}
+	}
+	return &ModemPool{
+		ctx:    ctx,
+		opts:   opts,
+		modems: make(map[string]*PoolModem),
+	}
+}
+
+// Discover probes every port not yet in the pool, opens the ones answering
+// AT and returns the newly added modems. Modems whose port was lost and
+// that are not supervised are removed first. Modems expose several ports
+// answering AT, only the first port by name of each IMEI is kept and only
+// that one runs the init profile.
+func (p *ModemPool) Discover(ctx context.Context) ([]*PoolModem, error) {
+	p.prune()
+	names, err := p.opts.Ports()
+	if err != nil {
+		return nil, err
+	}
+	var wg sync.WaitGroup
+	found := make(chan *PoolModem, len(names))
+	for _, name := range names {
+		if _, ok := p.byPort(name); ok {
+			continue
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			modem, err := p.probe(ctx, name)
+			if err != nil {
+				logrus.LogrusLoggerWithContext(p.ctx).Debugf("Skipping %s: %v", name, err)
+				return
+			}
+			found <- modem
+		}(name)
+	}
+	wg.Wait()
+	close(found)
+
+	probed := make([]*PoolModem, 0, len(names))
+	for modem := range found {
+		probed = append(probed, modem)
+	}
+	sort.Slice(probed, func(i, j int) bool { return probed[i].PortName < probed[j].PortName })
+	kept := make([]*PoolModem, 0, len(probed))
+	var duplicates []*PoolModem
+	seen := make(map[string]bool)
+	p.mu.RLock()
+	for _, modem := range probed {
+		if modem.IMEI != "" && (seen[modem.IMEI] || p.hasIMEI(modem.IMEI)) {
+			duplicates = append(duplicates, modem)
+			continue
+		}
+		seen[modem.IMEI] = true
+		kept = append(kept, modem)
+	}
+	p.mu.RUnlock()
+	for _, modem := range duplicates {
+		logrus.LogrusLoggerWithContext(p.ctx).Infof("Skipping %s: another port of modem %s", modem.PortName, modem.IMEI)
+		_ = modem.close()
+	}
+
+	opened := make(chan *PoolModem, len(kept))
+	for _, modem := range kept {
+		wg.Add(1)
+		go func(modem *PoolModem) {
+			defer wg.Done()
+			if err := p.open(ctx, modem); err != nil {
+				logrus.LogrusLoggerWithContext(p.ctx).Warnf("Skipping %s: %v", modem.PortName, err)
+				_ = modem.close()
+				return
+			}
+			opened <- modem
+		}(modem)
+	}
+	wg.Wait()
+	close(opened)
+
+	added := make([]*PoolModem, 0, len(kept))
+	p.mu.Lock()
+	for modem := range opened {
+		if modem.IMEI != "" && p.hasIMEI(modem.IMEI) {
+			// Added by a Discover running alongside
+			_ = modem.close()
+			continue
+		}
+		p.modems[modem.PortName] = modem
+		added = append(added, modem)
+	}
+	p.mu.Unlock()
+	for _, modem := range added {
+		p.start(modem)
+	}
+	return added, nil
+}
+
+// hasIMEI reports whether a modem in the pool has imei, p.mu is held
+func (p *ModemPool) hasIMEI(imei string) bool {
+	for _, modem := range p.modems {
+		if modem.IMEI == imei {
+			return true
+		}
+	}
+	return false
+}
+
+// probe opens a port answering AT and reads its IMEI, nothing else is sent
+// before the duplicates are known. A supervised modem needs its IMEI,
+// without it any device reappearing on the port would be taken.
+func (p *ModemPool) probe(ctx context.Context, name string) (*PoolModem, error) {
+	port, err := p.opts.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if !ProbeAT(port, p.opts.ProbeTimeout) {
+		_ = port.Close()
+		return nil, fmt.Errorf("no AT response")
+	}
+	subject := NewSerial(p.ctx, port, name)
+	if p.opts.Profile != nil {
+		subject.SetInitProfile(*p.opts.Profile)
+	}
+	subject.attachTransport(port)
+	modem := &PoolModem{PortName: name, Subject: subject}
+	if response, err := subject.ExecContext(ctx, imeiCommand); err == nil {
+		modem.IMEI = parseIMEI(response)
+	}
+	if p.opts.Supervise && modem.IMEI == "" {
+		_ = subject.Close()
+		return nil, fmt.Errorf("no IMEI to supervise the modem by")
+	}
+	return modem, nil
+}
+
+// open runs the init profile on a kept port and identifies the modem
+func (p *ModemPool) open(ctx context.Context, modem *PoolModem) error {
+	if err := modem.Subject.initModem(ctx); err != nil {
+		return err
+	}
+	modem.identify(ctx)
+	return nil
+}
+
+// start runs the monitor, watchdog and supervisor of an added modem
+func (p *ModemPool) start(modem *PoolModem) {
+	subject, name := modem.Subject, modem.PortName
+	if p.opts.Monitor != nil {
+		subject.StartMonitor(subject.baseContext(), *p.opts.Monitor)
+	}
+	if p.opts.Watchdog != nil {
+		watchdog := *p.opts.Watchdog
+		if watchdog.Dial == nil && !p.opts.Supervise {
+			open := p.opts.Open
+			watchdog.Dial = func(ctx context.Context) (Transport, error) {
+				return open(name)
+			}
+		}
+		subject.StartWatchdog(subject.baseContext(), watchdog)
+	}
+	if p.opts.Supervise {
+		supervisorCtx, cancel := context.WithCancel(subject.baseContext())
+		modem.cancel = cancel
+		open := p.opts.Open
+		supervisor := NewSupervisor(subject, SupervisorOptions{
+			Dial: func(ctx context.Context) (Transport, error) {
+				return open(name)
+			},
+			IMEI: modem.IMEI,
+		})
+		go func() {
+			_ = supervisor.Run(supervisorCtx)
+		}()
+	}
+}
+
+// identify refreshes the modem info and copies the identity, failures
+// leave the field empty since not every SIM stores its own number
+func (m *PoolModem) identify(ctx context.Context) {
+	info, err := m.Subject.RefreshInfo(ctx)
+	if err != nil {
+		logrus.LogrusLoggerWithContext(m.Subject.ctx).Warnf("Identifying %s: %v", m.PortName, err)
+	}
+	m.ICCID = info.ICCID
+	if info.IMEI != "" {
+		m.IMEI = info.IMEI
+	}
+	m.Phone = info.MSISDN
+}
+
+// prune drops unsupervised modems whose transport failed
+func (p *ModemPool) prune() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name, modem := range p.modems {
+		if modem.cancel != nil {
+			continue
+		}
+		select {
+		case <-modem.Subject.Lost():
+			_ = modem.Subject.Close()
+			delete(p.modems, name)
+		case <-modem.Subject.closed:
+			delete(p.modems, name)
+		default:
+		}
+	}
+}
+
+// Modems returns every modem in the pool
+func (p *ModemPool) Modems() []*PoolModem {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	modems := make([]*PoolModem, 0, len(p.modems))
+	for _, modem := range p.modems {
+		modems = append(modems, modem)
+	}
+	return modems
+}
+
+func (p *ModemPool) byPort(name string) (*PoolModem, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	modem, ok := p.modems[name]
+	return modem, ok
+}
+
+func (p *ModemPool) find(match func(*PoolModem) bool) (*PoolModem, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, modem := range p.modems {
+		if match(modem) {
+			return modem, true
+		}
+	}
+	return nil, false
+}
+
+// ByICCID finds a modem by the ICCID of its SIM
+func (p *ModemPool) ByICCID(iccid string) (*PoolModem, bool) {
+	return p.find(func(m *PoolModem) bool { return m.ICCID == iccid })
+}
+
+// ByIMEI finds a modem by its IMEI
+func (p *ModemPool) ByIMEI(imei string) (*PoolModem, bool) {
+	return p.find(func(m *PoolModem) bool { return m.IMEI == imei })
+}
+
+// ByPhone finds a modem by the subscriber number of its SIM
+func (p *ModemPool) ByPhone(phone string) (*PoolModem, bool) {
+	return p.find(func(m *PoolModem) bool { return m.Phone != "" && m.Phone == phone })
+}
+
+// Remove closes a modem and takes it out of the pool
+func (p *ModemPool) Remove(portName string) error {
+	p.mu.Lock()
+	modem, ok := p.modems[portName]
+	delete(p.modems, portName)
+	p.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no modem on %s", portName)
+	}
+	return modem.close()
+}
+
+// Close closes every modem in the pool
+func (p *ModemPool) Close() error {
+	p.mu.Lock()
+	modems := p.modems
+	p.modems = make(map[string]*PoolModem)
+	p.mu.Unlock()
+	var errs []error
+	for _, modem := range modems {
+		if err := modem.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *PoolModem) close() error {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	return m.Subject.Close()
+}
@@ -0,0 +1,203 @@
+package gsm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// AutoBaudRates are probed in order by WithAutoBaud when no rates are given
+var AutoBaudRates = []int{115200, 9600, 57600, 38400, 19200, 230400, 460800, 921600}
+
+// ErrPortOption is returned by CreatePortWithOptions for invalid or
+// conflicting options
+var ErrPortOption = errors.New("invalid port option")
+
+// PortOption configures CreatePortWithOptions
+type PortOption func(*portConfig)
+
+type portConfig struct {
+	mode         serial.Mode
+	dtr          *bool
+	rts          *bool
+	flowControl  bool
+	autoBaud     []int
+	probeTimeout time.Duration
+}
+
+// WithBaudRate sets the baud rate, 115200 by default
+func WithBaudRate(baudRate int) PortOption {
+	return func(c *portConfig) { c.mode.BaudRate = baudRate }
+}
+
+// WithDataBits sets the character size, 8 by default
+func WithDataBits(dataBits int) PortOption {
+	return func(c *portConfig) { c.mode.DataBits = dataBits }
+}
+
+// WithParity sets the parity, none by default
+func WithParity(parity serial.Parity) PortOption {
+	return func(c *portConfig) { c.mode.Parity = parity }
+}
+
+// WithStopBits sets the stop bits, one by default
+func WithStopBits(stopBits serial.StopBits) PortOption {
+	return func(c *portConfig) { c.mode.StopBits = stopBits }
+}
+
+// WithDTR sets the DataTerminalReady line, raised by default
+func WithDTR(dtr bool) PortOption {
+	return func(c *portConfig) { c.dtr = &dtr }
+}
+
+// WithRTS sets the RequestToSend line, raised by default
+func WithRTS(rts bool) PortOption {
+	return func(c *portConfig) { c.rts = &rts }
+}
+
+// WithHardwareFlowControl enables RTS/CTS flow control, needed by some
+// boards for file transfers at high baud rates. The UART then drives RTS,
+// so it can't be combined with WithRTS. Supported on Linux and Windows.
+func WithHardwareFlowControl() PortOption {
+	return func(c *portConfig) { c.flowControl = true }
+}
+
+// WithAutoBaud probes AT at each rate until the modem answers, AutoBaudRates
+// when none are given. The first rate answering wins over WithBaudRate.
+func WithAutoBaud(rates ...int) PortOption {
+	return func(c *portConfig) {
+		if len(rates) == 0 {
+			rates = AutoBaudRates
+		}
+		c.autoBaud = rates
+	}
+}
+
+// WithProbeTimeout bounds each auto-baud probe, 500ms by default
+func WithProbeTimeout(timeout time.Duration) PortOption {
+	return func(c *portConfig) { c.probeTimeout = timeout }
+}
+
+func newPortConfig(opts []PortOption) (*portConfig, error) {
+	config := &portConfig{
+		mode: serial.Mode{
+			BaudRate: 115200,
+			DataBits: 8,
+			Parity:   serial.NoParity,
+			StopBits: serial.OneStopBit,
+		},
+		probeTimeout: 500 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if config.dtr != nil || config.rts != nil {
+		bits := &serial.ModemOutputBits{DTR: true, RTS: true}
+		if config.dtr != nil {
+			bits.DTR = *config.dtr
+		}
+		if config.rts != nil {
+			bits.RTS = *config.rts
+		}
+		config.mode.InitialStatusBits = bits
+	}
+	return config, nil
+}
+
+func (c *portConfig) validate() error {
+	if c.mode.BaudRate <= 0 {
+		return fmt.Errorf("%w: baud rate %d", ErrPortOption, c.mode.BaudRate)
+	}
+	if c.mode.DataBits < 5 || c.mode.DataBits > 8 {
+		return fmt.Errorf("%w: %d data bits", ErrPortOption, c.mode.DataBits)
+	}
+	if c.mode.Parity < serial.NoParity || c.mode.Parity > serial.SpaceParity {
+		return fmt.Errorf("%w: parity %d", ErrPortOption, c.mode.Parity)
+	}
+	if c.mode.StopBits < serial.OneStopBit || c.mode.StopBits > serial.TwoStopBits {
+		return fmt.Errorf("%w: stop bits %d", ErrPortOption, c.mode.StopBits)
+	}
+	for _, rate := range c.autoBaud {
+		if rate <= 0 {
+			return fmt.Errorf("%w: auto-baud rate %d", ErrPortOption, rate)
+		}
+	}
+	if c.probeTimeout <= 0 {
+		return fmt.Errorf("%w: probe timeout %v", ErrPortOption, c.probeTimeout)
+	}
+	if c.flowControl && c.rts != nil {
+		return fmt.Errorf("%w: RTS is driven by hardware flow control", ErrPortOption)
+	}
+	return nil
+}
+
+// CreatePortWithOptions opens a serial port with full control of the line
+// settings
+func CreatePortWithOptions(portName string, opts ...PortOption) (serial.Port, error) {
+	config, err := newPortConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var port serial.Port
+	if config.flowControl {
+		// go.bug.st/serial always turns RTS/CTS off
+		port, err = openRTSCTS(portName, &config.mode)
+	} else {
+		port, err = serial.Open(portName, &config.mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Unix can't set the lines before opening, set them again
+	if config.dtr != nil {
+		if err := port.SetDTR(*config.dtr); err != nil {
+			_ = port.Close()
+			return nil, err
+		}
+	}
+	if config.rts != nil {
+		if err := port.SetRTS(*config.rts); err != nil {
+			_ = port.Close()
+			return nil, err
+		}
+	}
+	if len(config.autoBaud) > 0 {
+		if err := detectBaudRate(port, config); err != nil {
+			_ = port.Close()
+			return nil, fmt.Errorf("%s: %w", portName, err)
+		}
+	}
+	return port, nil
+}
+
+// baudPort is the part of serial.Port auto-baud needs
+type baudPort interface {
+	Transport
+	SetMode(mode *serial.Mode) error
+	ResetInputBuffer() error
+}
+
+// detectBaudRate switches the port through the candidate rates until AT is
+// answered, leaving the port at the working rate
+func detectBaudRate(port baudPort, config *portConfig) error {
+	for _, rate := range config.autoBaud {
+		mode := config.mode
+		mode.BaudRate = rate
+		if err := port.SetMode(&mode); err != nil {
+			continue
+		}
+		// Drop garbage received at the previous rate
+		_ = port.ResetInputBuffer()
+		if ProbeAT(port, config.probeTimeout) {
+			config.mode.BaudRate = rate
+			return nil
+		}
+	}
+	return fmt.Errorf("no AT response at %v baud", config.autoBaud)
+}
@@ -0,0 +1,112 @@
+package gsm
+
+import (
+	"bufio"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+func TestPortOptionValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  []PortOption
+		valid bool
+	}{
+		{"defaults", nil, true},
+		{"flow control", []PortOption{WithHardwareFlowControl(), WithDTR(false)}, true},
+		{"auto-baud", []PortOption{WithAutoBaud(), WithProbeTimeout(time.Second)}, true},
+		{"zero baud", []PortOption{WithBaudRate(0)}, false},
+		{"9 data bits", []PortOption{WithDataBits(9)}, false},
+		{"bad parity", []PortOption{WithParity(serial.Parity(7))}, false},
+		{"bad stop bits", []PortOption{WithStopBits(serial.StopBits(5))}, false},
+		{"negative auto-baud rate", []PortOption{WithAutoBaud(115200, -1)}, false},
+		{"zero probe timeout", []PortOption{WithAutoBaud(), WithProbeTimeout(0)}, false},
+		{"RTS with flow control", []PortOption{WithHardwareFlowControl(), WithRTS(true)}, false},
+	}
+	for _, test := range tests {
+		_, err := newPortConfig(test.opts)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && !errors.Is(err, ErrPortOption) {
+			t.Errorf("%s: got %v, want ErrPortOption", test.name, err)
+		}
+	}
+
+	// Rejected before the port is touched
+	if _, err := CreatePortWithOptions("/nonexistent", WithHardwareFlowControl(), WithRTS(false)); !errors.Is(err, ErrPortOption) {
+		t.Errorf("CreatePortWithOptions: %v", err)
+	}
+}
+
+// baudPipe is a pipe standing in for a serial port, the modem end only
+// understands the host at modemRate
+type baudPipe struct {
+	*PipeTransport
+	mu   sync.Mutex
+	rate int
+}
+
+func (p *baudPipe) SetMode(mode *serial.Mode) error {
+	p.mu.Lock()
+	p.rate = mode.BaudRate
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *baudPipe) ResetInputBuffer() error { return nil }
+
+func newBaudPipe(t *testing.T, modemRate int) *baudPipe {
+	host, modem := NewPipe()
+	port := &baudPipe{PipeTransport: host}
+	t.Cleanup(func() { _ = host.Close() })
+	go func() {
+		scanner := bufio.NewScanner(modem)
+		for scanner.Scan() {
+			port.mu.Lock()
+			rate := port.rate
+			port.mu.Unlock()
+			if rate == modemRate {
+				_, _ = modem.Write([]byte("\r\nOK\r\n"))
+			} else {
+				// Framing errors at the wrong rate
+				_, _ = modem.Write([]byte{0xfe, 0x80, 0x00})
+			}
+		}
+	}()
+	return port
+}
+
+func TestDetectBaudRate(t *testing.T) {
+	config, err := newPortConfig([]PortOption{
+		WithAutoBaud(115200, 9600, 57600),
+		WithProbeTimeout(50 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := detectBaudRate(newBaudPipe(t, 57600), config); err != nil {
+		t.Fatal(err)
+	}
+	if config.mode.BaudRate != 57600 {
+		t.Errorf("detected %d baud", config.mode.BaudRate)
+	}
+
+	config, err = newPortConfig([]PortOption{
+		WithAutoBaud(115200, 9600),
+		WithProbeTimeout(50 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := detectBaudRate(newBaudPipe(t, 57600), config); err == nil {
+		t.Error("detected a rate the modem doesn't answer at")
+	}
+	if config.mode.BaudRate != 115200 {
+		t.Errorf("baud rate changed to %d after a failed detection", config.mode.BaudRate)
+	}
+}
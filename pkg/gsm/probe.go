@@ -0,0 +1,72 @@
+package gsm
+
+import (
+	"strings"
+	"time"
+)
+
+type readTimeouter interface {
+	SetReadTimeout(t time.Duration) error
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// ProbeAT sends a bare AT and reports whether the other end answered OK
+// within timeout. Callers should close the transport when it returns false,
+// a transport without read timeouts may still have a read in flight.
+func ProbeAT(port Transport, timeout time.Duration) bool {
+	if _, err := port.Write([]byte("AT\r\n")); err != nil {
+		return false
+	}
+	deadline := time.Now().Add(timeout)
+	switch p := port.(type) {
+	case readTimeouter:
+		defer func() { _ = p.SetReadTimeout(-1) }()
+		return waitOK(port, func() bool {
+			remaining := time.Until(deadline)
+			return remaining > 0 && p.SetReadTimeout(remaining) == nil
+		})
+	case readDeadliner:
+		defer func() { _ = p.SetReadDeadline(time.Time{}) }()
+		if err := p.SetReadDeadline(deadline); err != nil {
+			return false
+		}
+		return waitOK(port, func() bool { return time.Now().Before(deadline) })
+	}
+	result := make(chan bool, 1)
+	go func() {
+		result <- waitOK(port, func() bool { return true })
+	}()
+	select {
+	case ok := <-result:
+		return ok
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// waitOK reads until an OK line arrives, a read error or more returns false
+func waitOK(port Transport, more func() bool) bool {
+	buf := make([]byte, 64)
+	received := ""
+	for more() {
+		n, err := port.Read(buf)
+		if err != nil {
+			return false
+		}
+		if n == 0 {
+			// Serial read timeout
+			continue
+		}
+		received += string(buf[:n])
+		if strings.Contains(received, "\r\nOK\r\n") || strings.HasPrefix(received, "OK\r\n") {
+			return true
+		}
+		if strings.Contains(received, "ERROR") {
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,245 @@
+package gsm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-gsm/pkg/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration written as "500ms" or "2s" in profile files
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// InitStep is one command of an InitProfile
+type InitStep struct {
+	Command string `json:"command" yaml:"command"`
+	// Expect is the prefix of a line that must be in the response, e.g.
+	// "+CCID". Empty only requires OK.
+	Expect string `json:"expect,omitempty" yaml:"expect,omitempty"`
+	// Timeout for the final result code, DefaultCommandTimeout when zero
+	Timeout Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// Retries is how often the step is repeated after failing
+	Retries    int      `json:"retries,omitempty" yaml:"retries,omitempty"`
+	RetryDelay Duration `json:"retry_delay,omitempty" yaml:"retry_delay,omitempty"`
+	// Fatal aborts Open when the step still fails after its retries,
+	// otherwise the error is logged
+	Fatal bool `json:"fatal,omitempty" yaml:"fatal,omitempty"`
+}
+
+// InitProfile is the command sequence run by Open and after every reconnect
+type InitProfile struct {
+	Name  string     `json:"name,omitempty" yaml:"name,omitempty"`
+	Steps []InitStep `json:"steps" yaml:"steps"`
+	// SMSDelivery, when set, configures new message indications after the
+	// steps, AckSMS acknowledges every +CMT with AT+CNMA
+	SMSDelivery SMSDelivery `json:"sms_delivery,omitempty" yaml:"sms_delivery,omitempty"`
+	AckSMS      bool        `json:"ack_sms,omitempty" yaml:"ack_sms,omitempty"`
+	// StatusReports requests a status report for every sent message
+	StatusReports bool `json:"status_reports,omitempty" yaml:"status_reports,omitempty"`
+	// USSD is queried once the steps are done, e.g. the balance code.
+	// Empty sends no USSD.
+	USSD string `json:"ussd,omitempty" yaml:"ussd,omitempty"`
+	// USSDByNetwork overrides USSD per network name as reported by COPS,
+	// e.g. "Vinaphone": "*111#"
+	USSDByNetwork map[string]string `json:"ussd_by_network,omitempty" yaml:"ussd_by_network,omitempty"`
+}
+
+// commonSteps work on every 3GPP modem
+func commonSteps() []InitStep {
+	return []InitStep{
+		// Echo on, responses are only accepted after the echo of their
+		// command so URCs of the same shape can't be mistaken for them
+		{Command: "ATE1"},
+		// Enable error messages
+		{Command: "AT+CMEE=2"},
+		// PDU mode, text mode hides the header joining concatenated SMS
+		{Command: "AT+CMGF=0"},
+		// Text mode shows <dcs>, the only sign of a UCS2 message in hex
+		{Command: "AT+CSDH=1"},
+		// Enable caller ID
+		{Command: "AT+CLIP=1"},
+		// Report registration changes with location
+		{Command: "AT+CREG=2"},
+		{Command: "AT+CCID", Expect: "+CCID"},
+		{Command: "AT+COPS?", Expect: "+COPS"},
+	}
+}
+
+// DefaultProfile is the sequence Open runs without SetInitProfile, it ends
+// with the balance USSD of Vietnamese networks
+func DefaultProfile() InitProfile {
+	return InitProfile{
+		Name:          "default",
+		Steps:         commonSteps(),
+		SMSDelivery:   SMSDirect,
+		USSD:          "*101#",
+		USSDByNetwork: map[string]string{"Vinaphone": "*111#"},
+	}
+}
+
+// QuectelProfile routes URCs to the AT port and turns on the RI pin for
+// SMS, it sends no USSD
+func QuectelProfile() InitProfile {
+	steps := []InitStep{
+		{Command: `AT+QURCCFG="urcport","usbat"`},
+		{Command: `AT+QCFG="urc/ri/smsincoming","pulse",120`},
+	}
+	return InitProfile{Name: "quectel", Steps: append(commonSteps(), steps...), SMSDelivery: SMSDirect}
+}
+
+// SIMComProfile is the common sequence with character set GSM, it sends no
+// USSD
+func SIMComProfile() InitProfile {
+	steps := []InitStep{{Command: `AT+CSCS="GSM"`}}
+	return InitProfile{Name: "simcom", Steps: append(commonSteps(), steps...), SMSDelivery: SMSDirect}
+}
+
+// ProfileFor returns the preset for a ModemModel vendor, DefaultProfile for
+// anything else
+func ProfileFor(vendor string) InitProfile {
+	switch strings.ToLower(vendor) {
+	case "quectel":
+		return QuectelProfile()
+	case "simcom":
+		return SIMComProfile()
+	}
+	return DefaultProfile()
+}
+
+// LoadProfile reads a profile from a .json, .yaml or .yml file
+func LoadProfile(path string) (InitProfile, error) {
+	var profile InitProfile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return profile, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &profile)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &profile)
+	default:
+		return profile, fmt.Errorf("unknown profile format %q", filepath.Ext(path))
+	}
+	if err != nil {
+		return profile, fmt.Errorf("parse profile %s: %w", path, err)
+	}
+	return profile, nil
+}
+
+// SetInitProfile replaces the sequence run by Open and Reopen
+func (s *SerialSubject) SetInitProfile(profile InitProfile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.profile = &profile
+}
+
+func (s *SerialSubject) initProfile() InitProfile {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.profile == nil {
+		return DefaultProfile()
+	}
+	return *s.profile
+}
+
+// runProfile executes every step, only fatal steps abort it
+func (s *SerialSubject) runProfile(ctx context.Context, profile InitProfile) error {
+	for _, step := range profile.Steps {
+		response, err := s.runStep(ctx, step)
+		if err != nil {
+			if step.Fatal {
+				return fmt.Errorf("init %s: %w", step.Command, err)
+			}
+			logrus.LogrusLoggerWithContext(s.ctx).Errorf("Init %s: %v", step.Command, err)
+			continue
+		}
+		s.rememberInit(response)
+	}
+	if profile.StatusReports {
+		if err := s.SetStatusReports(ctx, true); err != nil {
+			logrus.LogrusLoggerWithContext(s.ctx).Errorf("Init status reports: %v", err)
+		}
+	}
+	if profile.SMSDelivery != "" {
+		if err := s.SetSMSDelivery(ctx, profile.SMSDelivery, profile.AckSMS); err != nil {
+			logrus.LogrusLoggerWithContext(s.ctx).Errorf("Init SMS delivery: %v", err)
+		}
+	}
+	ussd := profile.USSD
+	if override, ok := profile.USSDByNetwork[s.Info().Network]; ok {
+		ussd = override
+	}
+	if ussd == "" {
+		return nil
+	}
+	cusd, errCUSD := s.SendUSSDContext(ctx, ussd)
+	if errCUSD != nil {
+		logrus.LogrusLoggerWithContext(s.ctx).Error(errCUSD)
+	}
+	logrus.LogrusLoggerWithContext(s.ctx).Infof("CUSD: %s", cusd)
+	return nil
+}
+
+// runStep executes a step with its retries
+func (s *SerialSubject) runStep(ctx context.Context, step InitStep) (*Response, error) {
+	var err error
+	for attempt := 0; attempt <= step.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Duration(step.RetryDelay)):
+			}
+		}
+		var response *Response
+		response, err = s.ExecContext(ctx, Command{Line: step.Command, Prefix: step.Expect, Timeout: time.Duration(step.Timeout)})
+		if err == nil && step.Expect != "" && response.First() == "" {
+			err = fmt.Errorf("no %s in response", step.Expect)
+		}
+		if err == nil {
+			return response, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// rememberInit keeps the identity read during init
+func (s *SerialSubject) rememberInit(response *Response) {
+	for _, line := range response.Lines {
+		switch {
+		case strings.HasPrefix(line, "+CCID"):
+			s.updateInfo(func(info *ModemInfo) { info.ICCID = parseCCID(line) })
+		case strings.HasPrefix(line, "+COPS"):
+			network := extractNetwork(line)
+			s.updateInfo(func(info *ModemInfo) {
+				info.Operator = parseOperator(line)
+				info.Network = network
+			})
+			logrus.LogrusLoggerWithContext(s.ctx).Infof("COPS: %s", line)
+			logrus.LogrusLoggerWithContext(s.ctx).Infof("Network: %s", network)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package gsm
+
+import (
+	"context"
+	"fmt"
+	"go-gsm/pkg/logrus"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMSState is where an outgoing message stands
+type SMSState int
+
+const (
+	// SMSSubmitted was accepted by the SMSC, no final report yet
+	SMSSubmitted SMSState = iota + 1
+	SMSDelivered
+	// SMSFailed was given up by the SMSC
+	SMSFailed
+	// SMSExpired ran out of validity before it could be delivered
+	SMSExpired
+)
+
+func (s SMSState) String() string {
+	switch s {
+	case SMSSubmitted:
+		return "submitted"
+	case SMSDelivered:
+		return "delivered"
+	case SMSFailed:
+		return "failed"
+	case SMSExpired:
+		return "expired"
+	}
+	return "unknown"
+}
+
+// MessageStatus is the state of one part sent with SendSMS
+type MessageStatus struct {
+	Reference int
+	Number    string
+	State     SMSState
+	// Status is the TP-ST of the latest status report
+	Status    TPStatus
+	Submitted time.Time
+	// Discharge is when the SMSC reached Status, Updated when the report
+	// arrived
+	Discharge time.Time
+	Updated   time.Time
+}
+
+// SMSStatusChanged is published when a status report changes the state of
+// a sent message
+type SMSStatusChanged struct {
+	PortName string
+	Message  MessageStatus
+	Previous SMSState
+}
+
+func (SMSStatusChanged) EventName() string { return "sms_status" }
+
+// maxTrackedSMS bounds the kept states, references wrap at 256 anyway
+const maxTrackedSMS = 256
+
+// deliveryTracker keeps the state of sent messages by reference
+type deliveryTracker struct {
+	mu   sync.Mutex
+	sent map[int]*MessageStatus
+}
+
+// SetStatusReports asks the SMSC for a status report of every message
+// sent afterwards. Reports are routed as +CDS with SMSDirect delivery and
+// stored and announced as +CDSI with SMSStored.
+func (s *SerialSubject) SetStatusReports(ctx context.Context, on bool) error {
+	// First octet of text mode submits: SMS-SUBMIT, relative validity and
+	// TP-SRR when on
+	csmp := "AT+CSMP=17,167,0,0"
+	if on {
+		csmp = "AT+CSMP=49,167,0,0"
+	}
+	if err := s.SendAndWaitOKContext(ctx, csmp); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.statusReports = on
+	delivery := s.smsDelivery
+	s.mu.Unlock()
+	if delivery == "" {
+		return nil
+	}
+	cnmi, err := delivery.cnmi(on)
+	if err != nil {
+		return err
+	}
+	return s.SendAndWaitOKContext(ctx, cnmi)
+}
+
+func (s *SerialSubject) statusReportsOn() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.statusReports
+}
+
+// SMSStatus returns the state of a message sent with SendSMS by one of
+// the references it returned
+func (s *SerialSubject) SMSStatus(reference int) (MessageStatus, bool) {
+	s.delivery.mu.Lock()
+	defer s.delivery.mu.Unlock()
+	status, ok := s.delivery.sent[reference]
+	if !ok {
+		return MessageStatus{}, false
+	}
+	return *status, true
+}
+
+// trackSMS records a submitted part, a reused reference replaces the older
+// message
+func (s *SerialSubject) trackSMS(reference int, number string) {
+	t := &s.delivery
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sent == nil {
+		t.sent = map[int]*MessageStatus{}
+	}
+	if len(t.sent) >= maxTrackedSMS {
+		oldest := -1
+		for ref, status := range t.sent {
+			if oldest == -1 || status.Submitted.Before(t.sent[oldest].Submitted) {
+				oldest = ref
+			}
+		}
+		delete(t.sent, oldest)
+	}
+	now := time.Now()
+	t.sent[reference] = &MessageStatus{
+		Reference: reference,
+		Number:    number,
+		State:     SMSSubmitted,
+		Submitted: now,
+		Updated:   now,
+	}
+}
+
+// applyStatusReport updates the message a report refers to
+func (s *SerialSubject) applyStatusReport(report *StatusReport) {
+	state := SMSSubmitted
+	switch {
+	case report.Status.Delivered():
+		state = SMSDelivered
+	case report.Status.Expired():
+		state = SMSExpired
+	case report.Status.Failed():
+		state = SMSFailed
+	}
+	reference := int(report.Reference)
+	t := &s.delivery
+	t.mu.Lock()
+	status, ok := t.sent[reference]
+	if !ok {
+		t.mu.Unlock()
+		logrus.LogrusLoggerWithContext(s.ctx).Warnf("Status report for unknown message %d to %s: %#x", reference, report.Recipient, byte(report.Status))
+		return
+	}
+	previous := status.State
+	status.State = state
+	status.Status = report.Status
+	status.Discharge = report.Discharge
+	status.Updated = time.Now()
+	message := *status
+	t.mu.Unlock()
+	logrus.LogrusLoggerWithContext(s.ctx).Infof("SMS %d to %s %s (status %#x)", reference, message.Number, state, byte(report.Status))
+	if state == previous {
+		return
+	}
+	s.publish(SMSStatusChanged{PortName: s.portName, Message: message, Previous: previous})
+}
+
+// handleCDS parses a status report routed to the host, PDU mode:
+//
+//	+CDS: <length>
+//	<pdu>
+//
+// or text mode, +CDS: <fo>,<mr>,[<ra>],[<tora>],<scts>,<dt>,<st>
+func (s *SerialSubject) handleCDS(lines []string) {
+	defer s.acknowledgeSMS()
+	fields := splitFields(strings.TrimPrefix(lines[0], "+CDS:"))
+	var report *StatusReport
+	var err error
+	if len(fields) == 1 && len(lines) > 1 {
+		report, err = decodeStatusReport(lines[1])
+	} else {
+		report, err = parseTextStatusReport(fields)
+	}
+	if err != nil {
+		logrus.LogrusLoggerWithContext(s.ctx).Errorf("Error decoding status report: %v", err)
+		return
+	}
+	s.applyStatusReport(report)
+}
+
+// completeCDS waits for the PDU line of PDU mode reports
+func completeCDS(lines []string) bool {
+	return len(lines) >= 2 || len(splitFields(strings.TrimPrefix(lines[0], "+CDS:"))) > 1
+}
+
+// handleCDSI reads a stored status report, +CDSI: <mem>,<index>, and
+// deletes it
+func (s *SerialSubject) handleCDSI(lines []string) {
+	fields := splitFields(strings.TrimPrefix(lines[0], "+CDSI:"))
+	if len(fields) < 2 {
+		logrus.LogrusLoggerWithContext(s.ctx).Warnf("Unsupported %s", lines[0])
+		return
+	}
+	// Read aside so URCs arriving meanwhile are not held up
+	go s.readStatusReport(fields[1])
+}
+
+func (s *SerialSubject) readStatusReport(index string) {
+	s.smsMu.Lock()
+	response, err := s.Exec(Command{Line: fmt.Sprintf("AT+CMGR=%s", index), Prefix: "+CMGR:"})
+	s.smsMu.Unlock()
+	if err != nil {
+		logrus.LogrusLoggerWithContext(s.ctx).Errorf("Error reading status report: %v", err)
+		return
+	}
+	fields := splitFields(strings.TrimPrefix(response.First(), "+CMGR:"))
+	if len(fields) == 0 {
+		logrus.LogrusLoggerWithContext(s.ctx).Warnf("Unsupported %s", response.First())
+		return
+	}
+	var report *StatusReport
+	if _, errStat := strconv.Atoi(fields[0]); errStat == nil && len(response.Lines) > 1 {
+		report, err = decodeStatusReport(response.Lines[1])
+	} else {
+		// +CMGR: <stat>,<fo>,<mr>,[<ra>],[<tora>],<scts>,<dt>,<st>
+		report, err = parseTextStatusReport(fields[1:])
+	}
+	if err != nil {
+		logrus.LogrusLoggerWithContext(s.ctx).Errorf("Error decoding status report: %v", err)
+		return
+	}
+	s.applyStatusReport(report)
+	if err := s.SendAndWaitOK(fmt.Sprintf("AT+CMGD=%s", index)); err != nil {
+		logrus.LogrusLoggerWithContext(s.ctx).Errorf("Error deleting status report: %v", err)
+	}
+}
+
+func decodeStatusReport(hexPDU string) (*StatusReport, error) {
+	pdu, err := DecodePDU(hexPDU)
+	if err != nil {
+		return nil, err
+	}
+	report, ok := pdu.(*StatusReport)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s instead of a status report", ErrPDU, pdu.Type())
+	}
+	return report, nil
+}
+
+// parseTextStatusReport reads <fo>,<mr>,[<ra>],[<tora>],<scts>,<dt>,<st>
+func parseTextStatusReport(fields []string) (*StatusReport, error) {
+	if len(fields) < 7 {
+		return nil, fmt.Errorf("status report %q: %d fields", strings.Join(fields, ","), len(fields))
+	}
+	reference, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("status report reference %q", fields[1])
+	}
+	status, err := strconv.Atoi(fields[6])
+	if err != nil {
+		return nil, fmt.Errorf("status report status %q", fields[6])
+	}
+	return &StatusReport{
+		Reference: byte(reference),
+		Recipient: ParseAddress(fields[2]),
+		Timestamp: parseTextSCTS(fields[4]),
+		Discharge: parseTextSCTS(fields[5]),
+		Status:    TPStatus(status),
+	}, nil
+}
+
+// parseTextSCTS reads "yy/MM/dd,hh:mm:ss±zz", the zone in quarters of an
+// hour. Malformed timestamps give the zero time.
+func parseTextSCTS(value string) time.Time {
+	if len(value) < 20 {
+		return time.Time{}
+	}
+	quarters, err := strconv.Atoi(value[17:])
+	if err != nil {
+		return time.Time{}
+	}
+	t, err := time.ParseInLocation("06/01/02,15:04:05", value[:17], time.FixedZone("", quarters*15*60))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
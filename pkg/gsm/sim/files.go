@@ -0,0 +1,247 @@
+package sim
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StorageSize is the emulated UFS capacity reported by AT+QFLDS
+const StorageSize = 1 << 20
+
+type openFile struct {
+	name string
+	pos  int
+}
+
+// receiver collects the raw payload that follows CONNECT
+type receiver struct {
+	remaining int
+	// until ends the data at a terminator byte instead of a size, ESC
+	// aborts it
+	until byte
+	data  []byte
+	done  func(m *Modem, data []byte) []string
+}
+
+func (r *receiver) feed(m *Modem, buffer string) string {
+	if r.until != 0 {
+		idx := strings.IndexAny(buffer, string([]byte{r.until, 0x1B}))
+		if idx == -1 {
+			r.data = append(r.data, buffer...)
+			return ""
+		}
+		m.mu.Lock()
+		m.receive = nil
+		m.mu.Unlock()
+		if buffer[idx] == r.until {
+			r.data = append(r.data, buffer[:idx]...)
+			m.writeLines(r.done(m, r.data))
+		}
+		return buffer[idx+1:]
+	}
+	if buffer == "+++" {
+		// Escape from data mode, guard times keep it in a read of its own
+		m.mu.Lock()
+		m.receive = nil
+		m.mu.Unlock()
+		m.writeLines([]string{"OK"})
+		return ""
+	}
+	n := len(buffer)
+	if n > r.remaining {
+		n = r.remaining
+	}
+	r.data = append(r.data, buffer[:n]...)
+	r.remaining -= n
+	if r.remaining == 0 {
+		m.mu.Lock()
+		m.receive = nil
+		m.mu.Unlock()
+		m.writeLines(r.done(m, r.data))
+	}
+	return buffer[n:]
+}
+
+func (m *Modem) receiving() *receiver {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.receive
+}
+
+// expect switches to raw mode for size bytes and announces it with CONNECT
+func (m *Modem) expect(size int, done func(m *Modem, data []byte) []string) []string {
+	m.mu.Lock()
+	m.receive = &receiver{remaining: size, done: done}
+	m.mu.Unlock()
+	if size == 0 {
+		m.mu.Lock()
+		m.receive = nil
+		m.mu.Unlock()
+		return append([]string{"CONNECT"}, done(m, nil)...)
+	}
+	return []string{"CONNECT"}
+}
+
+func params(command, prefix string) []string {
+	values := strings.Split(command[len(prefix):], ",")
+	for i, value := range values {
+		values[i] = unquote(value)
+	}
+	return values
+}
+
+func (m *Modem) fileCommand(command string) ([]string, bool) {
+	upper := strings.ToUpper(command)
+	switch {
+	case strings.HasPrefix(upper, "AT+QFLST"):
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		names := make([]string, 0, len(m.files))
+		for name := range m.files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		lines := make([]string, 0, len(names)+1)
+		for _, name := range names {
+			lines = append(lines, fmt.Sprintf("+QFLST: \"UFS:%s\",%d", name, len(m.files[name])))
+		}
+		return append(lines, "OK"), true
+	case strings.HasPrefix(upper, "AT+QFLDS"):
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		used := 0
+		for _, data := range m.files {
+			used += len(data)
+		}
+		return []string{fmt.Sprintf("+QFLDS: %d,%d", StorageSize-used, StorageSize), "OK"}, true
+	case strings.HasPrefix(upper, "AT+QFUPL="):
+		p := params(command, "AT+QFUPL=")
+		size := 0
+		if len(p) > 1 {
+			size, _ = strconv.Atoi(p[1])
+		}
+		name := strings.TrimPrefix(p[0], "UFS:")
+		return m.expect(size, func(m *Modem, data []byte) []string {
+			m.SetFile(name, data)
+			return []string{fmt.Sprintf("+QFUPL: %d,%x", len(data), Checksum(data)), "OK"}
+		}), true
+	case strings.HasPrefix(upper, "AT+QFOPEN="):
+		p := params(command, "AT+QFOPEN=")
+		name := strings.TrimPrefix(p[0], "UFS:")
+		mode := 0
+		if len(p) > 1 {
+			mode, _ = strconv.Atoi(p[1])
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if _, ok := m.files[name]; !ok {
+			if mode == 2 {
+				return []string{"+CME ERROR: 405"}, true
+			}
+			m.files[name] = nil
+		}
+		if mode == 1 {
+			m.files[name] = nil
+		}
+		handle := 1
+		for m.handles[handle] != nil {
+			handle++
+		}
+		m.handles[handle] = &openFile{name: name}
+		return []string{fmt.Sprintf("+QFOPEN: %d", handle), "OK"}, true
+	case strings.HasPrefix(upper, "AT+QFREAD="):
+		p := params(command, "AT+QFREAD=")
+		handle, _ := strconv.Atoi(p[0])
+		length := 1024
+		if len(p) > 1 {
+			length, _ = strconv.Atoi(p[1])
+		}
+		m.mu.Lock()
+		file, ok := m.handles[handle]
+		if !ok {
+			m.mu.Unlock()
+			return []string{"+CME ERROR: 416"}, true
+		}
+		data := m.files[file.name]
+		end := file.pos + length
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := append([]byte(nil), data[file.pos:end]...)
+		file.pos = end
+		m.mu.Unlock()
+		m.Write([]byte(fmt.Sprintf("\r\nCONNECT %d\r\n", len(chunk))))
+		m.Write(chunk)
+		return []string{"OK"}, true
+	case strings.HasPrefix(upper, "AT+QFWRITE="):
+		p := params(command, "AT+QFWRITE=")
+		handle, _ := strconv.Atoi(p[0])
+		length := 0
+		if len(p) > 1 {
+			length, _ = strconv.Atoi(p[1])
+		}
+		m.mu.Lock()
+		file, ok := m.handles[handle]
+		m.mu.Unlock()
+		if !ok {
+			return []string{"+CME ERROR: 416"}, true
+		}
+		return m.expect(length, func(m *Modem, data []byte) []string {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			content := m.files[file.name]
+			if end := file.pos + len(data); end > len(content) {
+				content = append(content, make([]byte, end-len(content))...)
+			}
+			copy(content[file.pos:], data)
+			file.pos += len(data)
+			m.files[file.name] = content
+			return []string{fmt.Sprintf("+QFWRITE: %d,%d", len(data), len(content)), "OK"}
+		}), true
+	case strings.HasPrefix(upper, "AT+QFSEEK="):
+		p := params(command, "AT+QFSEEK=")
+		handle, _ := strconv.Atoi(p[0])
+		offset, whence := 0, 0
+		if len(p) > 1 {
+			offset, _ = strconv.Atoi(p[1])
+		}
+		if len(p) > 2 {
+			whence, _ = strconv.Atoi(p[2])
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		file, ok := m.handles[handle]
+		if !ok {
+			return []string{"+CME ERROR: 416"}, true
+		}
+		switch whence {
+		case 1:
+			offset += file.pos
+		case 2:
+			offset += len(m.files[file.name])
+		}
+		file.pos = offset
+		return []string{"OK"}, true
+	case strings.HasPrefix(upper, "AT+QFPOSITION="):
+		handle, _ := strconv.Atoi(params(command, "AT+QFPOSITION=")[0])
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		file, ok := m.handles[handle]
+		if !ok {
+			return []string{"+CME ERROR: 416"}, true
+		}
+		return []string{fmt.Sprintf("+QFPOSITION: %d", file.pos), "OK"}, true
+	case strings.HasPrefix(upper, "AT+QFCLOSE="):
+		handle, _ := strconv.Atoi(params(command, "AT+QFCLOSE=")[0])
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if _, ok := m.handles[handle]; !ok {
+			return []string{"+CME ERROR: 416"}, true
+		}
+		delete(m.handles, handle)
+		return []string{"OK"}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,691 @@
+// Package sim is a scriptable AT modem emulator. It speaks enough of the
+// Quectel dialect for SerialSubject to open, query, receive SMS and calls
+// and download recordings without hardware.
+package sim
+
+import (
+	"encoding/hex"
+	"fmt"
+	"go-gsm/pkg/gsm"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+// HandlerFunc answers one command line, the returned lines are written to
+// the host in order and should end with a final result code such as "OK"
+type HandlerFunc func(m *Modem, command string) []string
+
+// SMS is a message stored in the emulated modem memory
+type SMS struct {
+	Sender string
+	Time   string
+	Text   string
+	Read   bool
+}
+
+type handler struct {
+	prefix string
+	fn     HandlerFunc
+}
+
+// Modem is an emulated modem. The host side is returned by Transport and is
+// what gets passed to gsm.NewSerial.
+type Modem struct {
+	ICCID    string
+	IMEI     string
+	IMSI     string
+	MSISDN   string
+	Operator string
+	Signal   int
+	// Manufacturer, Model and Revision are reported by ATI and AT+CGMR
+	Manufacturer string
+	Model        string
+	Revision     string
+	// PrefixedIdentity answers AT+CGSN and AT+CGMR as "+CGSN: <imei>" and
+	// "+CGMR: <revision>" like newer SIMCom firmware, instead of bare
+	PrefixedIdentity bool
+	// Latency delays every response, real modems never answer instantly
+	Latency time.Duration
+	// EchoDelay delays the echo of a command, leaving room for a URC to
+	// arrive between the command and its echo
+	EchoDelay time.Duration
+	// ConnectLength announces the file size in CONNECT for QFDWL
+	ConnectLength bool
+	// USSD maps a code such as "*101#" to the network reply
+	USSD map[string]string
+
+	mu      sync.Mutex
+	host    *gsm.PipeTransport
+	dev     *gsm.PipeTransport
+	echo    bool
+	pduMode bool
+	cmee    string
+	// csdh shows the header fields of text mode messages, AT+CSDH=1
+	csdh bool
+	// submitted holds what was sent with AT+CMGS, reference numbers it
+	submitted []string
+	reference int
+	handlers  []handler
+	commands  []string
+	sms       map[int]*SMS
+	files     map[string][]byte
+	handles   map[int]*openFile
+	// receive collects raw bytes after CONNECT for uploads and writes
+	receive *receiver
+	done    chan struct{}
+}
+
+// New creates an emulated modem with sensible defaults and starts it
+func New() *Modem {
+	host, dev := gsm.NewPipe()
+	m := &Modem{
+		ICCID:         "8984048000000000001",
+		IMEI:          "860000000000001",
+		IMSI:          "452040000000001",
+		MSISDN:        "+84960000001",
+		Operator:      "Viettel",
+		Signal:        20,
+		Manufacturer:  "Quectel",
+		Model:         "EC25",
+		Revision:      "EC25EFAR06A06M4G",
+		Latency:       5 * time.Millisecond,
+		ConnectLength: true,
+		USSD:          map[string]string{},
+		host:          host,
+		dev:           dev,
+		echo:          true,
+		sms:           map[int]*SMS{},
+		files:         map[string][]byte{},
+		handles:       map[int]*openFile{},
+		done:          make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+// Transport returns the host end of the modem
+func (m *Modem) Transport() gsm.Transport {
+	return m.host
+}
+
+// Close shuts the modem down, the host sees EOF
+func (m *Modem) Close() error {
+	return m.dev.Close()
+}
+
+// Done is closed once the modem stopped processing commands
+func (m *Modem) Done() <-chan struct{} {
+	return m.done
+}
+
+// Handle overrides the built-in behaviour for commands starting with prefix.
+// Handlers registered later take precedence.
+func (m *Modem) Handle(prefix string, fn HandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers = append(m.handlers, handler{prefix: strings.ToUpper(prefix), fn: fn})
+}
+
+// Respond makes commands starting with prefix answer with fixed lines
+func (m *Modem) Respond(prefix string, lines ...string) {
+	m.Handle(prefix, func(_ *Modem, _ string) []string {
+		return lines
+	})
+}
+
+// Commands returns every command line received so far
+func (m *Modem) Commands() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.commands...)
+}
+
+// WaitCommand blocks until a command starting with prefix was received
+func (m *Modem) WaitCommand(prefix string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, command := range m.Commands() {
+			if strings.HasPrefix(strings.ToUpper(command), strings.ToUpper(prefix)) {
+				return true
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
+// Write sends raw bytes to the host
+func (m *Modem) Write(data []byte) {
+	_, _ = m.dev.Write(data)
+}
+
+// URC emits unsolicited result codes
+func (m *Modem) URC(lines ...string) {
+	m.writeLines(lines)
+}
+
+// Ring signals an incoming call
+func (m *Modem) Ring(number string) {
+	if number == "" {
+		m.URC("RING")
+		return
+	}
+	m.URC("RING", fmt.Sprintf("+CLIP: \"%s\",145,\"\",0,\"\",0", number))
+}
+
+// Hangup signals the remote party ended the call
+func (m *Modem) Hangup() {
+	m.URC("NO CARRIER")
+}
+
+// StoreSMS puts a message into memory without notifying the host
+func (m *Modem) StoreSMS(sender, text string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	index := 1
+	for {
+		if _, ok := m.sms[index]; !ok {
+			break
+		}
+		index++
+	}
+	m.sms[index] = &SMS{
+		Sender: sender,
+		Time:   time.Now().Format("06/01/02,15:04:05") + "+28",
+		Text:   text,
+	}
+	return index
+}
+
+// DeliverSMS stores a message and announces it with +CMTI
+func (m *Modem) DeliverSMS(sender, text string) int {
+	index := m.StoreSMS(sender, text)
+	m.URC(fmt.Sprintf("+CMTI: \"ME\",%d", index))
+	return index
+}
+
+// DeliverDirect pushes a message as a text mode +CMT without storing it
+func (m *Modem) DeliverDirect(sender, text string) {
+	timestamp := time.Now().Format("06/01/02,15:04:05") + "+28"
+	m.mu.Lock()
+	details, body := m.textMessage(sender, text)
+	m.mu.Unlock()
+	m.URC(fmt.Sprintf("+CMT: \"%s\",\"\",\"%s\"%s", sender, timestamp, details), body)
+}
+
+// DeliverPDU pushes a hex SMS-DELIVER PDU, SMSC included, as a +CMT in the
+// format of the current mode. Text mode shows the text alone, UCS2 as hex,
+// so the parts of a concatenated message can't be told apart. Anything but
+// a valid SMS-DELIVER is refused.
+func (m *Modem) DeliverPDU(pdu string) error {
+	decoded, err := gsm.DecodePDU(pdu)
+	if err != nil {
+		return err
+	}
+	deliver, ok := decoded.(*gsm.Deliver)
+	if !ok {
+		return fmt.Errorf("%w: %T is not an SMS-DELIVER", gsm.ErrPDU, decoded)
+	}
+	m.mu.Lock()
+	pduMode := m.pduMode
+	m.mu.Unlock()
+	if pduMode {
+		// Decoded, so the SMSC length octet is there
+		smsc, _ := strconv.ParseUint(pdu[:2], 16, 8)
+		m.URC(fmt.Sprintf("+CMT: ,%d", len(pdu)/2-int(smsc)-1), pdu)
+		return nil
+	}
+	sender := deliver.Originator.String()
+	m.mu.Lock()
+	details, body := m.textMessage(sender, deliver.Text)
+	m.mu.Unlock()
+	m.URC(fmt.Sprintf("+CMT: \"%s\",\"\",\"%s\"%s", sender, scts(deliver.Timestamp), details), body)
+	return nil
+}
+
+// scts formats a timestamp as text mode shows it, "yy/MM/dd,hh:mm:ss±zz"
+func scts(t time.Time) string {
+	_, offset := t.Zone()
+	quarters := offset / (15 * 60)
+	sign := "+"
+	if quarters < 0 {
+		sign, quarters = "-", -quarters
+	}
+	return fmt.Sprintf("%s%s%02d", t.Format("06/01/02,15:04:05"), sign, quarters)
+}
+
+// DeliveryReport pushes a +CDS status report for a message sent with
+// AT+CMGS, in the format of the current mode
+func (m *Modem) DeliveryReport(reference int, recipient string, status byte) {
+	m.mu.Lock()
+	pduMode := m.pduMode
+	m.mu.Unlock()
+	now := time.Now()
+	if !pduMode {
+		timestamp := now.Format("06/01/02,15:04:05") + "+28"
+		m.URC(fmt.Sprintf("+CDS: 6,%d,\"%s\",145,\"%s\",\"%s\",%d", reference, recipient, timestamp, timestamp, status))
+		return
+	}
+	report := &gsm.StatusReport{
+		Reference: byte(reference),
+		Recipient: gsm.ParseAddress(recipient),
+		Timestamp: now,
+		Discharge: now,
+		Status:    gsm.TPStatus(status),
+	}
+	pdu, length, err := report.Encode()
+	if err != nil {
+		return
+	}
+	m.URC(fmt.Sprintf("+CDS: %d", length), pdu)
+}
+
+// SetFile puts a file into the emulated UFS storage
+func (m *Modem) SetFile(name string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = append([]byte(nil), data...)
+}
+
+// File returns a file from the emulated UFS storage
+func (m *Modem) File(name string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[name]
+	return data, ok
+}
+
+// Checksum is the Quectel UFS checksum, XOR of every 16-bit big endian word
+func Checksum(data []byte) uint16 {
+	var sum uint16
+	for i := 0; i < len(data); i += 2 {
+		word := uint16(data[i]) << 8
+		if i+1 < len(data) {
+			word |= uint16(data[i+1])
+		}
+		sum ^= word
+	}
+	return sum
+}
+
+func (m *Modem) writeLines(lines []string) {
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString("\r\n")
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	m.Write([]byte(b.String()))
+}
+
+func (m *Modem) run() {
+	defer close(m.done)
+	buf := make([]byte, 256)
+	line := ""
+	for {
+		n, err := m.dev.Read(buf)
+		if err != nil {
+			return
+		}
+		line += string(buf[:n])
+		for {
+			if r := m.receiving(); r != nil {
+				line = r.feed(m, line)
+				if line == "" {
+					break
+				}
+				continue
+			}
+			idx := strings.IndexAny(line, "\r\n")
+			if idx == -1 {
+				break
+			}
+			command := line[:idx]
+			line = line[idx:]
+			if m.receiving() == nil {
+				line = strings.TrimLeft(line, "\r\n")
+			}
+			if command == "" {
+				continue
+			}
+			m.process(command)
+			if m.receiving() != nil {
+				// Only the command terminator may precede the payload
+				line = strings.TrimPrefix(strings.TrimPrefix(line, "\r"), "\n")
+			}
+		}
+	}
+}
+
+func (m *Modem) process(command string) {
+	m.mu.Lock()
+	m.commands = append(m.commands, command)
+	echo := m.echo
+	var fn HandlerFunc
+	upper := strings.ToUpper(command)
+	for i := len(m.handlers) - 1; i >= 0; i-- {
+		if strings.HasPrefix(upper, m.handlers[i].prefix) {
+			fn = m.handlers[i].fn
+			break
+		}
+	}
+	latency := m.Latency
+	echoDelay := m.EchoDelay
+	m.mu.Unlock()
+
+	if echo {
+		time.Sleep(echoDelay)
+		m.Write([]byte(command + "\r\n"))
+	}
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if fn == nil {
+		fn = builtin
+	}
+	m.writeLines(fn(m, command))
+}
+
+func builtin(m *Modem, command string) []string {
+	if lines, ok := m.fileCommand(command); ok {
+		return lines
+	}
+	upper := strings.ToUpper(command)
+	switch {
+	case upper == "AT", upper == "ATA", upper == "ATH":
+		return []string{"OK"}
+	case upper == "ATZ":
+		// The stored profile is in text mode
+		m.mu.Lock()
+		m.pduMode = false
+		m.mu.Unlock()
+		return []string{"OK"}
+	case upper == "ATE0", upper == "ATE1":
+		m.mu.Lock()
+		m.echo = upper == "ATE1"
+		m.mu.Unlock()
+		return []string{"OK"}
+	case upper == "AT+CCID", upper == "AT+QCCID":
+		return []string{"+CCID: " + m.ICCID, "OK"}
+	case upper == "AT+CGSN":
+		if m.PrefixedIdentity {
+			return []string{"+CGSN: " + m.IMEI, "OK"}
+		}
+		return []string{m.IMEI, "OK"}
+	case upper == "ATI":
+		return []string{m.Manufacturer, m.Model, "Revision: " + m.Revision, "OK"}
+	case upper == "AT+CGMR":
+		if m.PrefixedIdentity {
+			return []string{"+CGMR: " + m.Revision, "OK"}
+		}
+		return []string{m.Revision, "OK"}
+	case upper == "AT+CIMI":
+		return []string{m.IMSI, "OK"}
+	case upper == "AT+CNUM":
+		if m.MSISDN == "" {
+			return []string{"OK"}
+		}
+		return []string{fmt.Sprintf("+CNUM: \"\",\"%s\",145", m.MSISDN), "OK"}
+	case upper == "AT+COPS?":
+		return []string{fmt.Sprintf("+COPS: 0,0,\"%s\",7", m.Operator), "OK"}
+	case upper == "AT+CSQ":
+		return []string{fmt.Sprintf("+CSQ: %d,99", m.Signal), "OK"}
+	case upper == "AT+CREG?":
+		return []string{"+CREG: 0,1", "OK"}
+	case strings.HasPrefix(upper, "AT+CMEE="):
+		m.mu.Lock()
+		m.cmee = command[len("AT+CMEE="):]
+		m.mu.Unlock()
+		return []string{"OK"}
+	case upper == "AT+CMEE?":
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.cmee == "" {
+			return []string{"+CMEE: 0", "OK"}
+		}
+		return []string{"+CMEE: " + m.cmee, "OK"}
+	case upper == "AT+CSDH=0", upper == "AT+CSDH=1":
+		m.mu.Lock()
+		m.csdh = upper == "AT+CSDH=1"
+		m.mu.Unlock()
+		return []string{"OK"}
+	case upper == "AT+CMGF?":
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.pduMode {
+			return []string{"+CMGF: 0", "OK"}
+		}
+		return []string{"+CMGF: 1", "OK"}
+	case upper == "AT+CMGF=0", upper == "AT+CMGF=1":
+		m.mu.Lock()
+		m.pduMode = upper == "AT+CMGF=0"
+		m.mu.Unlock()
+		return []string{"OK"}
+	case strings.HasPrefix(upper, "AT+CUSD="):
+		return m.ussd(command)
+	case strings.HasPrefix(upper, "AT+CMGS="):
+		return m.submit(command)
+	case strings.HasPrefix(upper, "AT+CMGR="):
+		return m.readSMS(command)
+	case strings.HasPrefix(upper, "AT+CMGD="):
+		return m.deleteSMS(command)
+	case strings.HasPrefix(upper, "AT+QFDWL="):
+		m.download(command)
+		return nil
+	case strings.HasPrefix(upper, "AT+QFDEL="):
+		name := strings.TrimPrefix(unquote(command[len("AT+QFDEL="):]), "UFS:")
+		m.mu.Lock()
+		if name == "*" {
+			m.files = map[string][]byte{}
+		} else {
+			delete(m.files, name)
+		}
+		m.mu.Unlock()
+		return []string{"OK"}
+	case strings.HasPrefix(upper, "AT+"), strings.HasPrefix(upper, "AT&"):
+		// Setters such as CMEE, CMGF, CNMI, CLIP, QAUDRD
+		return []string{"OK"}
+	}
+	return []string{"ERROR"}
+}
+
+func (m *Modem) ussd(command string) []string {
+	params := strings.SplitN(command[len("AT+CUSD="):], ",", 3)
+	if len(params) < 2 {
+		return []string{"OK"}
+	}
+	code := unquote(params[1])
+	m.mu.Lock()
+	reply, ok := m.USSD[code]
+	m.mu.Unlock()
+	if !ok {
+		reply = fmt.Sprintf("TKC: 10000d. Code %s", code)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		m.URC(fmt.Sprintf("+CUSD: 0,\"%s\",15", reply))
+	}()
+	return []string{"OK"}
+}
+
+func (m *Modem) readSMS(command string) []string {
+	index, err := strconv.Atoi(strings.TrimSpace(command[len("AT+CMGR="):]))
+	if err != nil {
+		return []string{"+CMS ERROR: 321"}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sms, ok := m.sms[index]
+	if !ok {
+		return []string{"+CMS ERROR: 321"}
+	}
+	status := "REC UNREAD"
+	if sms.Read {
+		status = "REC READ"
+	}
+	sms.Read = true
+	if m.pduMode {
+		return pduSMS(sms, status)
+	}
+	details, body := m.textMessage(sms.Sender, sms.Text)
+	return []string{
+		fmt.Sprintf("+CMGR: \"%s\",\"%s\",,\"%s\"%s", status, sms.Sender, sms.Time, details),
+		body,
+		"OK",
+	}
+}
+
+// textMessage renders a message the way text mode shows it, UCS2 as hex.
+// details holds the header fields after the timestamp when AT+CSDH=1,
+// ,<tooa>,<fo>,<pid>,<dcs>,<sca>,<tosca>,<length>. The caller holds mu.
+func (m *Modem) textMessage(sender, text string) (details, body string) {
+	dcs := gsm.DCSFor(gsm.AlphabetGSM7)
+	body, length := text, len([]rune(text))
+	if _, _, err := (&gsm.Deliver{Originator: gsm.ParseAddress(sender), Text: text}).Encode(); err != nil {
+		dcs = gsm.DCSFor(gsm.AlphabetUCS2)
+		var data []byte
+		for _, unit := range utf16.Encode([]rune(text)) {
+			data = append(data, byte(unit>>8), byte(unit))
+		}
+		body, length = strings.ToUpper(hex.EncodeToString(data)), len(data)
+	}
+	if !m.csdh {
+		return "", body
+	}
+	tooa := 129
+	if strings.HasPrefix(sender, "+") {
+		tooa = 145
+	}
+	return fmt.Sprintf(",%d,4,0,%d,\"+84980200030\",145,%d", tooa, dcs, length), body
+}
+
+// pduSMS lists a stored message in PDU mode, as GSM 7-bit when the text
+// allows it and UCS2 otherwise
+func pduSMS(sms *SMS, status string) []string {
+	stat := 0
+	if status == "REC READ" {
+		stat = 1
+	}
+	deliver := &gsm.Deliver{
+		SMSC:       gsm.ParseAddress("+84980200030"),
+		Originator: gsm.ParseAddress(sms.Sender),
+		Timestamp:  smsTime(sms.Time),
+		Text:       sms.Text,
+	}
+	pdu, length, err := deliver.Encode()
+	if err != nil {
+		deliver.DCS = gsm.DCSFor(gsm.AlphabetUCS2)
+		pdu, length, err = deliver.Encode()
+	}
+	if err != nil {
+		return []string{"+CMS ERROR: 500"}
+	}
+	return []string{fmt.Sprintf("+CMGR: %d,,%d", stat, length), pdu, "OK"}
+}
+
+// smsTime reads the "yy/MM/dd,hh:mm:ss±zz" of a stored message, the zone in
+// quarters of an hour. Anything else gives the current time.
+func smsTime(value string) time.Time {
+	if len(value) < 18 {
+		return time.Now()
+	}
+	quarters, err := strconv.Atoi(value[17:])
+	if err != nil {
+		return time.Now()
+	}
+	t, err := time.ParseInLocation("06/01/02,15:04:05", value[:17], time.FixedZone("", quarters*15*60))
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
+
+// submit prompts for the message of AT+CMGS, it ends with Ctrl-Z. In PDU
+// mode the announced length must match the TPDU.
+func (m *Modem) submit(command string) []string {
+	m.mu.Lock()
+	pduMode := m.pduMode
+	m.receive = &receiver{until: 0x1A, done: func(m *Modem, data []byte) []string {
+		body := string(data)
+		if pduMode {
+			length, _ := strconv.Atoi(command[len("AT+CMGS="):])
+			smsc, err := strconv.ParseUint(body[:min(2, len(body))], 16, 8)
+			if err != nil || len(body) != (int(smsc)+1+length)*2 {
+				return []string{"+CMS ERROR: 304"}
+			}
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.submitted = append(m.submitted, body)
+		m.reference = (m.reference + 1) % 256
+		return []string{fmt.Sprintf("+CMGS: %d", m.reference), "OK"}
+	}}
+	m.mu.Unlock()
+	m.Write([]byte("\r\n> "))
+	return nil
+}
+
+// Submitted returns the messages sent with AT+CMGS, PDUs in PDU mode and
+// text in text mode
+func (m *Modem) Submitted() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.submitted...)
+}
+
+func (m *Modem) deleteSMS(command string) []string {
+	params := strings.Split(command[len("AT+CMGD="):], ",")
+	index, err := strconv.Atoi(strings.TrimSpace(params[0]))
+	if err != nil {
+		return []string{"+CMS ERROR: 321"}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(params) > 1 && strings.TrimSpace(params[1]) == "4" {
+		m.sms = map[int]*SMS{}
+		return []string{"OK"}
+	}
+	delete(m.sms, index)
+	return []string{"OK"}
+}
+
+// SMSIndexes returns the indexes of stored messages
+func (m *Modem) SMSIndexes() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	indexes := make([]int, 0, len(m.sms))
+	for index := range m.sms {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+func (m *Modem) download(command string) {
+	name := strings.TrimPrefix(unquote(strings.TrimSuffix(command[len("AT+QFDWL="):], ";")), "UFS:")
+	data, ok := m.File(name)
+	if !ok {
+		m.writeLines([]string{"+CME ERROR: 405"})
+		return
+	}
+	m.mu.Lock()
+	announce := m.ConnectLength
+	m.mu.Unlock()
+	var b strings.Builder
+	if announce {
+		b.WriteString(fmt.Sprintf("\r\nCONNECT %d\r\n", len(data)))
+	} else {
+		b.WriteString("\r\nCONNECT\r\n")
+	}
+	b.Write(data)
+	b.WriteString(fmt.Sprintf("\r\n+QFDWL: %d,%04x\r\n\r\nOK\r\n", len(data), Checksum(data)))
+	m.Write([]byte(b.String()))
+}
+
+func unquote(s string) string {
+	return strings.Trim(strings.TrimSpace(s), "\"")
+}
@@ -0,0 +1,281 @@
+package gsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-gsm/pkg/logrus"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// SMSDelivery selects how the modem hands over received messages
+type SMSDelivery string
+
+const (
+	// SMSDirect routes messages to the host as +CMT without storing them
+	SMSDirect SMSDelivery = "direct"
+	// SMSStored stores messages and announces their index with +CMTI,
+	// they survive the host being down
+	SMSStored SMSDelivery = "stored"
+)
+
+// cnmi returns the AT+CNMI settings for a delivery mode, status reports
+// follow the same route
+func (d SMSDelivery) cnmi(reports bool) (string, error) {
+	switch {
+	case d == SMSDirect && reports:
+		return "AT+CNMI=2,2,0,1,0", nil
+	case d == SMSDirect:
+		return "AT+CNMI=2,2,0,0,0", nil
+	case d == SMSStored && reports:
+		return "AT+CNMI=2,1,0,2,0", nil
+	case d == SMSStored:
+		return "AT+CNMI=2,1,0,0,0", nil
+	}
+	return "", fmt.Errorf("unknown SMS delivery %q", d)
+}
+
+// SetSMSDelivery configures new message indications. With ack, phase 2+
+// is enabled (AT+CSMS=1) and every +CMT is acknowledged with AT+CNMA, the
+// network then retries messages the host never acknowledged.
+func (s *SerialSubject) SetSMSDelivery(ctx context.Context, delivery SMSDelivery, ack bool) error {
+	cnmi, err := delivery.cnmi(s.statusReportsOn())
+	if err != nil {
+		return err
+	}
+	service := "AT+CSMS=0"
+	if ack {
+		service = "AT+CSMS=1"
+	}
+	if err := s.SendAndWaitOKContext(ctx, service); err != nil {
+		return err
+	}
+	if err := s.SendAndWaitOKContext(ctx, cnmi); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.smsAck = ack && delivery == SMSDirect
+	s.smsDelivery = delivery
+	s.mu.Unlock()
+	return nil
+}
+
+// acknowledgeSMS sends AT+CNMA for a +CMT when acknowledgement is enabled
+func (s *SerialSubject) acknowledgeSMS() {
+	s.mu.RLock()
+	ack := s.smsAck
+	s.mu.RUnlock()
+	if !ack {
+		return
+	}
+	if err := s.SendAndWaitOK("AT+CNMA"); err != nil {
+		logrus.LogrusLoggerWithContext(s.ctx).Errorf("Error acknowledging SMS: %v", err)
+	}
+}
+
+// SMSSubmitTimeout bounds each AT+CMGS, the network can take a while
+var SMSSubmitTimeout = time.Minute
+
+// ErrSMSTooLong is returned for texts needing more than 255 parts
+var ErrSMSTooLong = errors.New("SMS too long")
+
+// learnSMSMode follows AT+CMGF so SendSMS knows the message format. ATZ
+// and AT&F restore the stored format, it is asked again with AT+CMGF?.
+func (s *SerialSubject) learnSMSMode(line string) {
+	switch upper := strings.ToUpper(strings.ReplaceAll(line, " ", "")); {
+	case upper == "AT+CMGF=0":
+		s.pduMode.Store(true)
+		s.smsModeKnown.Store(true)
+	case upper == "AT+CMGF=1":
+		s.pduMode.Store(false)
+		s.smsModeKnown.Store(true)
+	case upper == "ATZ", strings.HasPrefix(upper, "AT&F"):
+		s.smsModeKnown.Store(false)
+	}
+}
+
+// smsPDUMode reports whether the modem is in PDU mode, querying it when no
+// AT+CMGF was seen since the transport was attached or the modem reset.
+// The caller holds smsMu.
+func (s *SerialSubject) smsPDUMode(ctx context.Context) (bool, error) {
+	if s.smsModeKnown.Load() {
+		return s.pduMode.Load(), nil
+	}
+	data, err := s.SendAndGetDataContext(ctx, "+CMGF", "AT+CMGF?", 0)
+	if err != nil {
+		return false, err
+	}
+	switch strings.TrimSpace(strings.TrimPrefix(data, "+CMGF:")) {
+	case "0":
+		s.pduMode.Store(true)
+	case "1":
+		s.pduMode.Store(false)
+	default:
+		return false, fmt.Errorf("unexpected message format %q", data)
+	}
+	s.smsModeKnown.Store(true)
+	return s.pduMode.Load(), nil
+}
+
+// SendSMS sends text to number and returns the message reference of every
+// part. GSM 7-bit is used when the text allows it, UCS2 otherwise, and long
+// texts are split into concatenated parts. Text mode only carries a single
+// GSM 7-bit part, other messages are sent in PDU mode and the modem is
+// switched back afterwards. With SetStatusReports on, every part is
+// followed by SMSStatus and SMSStatusChanged.
+func (s *SerialSubject) SendSMS(ctx context.Context, number, text string) ([]int, error) {
+	alphabet, parts := splitSMS(text)
+	if len(parts) > 255 {
+		return nil, fmt.Errorf("%w: %d parts", ErrSMSTooLong, len(parts))
+	}
+	s.smsMu.Lock()
+	defer s.smsMu.Unlock()
+	pduMode, err := s.smsPDUMode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !pduMode {
+		if alphabet == AlphabetGSM7 && len(parts) == 1 && textModeSafe(text) {
+			reference, err := s.submitText(ctx, number, text)
+			if err != nil {
+				return nil, err
+			}
+			s.trackSMS(reference, number)
+			return []int{reference}, nil
+		}
+		if err := s.SendAndWaitOKContext(ctx, "AT+CMGF=0"); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := s.SendAndWaitOKContext(context.WithoutCancel(ctx), "AT+CMGF=1"); err != nil {
+				logrus.LogrusLoggerWithContext(s.ctx).Errorf("Error restoring text mode: %v", err)
+			}
+		}()
+	}
+	concat := int(s.smsReference.Add(1) & 0xFF)
+	reports := s.statusReportsOn()
+	references := make([]int, 0, len(parts))
+	for i, part := range parts {
+		submit := &Submit{
+			StatusReportRequest: reports,
+			Destination:         ParseAddress(number),
+			DCS:                 DCSFor(alphabet),
+			Text:                part,
+		}
+		if len(parts) > 1 {
+			submit.UDH = ConcatHeader(concat, len(parts), i+1)
+		}
+		reference, err := s.submitPDU(ctx, submit)
+		if err != nil {
+			return references, fmt.Errorf("part %d/%d: %w", i+1, len(parts), err)
+		}
+		s.trackSMS(reference, number)
+		references = append(references, reference)
+	}
+	logrus.LogrusLoggerWithContext(s.ctx).Infof("SMS to %s sent in %d parts: %v", number, len(parts), references)
+	return references, nil
+}
+
+// submitText sends a message in text mode, AT+CMGS="<number>"
+func (s *SerialSubject) submitText(ctx context.Context, number, text string) (int, error) {
+	return s.submit(ctx, fmt.Sprintf("AT+CMGS=\"%s\"", number), text)
+}
+
+// submitPDU sends an SMS-SUBMIT in PDU mode, AT+CMGS=<TPDU length>
+func (s *SerialSubject) submitPDU(ctx context.Context, submit *Submit) (int, error) {
+	pdu, length, err := submit.Encode()
+	if err != nil {
+		return 0, err
+	}
+	return s.submit(ctx, fmt.Sprintf("AT+CMGS=%d", length), pdu)
+}
+
+// submit writes the message after the "> " prompt, ended with Ctrl-Z, and
+// returns the reference from +CMGS: <mr>
+func (s *SerialSubject) submit(ctx context.Context, command, body string) (int, error) {
+	response, err := s.ExecContext(ctx, Command{
+		Line:    command,
+		Prefix:  "+CMGS:",
+		Timeout: SMSSubmitTimeout,
+		prompt:  ">",
+		payload: strings.NewReader(body + "\x1A"),
+	})
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Split(strings.TrimPrefix(response.First(), "+CMGS:"), ",")
+	reference, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil {
+		return 0, fmt.Errorf("unexpected response %q", response.First())
+	}
+	return reference, nil
+}
+
+// splitSMS picks the alphabet for text and splits it into the parts of a
+// message, a single part needs no user data header and holds more
+func splitSMS(text string) (Alphabet, []string) {
+	if septets, err := encodeGSM7(text); err == nil {
+		if len(septets) <= 160 {
+			return AlphabetGSM7, []string{text}
+		}
+		// 153 septets per part beside the concatenation header, escape
+		// sequences are never split
+		var parts []string
+		var part strings.Builder
+		size := 0
+		for _, r := range text {
+			width := 1
+			if _, ok := gsm7ExtensionReverse[r]; ok {
+				width = 2
+			}
+			if size+width > 153 {
+				parts = append(parts, part.String())
+				part.Reset()
+				size = 0
+			}
+			part.WriteRune(r)
+			size += width
+		}
+		return AlphabetGSM7, append(parts, part.String())
+	}
+	if len(utf16.Encode([]rune(text))) <= 70 {
+		return AlphabetUCS2, []string{text}
+	}
+	// 67 UTF-16 units per part, surrogate pairs are never split
+	var parts []string
+	var part strings.Builder
+	size := 0
+	for _, r := range text {
+		width := 1
+		if r > 0xFFFF {
+			width = 2
+		}
+		if size+width > 67 {
+			parts = append(parts, part.String())
+			part.Reset()
+			size = 0
+		}
+		part.WriteRune(r)
+		size += width
+	}
+	return AlphabetUCS2, append(parts, part.String())
+}
+
+// textModeSafe reports whether text reads the same in ASCII and in the
+// GSM 03.38 default alphabet, the modem may take text mode input in either
+// (AT+CSCS="IRA" or "GSM"). '@', '$', '_', '`', brackets, braces and the
+// rest of the symbols sit elsewhere in GSM 03.38 or need an escape.
+func textModeSafe(text string) bool {
+	for _, r := range text {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		case strings.ContainsRune(" !\"#%&'()*+,-./:;<=>?\n\r", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -5,79 +5,114 @@ import (
 	"fmt"
 	"go-gsm/pkg/logrus"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 	"unicode/utf16"
 )
 
 type SMSObserver struct {
 	SerialSubject *SerialSubject
-	queue         []string
-	isReading     bool
 }
 
 func NewSMSObserver(subject *SerialSubject) *SMSObserver {
 	return &SMSObserver{
 		SerialSubject: subject,
-		queue:         []string{},
-		isReading:     false,
 	}
 }
 
-func (s *SMSObserver) isSMSResponse(data string) bool {
-	allows := []string{"+CMTI:", "+CMGR:"}
-	for _, allow := range allows {
-		if strings.Contains(data, allow) {
-			return true
-		}
-	}
-	return false
-}
-
 func (s *SMSObserver) isNotify(data string) bool {
-	return strings.Contains(data, "+CMTI:")
+	return strings.HasPrefix(data, "+CMTI:")
 }
 
-func (s *SMSObserver) isRead(data string) bool {
-	return strings.Contains(data, "+CMGR:")
-}
-
-func (s *SMSObserver) enqueueSMS(index string) {
-	s.queue = append(s.queue, index)
-	if !s.isReading {
-		s.processNextSMS()
+// readSMS fetches a stored message, it runs outside the reader goroutine
+// because the response is read by it. Text mode lists
+//
+//	+CMGR: "REC UNREAD","+84900000000",,"24/10/17,10:00:00+28"
+//
+// followed with AT+CSDH=1 by ,<tooa>,<fo>,<pid>,<dcs>,<sca>,<tosca>,<length>,
+//
+// and PDU mode +CMGR: <stat>,[<alpha>],<length> followed by the PDU.
+func (s *SMSObserver) readSMS(index string) {
+	s.SerialSubject.smsMu.Lock()
+	response, err := s.SerialSubject.Exec(Command{Line: fmt.Sprintf("AT+CMGR=%s", index), Prefix: "+CMGR:"})
+	s.SerialSubject.smsMu.Unlock()
+	if err != nil {
+		logrus.LogrusLoggerWithContext(s.SerialSubject.ctx).Errorf("Error reading SMS: %v", err)
+		return
 	}
-}
-
-func (s *SMSObserver) processNextSMS() {
-	if len(s.queue) == 0 {
+	number, _ := strconv.Atoi(index)
+	fields := splitFields(strings.TrimPrefix(response.First(), "+CMGR:"))
+	if len(fields) > 0 && len(response.Lines) > 1 {
+		if _, err := strconv.Atoi(fields[0]); err == nil {
+			s.receivePDU(response.Lines[1], number)
+			return
+		}
+	}
+	var re = regexp.MustCompile(`\+CMGR: "REC (?:UNREAD|READ)","(.*?)",.*?,"(.*?)"`)
+	match := re.FindStringSubmatch(response.First())
+	if len(match) < 3 {
 		return
 	}
-	index := s.queue[0]
-	s.queue = s.queue[1:]
-
-	if err := s.SerialSubject.Send(fmt.Sprintf("AT+CMGR=%s", index)); err != nil {
-		logrus.LogrusLoggerWithContext(s.SerialSubject.ctx).Errorf("Error reading SMS: %v", err)
-	} else {
-		s.isReading = true
+	dcs := ""
+	if len(fields) > 8 {
+		dcs = fields[8]
 	}
+	s.publish(match[1], match[2], textBody(response.Lines[1:], dcs), number)
 }
 
-func (s *SMSObserver) readSMS(data string) {
-	var re = regexp.MustCompile(`(?m)\+CMGR: "REC UNREAD","(.*?)",,"(.*?)"`)
-	match := re.FindStringSubmatch(data)
-	if len(match) < 3 {
+// receivePDU decodes an SMS-DELIVER listed or pushed in PDU mode
+func (s *SMSObserver) receivePDU(hexPDU string, index int) {
+	pdu, err := DecodePDU(hexPDU)
+	if err != nil {
+		logrus.LogrusLoggerWithContext(s.SerialSubject.ctx).Errorf("Error decoding SMS: %v", err)
+		return
+	}
+	deliver, ok := pdu.(*Deliver)
+	if !ok {
+		logrus.LogrusLoggerWithContext(s.SerialSubject.ctx).Warnf("Unexpected %s", pdu.Type())
 		return
 	}
-	content := strings.Join(strings.Split(data, "\r\n")[1:], "\r\n")
-	decode, err := decodeUCS2(content)
-	if err == nil {
-		content = decode
+	sender, timestamp := deliver.Originator.String(), formatSCTS(deliver.Timestamp)
+	if reference, total, seq, ok := deliver.UDH.Concat(); ok && total > 1 && seq >= 1 && seq <= total {
+		logrus.LogrusLoggerWithContext(s.SerialSubject.ctx).Debugf("SMS part %d/%d from %s", seq, total, sender)
+		s.SerialSubject.concat.add(ConcatPart{
+			Sender:    sender,
+			Reference: reference,
+			Total:     total,
+			Seq:       seq,
+			Time:      timestamp,
+			Text:      deliver.Text,
+			Index:     index,
+			Received:  time.Now(),
+		})
+		return
 	}
-	sender := match[1]
-	time := match[2]
-	logrus.LogrusLoggerWithContext(s.SerialSubject.ctx).Infof("SMS from %s at %s: %s", sender, time, content)
-	s.isReading = false
-	s.processNextSMS()
+	s.publish(sender, timestamp, deliver.Text, index)
+}
+
+func (s *SMSObserver) publish(sender, timestamp, content string, index int) {
+	logrus.LogrusLoggerWithContext(s.SerialSubject.ctx).Infof("SMS from %s at %s: %s", sender, timestamp, content)
+	s.SerialSubject.publish(SMSReceived{
+		PortName: s.SerialSubject.portName,
+		Sender:   sender,
+		Time:     timestamp,
+		Text:     content,
+		Index:    index,
+	})
+}
+
+// textBody joins the message lines of text mode, UCS2 is listed as hex.
+// Only the <dcs> shown with AT+CSDH=1 tells it apart from a text such as
+// "1234" that merely reads as hex.
+func textBody(lines []string, dcs string) string {
+	content := strings.Join(lines, "\n")
+	value, err := strconv.Atoi(dcs)
+	if err != nil || DCS(value).Alphabet() != AlphabetUCS2 {
+		return content
+	}
+	decoded, _ := decodeUCS2(content)
+	return decoded
 }
 
 func decodeUCS2(inputStr string) (string, error) {
@@ -99,15 +134,35 @@ func decodeUCS2(inputStr string) (string, error) {
 }
 
 func (s *SMSObserver) Update(data string) {
-	if !s.isSMSResponse(data) {
+	if !s.isNotify(data) {
 		return
 	}
-	if s.isNotify(data) {
-		index := strings.Replace(data, "+CMTI: \"ME\",", "", 1)
-		index = strings.TrimSpace(index)
-		s.enqueueSMS(index)
-	}
-	if s.isRead(data) {
-		s.readSMS(data)
+	// +CMTI: "ME",3
+	parts := strings.Split(data, ",")
+	index := strings.TrimSpace(parts[len(parts)-1])
+	go s.readSMS(index)
+}
+
+// receive handles a message routed directly to the host, text mode:
+//
+//	+CMT: "+84900000000","","24/10/17,10:00:00+28"
+//	hello
+//
+// the header followed with AT+CSDH=1 by ,<tooa>,<fo>,<pid>,<dcs>,...
+// or PDU mode, +CMT: [<alpha>],<length> followed by the PDU
+func (s *SMSObserver) receive(lines []string) {
+	defer s.SerialSubject.acknowledgeSMS()
+	fields := splitFields(strings.TrimPrefix(lines[0], "+CMT:"))
+	switch len(fields) {
+	case 2:
+		s.receivePDU(lines[1], -1)
+	case 0, 1:
+		logrus.LogrusLoggerWithContext(s.SerialSubject.ctx).Warnf("Unsupported +CMT: %s", lines[0])
+	default:
+		dcs := ""
+		if len(fields) > 6 {
+			dcs = fields[6]
+		}
+		s.publish(fields[0], fields[2], textBody(lines[1:], dcs), -1)
 	}
 }
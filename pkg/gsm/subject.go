@@ -2,36 +2,93 @@ package gsm
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"go-gsm/pkg/logrus"
 	"go.bug.st/serial"
+	"io"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// SerialObserver receives raw lines, see Subscribe for typed events
 type SerialObserver interface {
 	Update(data string)
 }
 
 type SerialSubject struct {
 	ctx       *context.Context
-	observers []SerialObserver
+	observers map[SerialObserver]*Subscription
 	mu        sync.RWMutex
-	port      serial.Port
+	port      Transport
 	portName  string
 	buffer    string
-	phone     string
-	network   string
-	ccid      string
-	signal    int
-	channels  map[string]chan string
-	skipList  []string
-	cusd      string
-	wavBuffer []byte
+	// urcs routes unsolicited lines, urcRoute and urcLines hold a
+	// multi-line URC being received
+	urcs        []URCRoute
+	urcRoute    URCRoute
+	urcLines    []string
+	urcHandlers eventBus
+	// lastSent is the last command line written, to recognize its echo
+	lastSent atomic.Value
+	echo     atomic.Int32
+	// cmdSlot admits one command at a time, waiters queue in FIFO order
+	cmdSlot chan struct{}
+	cmdMu   sync.Mutex
+	pending *pendingCommand
+	// stale is set by a command that gave up before its echo, its answer
+	// may still come. Guarded by cmdSlot.
+	stale  bool
+	ussdMu sync.Mutex
+	ussd   chan string
+	// closed is closed by Close, readerDone once the read goroutine exits
+	closed     chan struct{}
+	closeOnce  sync.Once
+	readerDone chan struct{}
+	// connLost is closed when the current transport fails on its own
+	connMu      sync.Mutex
+	connLost    chan struct{}
+	connErr     error
+	started     bool
+	onRecording func(name string, data []byte)
+	autoAnswer  bool
+	smsAck      bool
+	smsDelivery SMSDelivery
+	// statusReports requests a report for every sent message, delivery
+	// tracks their state
+	statusReports bool
+	delivery      deliveryTracker
+	// pduMode follows AT+CMGF while smsModeKnown, smsReference numbers
+	// concatenated messages
+	pduMode      atomic.Bool
+	smsModeKnown atomic.Bool
+	// smsMu keeps the message format from changing under AT+CMGS and
+	// AT+CMGR, SendSMS switches it for the duration of a send
+	smsMu        sync.Mutex
+	smsReference atomic.Int32
+	concat       *reassembler
+	profile      *InitProfile
+	info         ModemInfo
+	monitor      *Monitor
+	// timeouts counts commands in a row without a final result code
+	timeouts atomic.Int32
+	timedOut chan struct{}
+	events   eventBus
+	lines    eventBus
+	// trace records the traffic of every attached transport
+	trace     io.Writer
+	traceFile *os.File
 }
 
+// ErrClosed is returned by every operation once the subject is closed
+var ErrClosed = errors.New("serial subject closed")
+
+// ErrDisconnected is returned to commands whose transport failed
+var ErrDisconnected = errors.New("modem disconnected")
+
 // GetAvailablePorts returns a list of available serial ports
 func GetAvailablePorts() ([]string, error) {
 	ports, err := serial.GetPortsList()
@@ -41,287 +98,391 @@ func GetAvailablePorts() ([]string, error) {
 	return ports, nil
 }
 
+// CreatePort opens a serial port at baudRate, 8N1. See CreatePortWithOptions
+// for anything else.
 func CreatePort(portName string, baudRate int) (serial.Port, error) {
-	mode := &serial.Mode{
-		BaudRate: baudRate,
-	}
-	port, errOpen := serial.Open(portName, mode)
-	return port, errOpen
+	return CreatePortWithOptions(portName, WithBaudRate(baudRate))
 }
 
-func NewSerial(ctx *context.Context, port serial.Port, portName string) *SerialSubject {
-	skipList := []string{
-		"AT",
-		"OK",
-		"+CREG",
-		"CONNECT",
-	}
-	return &SerialSubject{
-		ctx:       ctx,
-		observers: make([]SerialObserver, 0),
-		mu:        sync.RWMutex{},
-		port:      port,
-		portName:  portName,
-		buffer:    "",
-		channels:  make(map[string]chan string),
-		skipList:  skipList,
-		cusd:      "",
-		wavBuffer: nil,
+// NewSerial creates a subject on top of any Transport, a serial.Port from
+// CreatePort, a TCP connection from DialTCP, a pty or an in-memory pipe
+func NewSerial(ctx *context.Context, port Transport, portName string) *SerialSubject {
+	s := &SerialSubject{
+		ctx:        ctx,
+		observers:  make(map[SerialObserver]*Subscription),
+		mu:         sync.RWMutex{},
+		port:       port,
+		portName:   portName,
+		buffer:     "",
+		cmdSlot:    make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+		autoAnswer: true,
+		timedOut:   make(chan struct{}, 1),
 	}
+	// URC handlers read SMS and acknowledge them, none may be dropped
+	handlers := newSubscriber(ctx, []SubscribeOption{WithOverflow(overflowGrow)})
+	handlers.handler = func(item any) { item.(func())() }
+	s.urcHandlers.add(handlers)
+	s.concat = newReassembler(s)
+	s.registerBuiltinURCs()
+	return s
 }
 
-// attach adds an observer to the list of observers
-func (s *SerialSubject) attach(observer SerialObserver) {
+// attach adds an observer fed from its own queue
+func (s *SerialSubject) attach(observer SerialObserver, opts ...SubscribeOption) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.observers = append(s.observers, observer)
+	if _, ok := s.observers[observer]; ok {
+		return
+	}
+	sub := newSubscriber(s.ctx, opts)
+	sub.handler = func(item any) { observer.Update(item.(string)) }
+	s.observers[observer] = s.lines.add(sub)
 }
 
-// notify sends a message to all observers
+// notify queues a line for every observer, it never waits for them
 func (s *SerialSubject) notify(data string) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	for _, observer := range s.observers {
-		observer.Update(data)
-	}
+	s.lines.publish(data)
 }
 
+// Open starts reading the port and initializes the modem
 func (s *SerialSubject) Open() error {
-	s.attach(NewSMSObserver(s))
-	s.attach(NewCallObserver(s))
-	s.attach(NewInfoObserver(s))
-	go s.read()
-	// Enable error messages
-	_ = s.SendAndWaitOK("AT+CMEE=2")
-	// Set the modem to text mode
-	_ = s.SendAndWaitOK("AT+CMGF=1")
-	// Set the modem to notify when a new SMS is received
-	_ = s.SendAndWaitOK("AT+CNMI=2,2,0,0,0")
-	// Enable caller ID
-	_ = s.SendAndWaitOK("AT+CLIP=1")
-	// Delete all files in the file system
-	//_ = s.SendAndWaitOK("AT+QFDEL=\"*\"")
-	// Get ICCID
-	ccid, errCCID := s.SendAndGetData("+CCID", "AT+CCID", 5*time.Second)
-	if errCCID != nil {
-		logrus.LogrusLoggerWithContext(s.ctx).Error(errCCID)
+	return s.OpenContext(s.baseContext())
+}
+
+// OpenContext is Open with a context bounding the init sequence. The
+// subject closes itself when the context given to NewSerial is done.
+func (s *SerialSubject) OpenContext(ctx context.Context) error {
+	s.connMu.Lock()
+	port := s.port
+	s.connMu.Unlock()
+	s.attachTransport(port)
+	return s.initModem(ctx)
+}
+
+// Reopen swaps in a new transport after the previous one was lost, then
+// replays the init sequence. Observers and waiters are kept.
+func (s *SerialSubject) Reopen(ctx context.Context, port Transport) error {
+	s.attachTransport(port)
+	return s.initModem(ctx)
+}
+
+// attachTransport starts reading a transport, the first call also attaches
+// the built-in observers and ties the subject to its context
+func (s *SerialSubject) attachTransport(port Transport) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if !s.started {
+		s.started = true
+		go func() {
+			select {
+			case <-s.baseContext().Done():
+				_ = s.Close()
+			case <-s.closed:
+			}
+		}()
 	}
-	s.ccid = ccid
-	// Get phone service
-	cops, errCops := s.SendAndGetData("+COPS", "AT+COPS?", 5*time.Second)
-	if errCops != nil {
-		logrus.LogrusLoggerWithContext(s.ctx).Error(errCops)
+	if s.trace != nil {
+		if _, ok := port.(*TraceTransport); !ok {
+			port = NewTraceTransport(port, s.trace)
+		}
 	}
-	network := extractNetwork(cops)
-	logrus.LogrusLoggerWithContext(s.ctx).Infof("COPS: %s", cops)
-	logrus.LogrusLoggerWithContext(s.ctx).Infof("Network: %s", network)
-	ussd := "*101#"
-	if network == "Vinaphone" {
-		ussd = "*111#"
+	s.port = port
+	// The modem may have restarted behind a new transport
+	s.smsModeKnown.Store(false)
+	s.buffer = ""
+	s.urcLines = nil
+	s.connLost = make(chan struct{})
+	s.connErr = nil
+	s.readerDone = make(chan struct{})
+	go s.read(port, s.connLost, s.readerDone)
+}
+
+// dropTransport closes the current transport and waits for its reader
+func (s *SerialSubject) dropTransport() {
+	s.connMu.Lock()
+	port := s.port
+	done := s.readerDone
+	s.connMu.Unlock()
+	_ = port.Close()
+	if done != nil {
+		<-done
 	}
-	cusd, errCUSD := s.SendUSSD(ussd)
-	if errCUSD != nil {
-		logrus.LogrusLoggerWithContext(s.ctx).Error(errCUSD)
+}
+
+// SetRecordingHandler receives call recordings downloaded after a call
+// ends, they are also published as RecordingReady
+func (s *SerialSubject) SetRecordingHandler(handler func(name string, data []byte)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onRecording = handler
+}
+
+// SetAutoAnswer controls whether incoming calls are answered and recorded.
+// IncomingCall and CallEnded are published either way.
+func (s *SerialSubject) SetAutoAnswer(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.autoAnswer = enabled
+}
+
+// AutoAnswer reports whether incoming calls are answered
+func (s *SerialSubject) AutoAnswer() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.autoAnswer
+}
+
+func (s *SerialSubject) recordingHandler() func(name string, data []byte) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.onRecording
+}
+
+// Lost returns a channel closed when the current transport fails. It is
+// replaced on Reopen.
+func (s *SerialSubject) Lost() <-chan struct{} {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	return s.connLost
+}
+
+// LostErr returns why the current transport failed
+func (s *SerialSubject) LostErr() error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	return s.connErr
+}
+
+// initModem runs the init profile on the current transport
+func (s *SerialSubject) initModem(ctx context.Context) error {
+	if err := s.runProfile(ctx, s.initProfile()); err != nil {
+		return err
 	}
-	logrus.LogrusLoggerWithContext(s.ctx).Infof("CUSD: %s", cusd)
-	return nil
+	return ctx.Err()
 }
 
-func (s *SerialSubject) getNetworkSignal() {
-	for {
-		if err := s.Send("AT+CSQ"); err != nil {
-			logrus.LogrusLoggerWithContext(s.ctx).Errorf("Error getting network signal: %v", err)
-		}
-		time.Sleep(30 * time.Second)
+// baseContext is the context given to NewSerial, or Background
+func (s *SerialSubject) baseContext() context.Context {
+	if s.ctx == nil || *s.ctx == nil {
+		return context.Background()
 	}
+	return *s.ctx
 }
 
-func (s *SerialSubject) read() {
+func (s *SerialSubject) read(port Transport, lost chan struct{}, done chan struct{}) {
+	defer close(done)
 	for {
 		buf := make([]byte, 128)
-		n, err := s.port.Read(buf)
+		n, err := port.Read(buf)
 		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				logrus.LogrusLoggerWithContext(s.ctx).Errorf("Lost %s: %v", s.portName, err)
+				s.connMu.Lock()
+				s.connErr = err
+				s.connMu.Unlock()
+				close(lost)
+			}
 			return
 		}
 		s.buffer += string(buf[:n])
 		for {
-			if idx := strings.Index(s.buffer, "\r\n"); idx != -1 {
-				message := s.buffer[:idx]
-				s.buffer = s.buffer[idx+2:]
-				if message == "" {
-					continue
-				}
-				if s.wavBuffer == nil && strings.HasPrefix(message, "RIFF") {
-					// Nếu chưa có buffer và thông điệp bắt đầu bằng "RIFF"
-					i := strings.Index(message, "RIFF")
-					s.wavBuffer = []byte(message[i:])
-					continue
-				}
-
-				if s.wavBuffer != nil {
-					// Nếu đã có buffer, kiểm tra chuỗi "+QFDWL"
-					i := strings.Index(message, "+QFDWL")
-					if i != -1 {
-						// Nối phần tin nhắn có "+QFDWL" vào buffer
-						s.wavBuffer = append(s.wavBuffer, []byte(message[i:])...)
-						logrus.LogrusLoggerWithContext(s.ctx).Info("Received WAV file")
-
-						// Ghi file WAV
-						if errWrite := os.WriteFile(fmt.Sprintf("%s.wav", s.portName), s.wavBuffer, 0644); errWrite != nil {
-							logrus.LogrusLoggerWithContext(s.ctx).Errorf("Error writing WAV file: %v", errWrite)
-						}
-
-						// Xóa buffer sau khi ghi xong
-						s.wavBuffer = nil
-						continue
-					} else {
-						// Nếu không tìm thấy "+QFDWL", tiếp tục nối dữ liệu vào buffer
-						s.wavBuffer = append(s.wavBuffer, []byte(message)...)
-						continue
-					}
-				}
-
-				if message == "OK" {
-					if _, ok := s.channels["OK"]; ok {
-						s.channels["OK"] <- message
-					}
-					continue
+			if rest, ok := s.feedRaw(s.buffer); ok {
+				s.buffer = rest
+				if rest == "" {
+					break
 				}
-				logrus.LogrusLoggerWithContext(s.ctx).Debugf("Received: %s", message)
-				isSkip := false
-				for _, skip := range s.skipList {
-					if strings.HasPrefix(message, skip) {
-						isSkip = true
-						break
-					}
-				}
-				if isSkip {
-					logrus.LogrusLoggerWithContext(s.ctx).Debugf("Skipped: %s", message)
+				continue
+			}
+			idx := strings.Index(s.buffer, "\r\n")
+			if idx == -1 {
+				if rest, ok := s.feedPrompt(s.buffer); ok {
+					s.buffer = rest
 					continue
 				}
-				// check if message is response to channel
-				keys := s.getWaitKeys()
-				for _, key := range keys {
-					if strings.HasPrefix(message, key) {
-						//logrus.LogrusLoggerWithContext(s.ctx).Debugf("Sent to %s channel: %s", key, message)
-						s.channels[key] <- message
-						continue
-					}
-				}
-				if strings.HasPrefix(message, "+CUSD:") {
-					firstIndex := strings.Index(message, "\"")
-					lastIndex := strings.LastIndex(message, "\"")
-					if firstIndex == lastIndex {
-						s.cusd = message[firstIndex+1:] + "\n"
-						continue
-					} else {
-						s.cusd = message[firstIndex+1:lastIndex] + "\n"
-						s.channels["USSD"] <- strings.TrimSpace(s.cusd)
-						s.cusd = ""
-						continue
-					}
-				}
-				if s.cusd != "" {
-					index := strings.Index(message, "\"")
-					if index != -1 {
-						s.cusd += message[:index]
-						s.channels["USSD"] <- strings.TrimSpace(s.cusd)
-						s.cusd = ""
-						continue
-					}
-					s.cusd += message + "\n"
-				}
-				s.notify(message)
-			} else {
 				break
 			}
+			message := s.buffer[:idx]
+			s.buffer = s.buffer[idx+2:]
+			if message == "" {
+				continue
+			}
+			s.handleLine(message)
 		}
 	}
 }
 
-// Close closes the serial port
-func (s *SerialSubject) Close() error {
-	errClose := s.port.Close()
-	if errClose != nil {
-		return errClose
+// handleLine routes one received line to the waiting command, the
+// observers and the URC routes
+func (s *SerialSubject) handleLine(message string) {
+	logrus.LogrusLoggerWithContext(s.ctx).Debugf("Received: %s", message)
+	if s.urcLines != nil {
+		// The rest of a multi-line URC goes before any command response. A
+		// fixed count takes any line, an SMS may well read "OK".
+		if s.urcRoute.Lines > 0 || !isFinalResult(message) {
+			s.notify(message)
+			s.handleURC(message)
+			return
+		}
+		logrus.LogrusLoggerWithContext(s.ctx).Warnf("Incomplete URC dropped: %q", s.urcLines)
+		s.urcLines = nil
 	}
-	return nil
+	if s.dispatchResponse(message) {
+		return
+	}
+	if err, ok := parseModemError(message); ok {
+		// Late or unsolicited, the command it belonged to already gave up
+		logrus.LogrusLoggerWithContext(s.ctx).Errorf("Unsolicited modem error: %v", err)
+		return
+	}
+	s.notify(message)
+	s.handleURC(message)
 }
 
-// SendAndWaitOK sends a message to the serial port and waits for a response
-func (s *SerialSubject) SendAndWaitOK(command string) error {
-	err := s.Send(command)
-	if err != nil {
-		return err
+// deliverUSSD hands a network reply to SendUSSD, replies nobody waits for
+// are dropped
+func (s *SerialSubject) deliverUSSD(status int, reply string) {
+	s.publish(USSDResponse{PortName: s.portName, Status: status, Text: reply})
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.ussd == nil {
+		logrus.LogrusLoggerWithContext(s.ctx).Infof("Unsolicited USSD: %s", reply)
+		return
 	}
-	s.mu.Lock()
-	s.channels["OK"] = make(chan string, 1)
-	s.mu.Unlock()
-
 	select {
-	case <-s.channels["OK"]:
-		delete(s.channels, "OK")
-		return nil
-	case <-time.After(1 * time.Second):
-		delete(s.channels, "OK")
-		return fmt.Errorf("timeout waiting for OK response")
+	case s.ussd <- reply:
+	default:
 	}
 }
 
+// Close closes the port, stops the read goroutine and fails every queued
+// or waiting command with ErrClosed
+func (s *SerialSubject) Close() error {
+	var errClose error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.concat.stop()
+		s.events.close()
+		s.lines.close()
+		s.urcHandlers.close()
+		s.connMu.Lock()
+		port := s.port
+		done := s.readerDone
+		traceFile := s.traceFile
+		s.traceFile = nil
+		s.connMu.Unlock()
+		errClose = port.Close()
+		if traceFile != nil {
+			defer traceFile.Close()
+		}
+		if done != nil {
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				logrus.LogrusLoggerWithContext(s.ctx).Warn("Reader did not stop after closing the port")
+			}
+		}
+	})
+	return errClose
+}
+
+// SendAndWaitOK sends a command and waits for its final result code
+func (s *SerialSubject) SendAndWaitOK(command string) error {
+	return s.SendAndWaitOKContext(s.baseContext(), command)
+}
+
+// SendAndWaitOKContext is SendAndWaitOK aborting when ctx is done
+func (s *SerialSubject) SendAndWaitOKContext(ctx context.Context, command string) error {
+	_, err := s.ExecContext(ctx, Command{Line: command})
+	return err
+}
+
+// SendAndGetData sends a command and returns the first response line
+// starting with key
 func (s *SerialSubject) SendAndGetData(key string, command string, timeout time.Duration) (string, error) {
-	err := s.Send(command)
+	return s.SendAndGetDataContext(s.baseContext(), key, command, timeout)
+}
+
+// SendAndGetDataContext is SendAndGetData aborting when ctx is done
+func (s *SerialSubject) SendAndGetDataContext(ctx context.Context, key string, command string, timeout time.Duration) (string, error) {
+	response, err := s.ExecContext(ctx, Command{Line: command, Prefix: key, Timeout: timeout})
 	if err != nil {
 		return "", err
 	}
-	s.mu.Lock()
-	s.channels[key] = make(chan string, 1)
-	s.mu.Unlock()
-
-	select {
-	case response := <-s.channels[key]:
-		return response, nil
-	case <-time.After(timeout):
-		return "", fmt.Errorf("timeout waiting for DATA response")
+	data := response.First()
+	if data == "" {
+		return "", fmt.Errorf("no %s data in response to %s", key, command)
 	}
+	return data, nil
 }
 
-// Send sends a message to the serial port
+// Send writes a command to the port without waiting for a response. Prefer
+// Exec, raw writes bypass the command queue.
 func (s *SerialSubject) Send(command string) error {
+	select {
+	case <-s.closed:
+		return ErrClosed
+	default:
+	}
+	s.connMu.Lock()
+	port := s.port
+	s.connMu.Unlock()
 	logrus.LogrusLoggerWithContext(s.ctx).Warnf("Sending: %s", command)
-	_, errWrite := s.port.Write([]byte(fmt.Sprintf("%s\r\n", command)))
+	s.lastSent.Store(command)
+	_, errWrite := port.Write([]byte(fmt.Sprintf("%s\r\n", command)))
 	if errWrite != nil {
 		return errWrite
 	}
 	return nil
 }
 
+// SendUSSD starts a USSD session and waits for the network reply
 func (s *SerialSubject) SendUSSD(ussd string) (string, error) {
-	err := s.Send(fmt.Sprintf("AT+CUSD=1,\"%s\",15", ussd))
-	if err != nil {
-		return "", err
-	}
+	return s.SendUSSDContext(s.baseContext(), ussd)
+}
+
+// SendUSSDContext is SendUSSD aborting when ctx is done, the USSD session is
+// cancelled on the modem in that case
+func (s *SerialSubject) SendUSSDContext(ctx context.Context, ussd string) (string, error) {
+	s.ussdMu.Lock()
+	defer s.ussdMu.Unlock()
+	reply := make(chan string, 1)
 	s.mu.Lock()
-	s.channels["USSD"] = make(chan string, 1)
+	s.ussd = reply
 	s.mu.Unlock()
-	time.Sleep(1 * time.Second)
+	defer func() {
+		s.mu.Lock()
+		s.ussd = nil
+		s.mu.Unlock()
+	}()
 
+	if err := s.SendAndWaitOKContext(ctx, fmt.Sprintf("AT+CUSD=1,\"%s\",15", ussd)); err != nil {
+		return "", err
+	}
+
+	timer := time.NewTimer(60 * time.Second)
+	defer timer.Stop()
 	select {
-	case response := <-s.channels["USSD"]:
+	case <-s.Lost():
+		return "", ErrDisconnected
+	case response := <-reply:
 		return response, nil
-	case <-time.After(60 * time.Second):
+	case <-ctx.Done():
+		go func() {
+			_ = s.SendAndWaitOK("AT+CUSD=2")
+		}()
+		return "", ctx.Err()
+	case <-s.closed:
+		return "", ErrClosed
+	case <-timer.C:
 		return "", fmt.Errorf("timeout waiting for USSD response")
 	}
 }
 
-func (s *SerialSubject) getWaitKeys() []string {
-	keys := make([]string, 0)
-	s.mu.Lock()
-	for k := range s.channels {
-		if k == "OK" {
-			continue
-		}
-		keys = append(keys, k)
-	}
-	s.mu.Unlock()
-	return keys
+// isEcho reports whether line is the echo of the last command sent
+func (s *SerialSubject) isEcho(line string) bool {
+	sent, _ := s.lastSent.Load().(string)
+	return sent != "" && strings.TrimSpace(line) == sent
 }
@@ -0,0 +1,1591 @@
+package gsm_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go-gsm/pkg/gsm"
+	"go-gsm/pkg/gsm/sim"
+	"go-gsm/pkg/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logrus.InitLogrusLogger()
+	os.Exit(m.Run())
+}
+
+func newSubject(t *testing.T) (*gsm.SerialSubject, *sim.Modem) {
+	t.Helper()
+	ctx := context.Background()
+	modem := sim.New()
+	subject := gsm.NewSerial(&ctx, modem.Transport(), filepath.Join(t.TempDir(), "sim"))
+	t.Cleanup(func() {
+		_ = subject.Close()
+		_ = modem.Close()
+	})
+	return subject, modem
+}
+
+func TestOpen(t *testing.T) {
+	subject, modem := newSubject(t)
+	modem.Operator = "VINAPHONE"
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range []string{"AT+CMEE=2", "AT+CMGF=0", "AT+CNMI=2,2,0,0,0", "AT+CLIP=1", "AT+CCID", "AT+COPS?", "AT+CUSD=1,\"*111#\",15"} {
+		if !modem.WaitCommand(command, time.Second) {
+			t.Errorf("modem did not receive %s", command)
+		}
+	}
+}
+
+func TestInitProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profile.yaml")
+	profile := `
+name: no-ussd
+steps:
+  - command: AT+CMEE=2
+  - command: AT+QCFG="nwscanmode",3
+    retries: 2
+    retry_delay: 10ms
+  - command: AT+CPIN?
+    expect: "+CPIN"
+    fatal: true
+`
+	if err := os.WriteFile(path, []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := gsm.LoadProfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, modem := newSubject(t)
+	subject.SetInitProfile(loaded)
+	modem.Respond("AT+CPIN?", "+CPIN: READY", "OK")
+	modem.Respond(`AT+QCFG="nwscanmode",3`, "ERROR")
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	attempts := 0
+	for _, command := range modem.Commands() {
+		if strings.HasPrefix(command, "AT+QCFG") {
+			attempts++
+		}
+		if strings.HasPrefix(command, "AT+CUSD") || command == "AT+CNMI=2,2,0,0,0" {
+			t.Errorf("unexpected command %s", command)
+		}
+	}
+	if attempts != 3 {
+		t.Errorf("QCFG was sent %d times", attempts)
+	}
+
+	failing, modem := newSubject(t)
+	failing.SetInitProfile(loaded)
+	modem.Respond("AT+CPIN?", "+CME ERROR: 10")
+	err = failing.Open()
+	if !errors.Is(err, gsm.ErrSIMNotInserted) {
+		t.Errorf("expected fatal SIM error, got %v", err)
+	}
+}
+
+func TestRefreshInfo(t *testing.T) {
+	subject, modem := newSubject(t)
+	modem.Operator = "VINAPHONE"
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if info := subject.Info(); info.ICCID != modem.ICCID || info.Network != "Vinaphone" {
+		t.Errorf("init did not fill the snapshot: %+v", info)
+	}
+	info, err := subject.RefreshInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := gsm.ModemInfo{
+		PortName:     info.PortName,
+		IMEI:         modem.IMEI,
+		IMSI:         modem.IMSI,
+		ICCID:        modem.ICCID,
+		Manufacturer: "Quectel",
+		Model:        "EC25",
+		Firmware:     modem.Revision,
+		Operator:     "VINAPHONE",
+		Network:      "Vinaphone",
+		MSISDN:       modem.MSISDN,
+		RSSI:         modem.Signal,
+		Signal:       3,
+		Registration: gsm.RegisteredHome,
+		UpdatedAt:    info.UpdatedAt,
+	}
+	if info != want || info.UpdatedAt.IsZero() {
+		t.Errorf("got %+v\nwant %+v", info, want)
+	}
+}
+
+func TestRefreshInfoReadsPrefixedIdentity(t *testing.T) {
+	subject, modem := newSubject(t)
+	modem.PrefixedIdentity = true
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := subject.RefreshInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.IMEI != modem.IMEI || info.Firmware != modem.Revision {
+		t.Errorf("got IMEI %q firmware %q", info.IMEI, info.Firmware)
+	}
+}
+
+func TestHealthMonitor(t *testing.T) {
+	subject, modem := newSubject(t)
+	subject.SetInitProfile(gsm.InitProfile{})
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	changes := make(chan gsm.HealthChanged, 8)
+	gsm.On(subject, func(e gsm.HealthChanged) { changes <- e })
+	expect := func(status gsm.HealthStatus) {
+		t.Helper()
+		for {
+			select {
+			case change := <-changes:
+				if change.Status == status {
+					return
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("health did not become %s, is %s", status, subject.Health())
+			}
+		}
+	}
+	monitor := subject.StartMonitor(context.Background(), gsm.MonitorOptions{
+		Interval:  20 * time.Millisecond,
+		Timeout:   50 * time.Millisecond,
+		DeadAfter: 2,
+	})
+	defer monitor.Stop()
+	expect(gsm.HealthOK)
+	modem.Respond("AT+CREG?", "+CREG: 2,2", "OK")
+	expect(gsm.HealthDegraded)
+	modem.Handle("AT", func(*sim.Modem, string) []string { return nil })
+	expect(gsm.HealthDead)
+	if history := monitor.History(); len(history) < 3 || history[0].Signal != 3 || history[len(history)-1].Alive {
+		t.Errorf("unexpected history %+v", history)
+	}
+}
+
+func TestWatchdogEscalatesUntilModemAnswers(t *testing.T) {
+	subject, modem := newSubject(t)
+	subject.SetInitProfile(gsm.InitProfile{})
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	hung := true
+	// Only toggling the radio brings this modem back
+	modem.Handle("AT", func(_ *sim.Modem, command string) []string {
+		mu.Lock()
+		defer mu.Unlock()
+		if command == "AT+CFUN=1" {
+			hung = false
+		}
+		if hung {
+			return nil
+		}
+		return []string{"OK"}
+	})
+	recoveries := make(chan gsm.ModemRecovery, 8)
+	gsm.On(subject, func(e gsm.ModemRecovery) { recoveries <- e })
+	watchdog := subject.StartWatchdog(context.Background(), gsm.WatchdogOptions{
+		MaxTimeouts:  2,
+		Interval:     20 * time.Millisecond,
+		ProbeTimeout: 50 * time.Millisecond,
+		Settle:       10 * time.Millisecond,
+	})
+	defer watchdog.Stop()
+
+	var steps []gsm.RecoveryStep
+	for len(steps) == 0 || steps[len(steps)-1] != gsm.RecoveryRadio {
+		select {
+		case recovery := <-recoveries:
+			steps = append(steps, recovery.Step)
+			if recovery.Step == gsm.RecoveryRadio && !recovery.Recovered {
+				t.Fatalf("radio step failed: %v", recovery.Err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("no recovery, steps so far %v", steps)
+		}
+	}
+	if len(steps) != 2 || steps[0] != gsm.RecoveryReset {
+		t.Errorf("unexpected escalation %v", steps)
+	}
+	if !modem.WaitCommand("AT+CFUN=0", time.Second) {
+		t.Error("radio was not turned off")
+	}
+}
+
+func TestSendUSSD(t *testing.T) {
+	subject, modem := newSubject(t)
+	modem.USSD["*101#"] = "TKC: 25000d"
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := subject.SendUSSD("*101#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "TKC: 25000d" {
+		t.Errorf("unexpected USSD reply %q", reply)
+	}
+}
+
+func TestSMSObserverReadsNotifiedMessage(t *testing.T) {
+	subject, modem := newSubject(t)
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	index := modem.DeliverSMS("+84900000000", "hello")
+	if !modem.WaitCommand("AT+CMGR=1", time.Second) || index != 1 {
+		t.Fatal("SMS observer did not read the notified message")
+	}
+}
+
+func TestSMSObserverReadsPDUMode(t *testing.T) {
+	subject, modem := newSubject(t)
+	received := make(chan gsm.SMSReceived, 1)
+	gsm.On(subject, func(e gsm.SMSReceived) { received <- e })
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := subject.Exec(gsm.Command{Line: "AT+CMGF=0"}); err != nil {
+		t.Fatal(err)
+	}
+	modem.DeliverSMS("+84900000000", "Xin chào €")
+	select {
+	case got := <-received:
+		if got.Sender != "+84900000000" || got.Text != "Xin chào €" || got.Index != 1 {
+			t.Errorf("got %+v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+}
+
+func TestEventSubscription(t *testing.T) {
+	subject, modem := newSubject(t)
+	subject.SetAutoAnswer(false)
+	events, sub := subject.SubscribeChan(16)
+	defer sub.Unsubscribe()
+	calls := make(chan gsm.IncomingCall, 1)
+	gsm.On(subject, func(e gsm.IncomingCall) { calls <- e })
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	modem.DeliverSMS("+84900000000", "hello")
+	modem.Ring("0912345678")
+	modem.URC("+CREG: 5,\"1A2B\",\"01C3D4E5\"")
+
+	var sms *gsm.SMSReceived
+	var registration *gsm.RegistrationChanged
+	timeout := time.After(2 * time.Second)
+	for sms == nil || registration == nil {
+		select {
+		case event := <-events:
+			switch e := event.(type) {
+			case gsm.SMSReceived:
+				sms = &e
+			case gsm.RegistrationChanged:
+				registration = &e
+			}
+		case <-timeout:
+			t.Fatal("events were not published")
+		}
+	}
+	if sms.Sender != "+84900000000" || sms.Text != "hello" || sms.Index != 1 {
+		t.Errorf("unexpected SMS event %+v", sms)
+	}
+	if registration.Status != gsm.RegisteredRoaming || registration.LAC != "1A2B" || registration.CellID != "01C3D4E5" {
+		t.Errorf("unexpected registration event %+v", registration)
+	}
+	select {
+	case call := <-calls:
+		if call.Number != "0912345678" {
+			t.Errorf("unexpected caller %q", call.Number)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("incoming call was not published")
+	}
+	if modem.WaitCommand("ATA", 200*time.Millisecond) {
+		t.Error("call was answered with auto answer disabled")
+	}
+}
+
+func TestURCRouting(t *testing.T) {
+	subject, modem := newSubject(t)
+	subject.SetInitProfile(gsm.InitProfile{})
+	custom := make(chan []string, 1)
+	subject.RegisterURC(gsm.URCRoute{
+		Prefix:  "+QIND:",
+		Lines:   2,
+		Handler: func(lines []string) { custom <- lines },
+	})
+	events, sub := subject.SubscribeChan(16)
+	defer sub.Unsubscribe()
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	modem.URC("+QIND: \"csq\"", "15,99")
+	modem.URC("+FOO: 1")
+	modem.URC("+CUSD: 0,\"Balance:", "25000d\",15")
+	modem.URC("+CMT: \"+84900000000\",\"\",\"24/10/17,10:00:00+28\"", "ATTENTION please")
+
+	select {
+	case lines := <-custom:
+		if len(lines) != 2 || lines[1] != "15,99" {
+			t.Errorf("unexpected custom URC %q", lines)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("custom route was not called")
+	}
+	var unknown, ussd, sms bool
+	timeout := time.After(2 * time.Second)
+	for !unknown || !ussd || !sms {
+		select {
+		case event := <-events:
+			switch e := event.(type) {
+			case gsm.UnknownURC:
+				unknown = e.Line == "+FOO: 1"
+			case gsm.USSDResponse:
+				ussd = e.Text == "Balance:\n25000d"
+			case gsm.SMSReceived:
+				sms = e.Text == "ATTENTION please" && e.Index == -1
+			}
+		case <-timeout:
+			t.Fatalf("missing events: unknown %v, ussd %v, sms %v", unknown, ussd, sms)
+		}
+	}
+}
+
+func TestURCBurstIsNotDropped(t *testing.T) {
+	subject, modem := newSubject(t)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var seen []string
+	subject.RegisterURC(gsm.URCRoute{Prefix: "+BURST:", Handler: func(lines []string) {
+		<-release
+		mu.Lock()
+		seen = append(seen, lines[0])
+		mu.Unlock()
+	}})
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	const burst = 1000
+	for i := 0; i < burst; i++ {
+		modem.URC(fmt.Sprintf("+BURST: %d", i))
+	}
+	// The reader keeps going while the handler is stuck
+	if _, err := subject.Exec(gsm.Command{Line: "AT"}); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(seen)
+		mu.Unlock()
+		if n == burst {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != burst {
+		t.Fatalf("%d of %d URCs handled", len(seen), burst)
+	}
+	for i, line := range seen {
+		if line != fmt.Sprintf("+BURST: %d", i) {
+			t.Fatalf("URC %d out of order: %s", i, line)
+		}
+	}
+}
+
+func TestSlowSubscribersDoNotStallReader(t *testing.T) {
+	subject, modem := newSubject(t)
+	release := make(chan struct{})
+	defer close(release)
+	entered := make(chan struct{})
+	var once sync.Once
+	received := make(chan gsm.RegistrationStatus, 8)
+	// Blocks on the first event, keeps only the newest of the rest
+	gsm.On(subject, func(e gsm.RegistrationChanged) {
+		once.Do(func() {
+			close(entered)
+			<-release
+		})
+		received <- e.Status
+	}, gsm.WithBuffer(1), gsm.WithOverflow(gsm.OverflowDropOldest))
+	subject.Subscribe(func(gsm.Event) { panic("broken subscriber") })
+	stuck := make(chan struct{})
+	subject.Subscribe(func(gsm.Event) { <-stuck }, gsm.WithBuffer(1))
+	defer close(stuck)
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	modem.URC("+CREG: 0")
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatal("subscriber did not receive the first event")
+	}
+	for _, stat := range []string{"2", "3", "5"} {
+		modem.URC("+CREG: " + stat)
+	}
+	if _, err := subject.Exec(gsm.Command{Line: "AT"}); err != nil {
+		t.Fatalf("reader stalled: %v", err)
+	}
+	// Let the info observer publish what the reader queued
+	time.Sleep(50 * time.Millisecond)
+	release <- struct{}{}
+	var got []gsm.RegistrationStatus
+	for len(got) < 2 {
+		select {
+		case status := <-received:
+			got = append(got, status)
+		case <-time.After(time.Second):
+			t.Fatalf("received %v", got)
+		}
+	}
+	if got[0] != gsm.NotRegistered || got[1] != gsm.RegisteredRoaming {
+		t.Errorf("expected the first and newest event, got %v", got)
+	}
+}
+
+func TestDirectSMSDelivery(t *testing.T) {
+	subject, modem := newSubject(t)
+	subject.SetInitProfile(gsm.InitProfile{SMSDelivery: gsm.SMSDirect, AckSMS: true})
+	received := make(chan gsm.SMSReceived, 2)
+	gsm.On(subject, func(e gsm.SMSReceived) { received <- e })
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if !modem.WaitCommand("AT+CSMS=1", time.Second) || !modem.WaitCommand("AT+CNMI=2,2,0,0,0", time.Second) {
+		t.Fatal("direct delivery was not configured")
+	}
+	modem.DeliverDirect("+84900000000", "xin chao")
+	// "How are you?" from +31641600986 at 02/08/26 19:37:41 +07:00
+	if err := modem.DeliverPDU("07911326040000F0040B911346610089F60000208062917314820CC8F71D14969741F977FD07"); err != nil {
+		t.Fatal(err)
+	}
+	// Malformed PDUs are refused instead of pushed to the subject
+	for _, pdu := range []string{"", "0", "07911326040000F0040B91", "zz"} {
+		if err := modem.DeliverPDU(pdu); !errors.Is(err, gsm.ErrPDU) {
+			t.Errorf("DeliverPDU(%q): %v", pdu, err)
+		}
+	}
+	want := []gsm.SMSReceived{
+		{Sender: "+84900000000", Text: "xin chao"},
+		{Sender: "+31641600986", Time: "02/08/26,19:37:41+28", Text: "How are you?"},
+	}
+	for _, w := range want {
+		select {
+		case got := <-received:
+			if got.Sender != w.Sender || got.Text != w.Text || got.Index != -1 || w.Time != "" && got.Time != w.Time {
+				t.Errorf("got %+v, want %+v", got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message was not received")
+		}
+	}
+	acks := 0
+	deadline := time.Now().Add(time.Second)
+	for acks < 2 && time.Now().Before(deadline) {
+		acks = 0
+		for _, command := range modem.Commands() {
+			if command == "AT+CNMA" {
+				acks++
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if acks != 2 {
+		t.Errorf("%d messages acknowledged", acks)
+	}
+}
+
+func TestTextModeSMSDecodesUCS2ByDCS(t *testing.T) {
+	subject, modem := newSubject(t)
+	subject.SetInitProfile(gsm.InitProfile{
+		Steps:       []gsm.InitStep{{Command: "AT+CMGF=1"}, {Command: "AT+CSDH=1"}},
+		SMSDelivery: gsm.SMSDirect,
+	})
+	received := make(chan gsm.SMSReceived, 4)
+	gsm.On(subject, func(e gsm.SMSReceived) { received <- e })
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	// OTPs read as hex, only the DCS says whether a body is UCS2
+	modem.DeliverDirect("+84900000000", "20241017")
+	modem.DeliverDirect("+84900000000", "Mã OTP của bạn")
+	modem.DeliverSMS("+84900000000", "1234")
+	modem.DeliverSMS("+84900000000", "Xin chào")
+	want := map[string]bool{"20241017": true, "Mã OTP của bạn": true, "1234": true, "Xin chào": true}
+	for i := 0; i < 4; i++ {
+		select {
+		case got := <-received:
+			if !want[got.Text] {
+				t.Errorf("unexpected text %q", got.Text)
+			}
+			delete(want, got.Text)
+		case <-time.After(time.Second):
+			t.Fatalf("messages not received: %v", want)
+		}
+	}
+}
+
+func TestDirectSMSReadingOKIsNotAResult(t *testing.T) {
+	subject, modem := newSubject(t)
+	subject.SetInitProfile(gsm.InitProfile{SMSDelivery: gsm.SMSDirect})
+	modem.Handle("AT+QSLOW", func(*sim.Modem, string) []string {
+		time.Sleep(200 * time.Millisecond)
+		return []string{"+QSLOW: 1", "OK"}
+	})
+	received := make(chan gsm.SMSReceived, 1)
+	gsm.On(subject, func(e gsm.SMSReceived) { received <- e })
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan *gsm.Response, 1)
+	go func() {
+		response, _ := subject.Exec(gsm.Command{Line: "AT+QSLOW", Prefix: "+QSLOW:"})
+		result <- response
+	}()
+	if !modem.WaitCommand("AT+QSLOW", time.Second) {
+		t.Fatal("command was not sent")
+	}
+	modem.DeliverDirect("+84900000000", "OK")
+	if response := <-result; response.First() != "+QSLOW: 1" {
+		t.Errorf("command completed by the SMS: %+v", response)
+	}
+	select {
+	case got := <-received:
+		if got.Text != "OK" {
+			t.Errorf("got %+v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+}
+
+// concatPart encodes part seq of a concatenated SMS-DELIVER
+func concatPart(t *testing.T, reference, total, seq int, text string) string {
+	t.Helper()
+	deliver := &gsm.Deliver{
+		Originator: gsm.ParseAddress("+84900000000"),
+		Timestamp:  time.Now(),
+		UDH:        gsm.ConcatHeader(reference, total, seq),
+		Text:       text,
+	}
+	pdu, _, err := deliver.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pdu
+}
+
+func TestConcatenatedSMS(t *testing.T) {
+	store := gsm.FileConcatStore{Path: filepath.Join(t.TempDir(), "parts.json")}
+	subject, modem := newSubject(t)
+	received := make(chan gsm.SMSReceived, 4)
+	gsm.On(subject, func(e gsm.SMSReceived) { received <- e })
+	if err := subject.SetConcat(gsm.ConcatOptions{Timeout: 200 * time.Millisecond, Store: store}); err != nil {
+		t.Fatal(err)
+	}
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	receive := func() gsm.SMSReceived {
+		t.Helper()
+		select {
+		case got := <-received:
+			return got
+		case <-time.After(time.Second):
+			t.Fatal("message was not received")
+		}
+		return gsm.SMSReceived{}
+	}
+
+	// Out of order with a 16-bit reference
+	if err := modem.DeliverPDU(concatPart(t, 0x1234, 3, 3, "ma OTP.")); err != nil {
+		t.Fatal(err)
+	}
+	if err := modem.DeliverPDU(concatPart(t, 0x1234, 3, 1, "Day la ")); err != nil {
+		t.Fatal(err)
+	}
+	if err := modem.DeliverPDU(concatPart(t, 0x1234, 3, 2, "tin nhan co ")); err != nil {
+		t.Fatal(err)
+	}
+	got := receive()
+	if got.Text != "Day la tin nhan co ma OTP." || got.Parts != 3 || got.Reference != 0x1234 || len(got.Missing) != 0 {
+		t.Errorf("got %+v", got)
+	}
+
+	// The second part never comes
+	if err := modem.DeliverPDU(concatPart(t, 7, 3, 1, "first ")); err != nil {
+		t.Fatal(err)
+	}
+	if err := modem.DeliverPDU(concatPart(t, 7, 3, 3, "third")); err != nil {
+		t.Fatal(err)
+	}
+	got = receive()
+	if got.Text != "first third" || !reflect.DeepEqual(got.Missing, []int{2}) {
+		t.Errorf("got %+v", got)
+	}
+
+	// A part waiting when the subject closes is restored by the next one
+	if err := modem.DeliverPDU(concatPart(t, 8, 2, 1, "before ")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for parts, _ := store.Load(); len(parts) == 0 && time.Now().Before(deadline); parts, _ = store.Load() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = subject.Close()
+	subject, modem = newSubject(t)
+	gsm.On(subject, func(e gsm.SMSReceived) { received <- e })
+	if err := subject.SetConcat(gsm.ConcatOptions{Store: store}); err != nil {
+		t.Fatal(err)
+	}
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := modem.DeliverPDU(concatPart(t, 8, 2, 2, "after")); err != nil {
+		t.Fatal(err)
+	}
+	if got = receive(); got.Text != "before after" || len(got.Missing) != 0 {
+		t.Errorf("got %+v", got)
+	}
+	if parts, err := store.Load(); err != nil || len(parts) != 0 {
+		t.Errorf("store kept %v, %v", parts, err)
+	}
+}
+
+// textMode switches an opened subject to text mode, the default profile
+// receives in PDU mode
+func textMode(t *testing.T, subject *gsm.SerialSubject) {
+	t.Helper()
+	if _, err := subject.Exec(gsm.Command{Line: "AT+CMGF=1"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendSMS(t *testing.T) {
+	subject, modem := newSubject(t)
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	textMode(t, subject)
+	ctx := context.Background()
+
+	// A short ASCII text goes out in text mode
+	references, err := subject.SendSMS(ctx, "+84900000000", "hello")
+	if err != nil || !reflect.DeepEqual(references, []int{1}) {
+		t.Fatalf("got %v, %v", references, err)
+	}
+	if !modem.WaitCommand(`AT+CMGS="+84900000000"`, time.Second) || modem.Submitted()[0] != "hello" {
+		t.Errorf("submitted %q", modem.Submitted())
+	}
+
+	// Characters GSM 03.38 places elsewhere than ASCII go out as a PDU
+	before := len(modem.Submitted())
+	if _, err := subject.SendSMS(ctx, "+84900000000", "Pay $5 to user_1@example"); err != nil {
+		t.Fatal(err)
+	}
+	pdu, err := gsm.DecodePDU(modem.Submitted()[before])
+	if err != nil {
+		t.Fatalf("submitted %q in text mode: %v", modem.Submitted()[before], err)
+	}
+	if submit := pdu.(*gsm.Submit); submit.Text != "Pay $5 to user_1@example" || submit.DCS.Alphabet() != gsm.AlphabetGSM7 {
+		t.Errorf("got %+v", submit)
+	}
+
+	// Long texts are split in PDU mode, UCS2 when GSM 7-bit can't hold them
+	vietnamese := strings.Repeat("Mã xác thực của bạn là 123456. ", 5)
+	gsm7 := strings.Repeat("{euro} €", 25)
+	tests := []struct {
+		text     string
+		alphabet gsm.Alphabet
+		parts    int
+	}{
+		{vietnamese, gsm.AlphabetUCS2, 3},
+		{gsm7, gsm.AlphabetGSM7, 2},
+	}
+	for _, test := range tests {
+		before = len(modem.Submitted())
+		references, err = subject.SendSMS(ctx, "+84900000000", test.text)
+		if err != nil || len(references) != test.parts {
+			t.Fatalf("got %v, %v", references, err)
+		}
+		var text strings.Builder
+		for i, pdu := range modem.Submitted()[before:] {
+			decoded, err := gsm.DecodePDU(pdu)
+			if err != nil {
+				t.Fatal(err)
+			}
+			submit := decoded.(*gsm.Submit)
+			_, total, seq, ok := submit.UDH.Concat()
+			if submit.Destination.String() != "+84900000000" || submit.DCS.Alphabet() != test.alphabet || !ok || total != test.parts || seq != i+1 {
+				t.Errorf("part %d: %+v", i+1, submit)
+			}
+			text.WriteString(submit.Text)
+		}
+		if text.String() != test.text {
+			t.Errorf("sent %q, want %q", text.String(), test.text)
+		}
+	}
+	commands := modem.Commands()
+	if commands[len(commands)-1] != "AT+CMGF=1" {
+		t.Errorf("text mode not restored, last command %s", commands[len(commands)-1])
+	}
+
+	modem.Respond("AT+CMGS", "+CMS ERROR: 330")
+	var cmsErr *gsm.CMSError
+	if _, err := subject.SendSMS(ctx, "+84900000000", "hello"); !errors.As(err, &cmsErr) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestSendSMSAsksFormatAfterReset(t *testing.T) {
+	subject, modem := newSubject(t)
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	// Back to the stored text mode behind the subject's back
+	if _, err := subject.Exec(gsm.Command{Line: "ATZ"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := subject.SendSMS(context.Background(), "+84900000000", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if !modem.WaitCommand("AT+CMGF?", time.Second) || modem.Submitted()[0] != "hello" {
+		t.Errorf("submitted %q", modem.Submitted())
+	}
+}
+
+func TestConcurrentSendSMSKeepsMessageFormat(t *testing.T) {
+	subject, modem := newSubject(t)
+	received := make(chan gsm.SMSReceived, 8)
+	gsm.On(subject, func(e gsm.SMSReceived) { received <- e })
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	textMode(t, subject)
+	long := strings.Repeat("Tin nhắn dài ", 8)
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 3; j++ {
+				text := "hello"
+				if (i+j)%2 == 0 {
+					text = long
+				}
+				if _, err := subject.SendSMS(context.Background(), "+84900000000", text); err != nil {
+					errs <- err
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 3; i++ {
+		modem.DeliverSMS("+84911111111", "incoming")
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	for _, body := range modem.Submitted() {
+		if body == "hello" {
+			continue
+		}
+		pdu, err := gsm.DecodePDU(body)
+		if err != nil {
+			t.Fatalf("submitted %q in the wrong format: %v", body, err)
+		}
+		if submit := pdu.(*gsm.Submit); submit.DCS.Alphabet() != gsm.AlphabetUCS2 {
+			t.Errorf("got %+v", submit)
+		}
+	}
+	if got := len(modem.Submitted()); got != 6+6*2 {
+		t.Errorf("%d parts submitted", got)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case got := <-received:
+			if got.Text != "incoming" {
+				t.Errorf("got %+v", got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("message was not received")
+		}
+	}
+}
+
+func TestDeliveryReports(t *testing.T) {
+	subject, modem := newSubject(t)
+	changes := make(chan gsm.SMSStatusChanged, 4)
+	gsm.On(subject, func(e gsm.SMSStatusChanged) { changes <- e })
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	textMode(t, subject)
+	ctx := context.Background()
+	if err := subject.SetStatusReports(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if !modem.WaitCommand("AT+CSMP=49,167,0,0", time.Second) || !modem.WaitCommand("AT+CNMI=2,2,0,1,0", time.Second) {
+		t.Fatal("status reports were not enabled")
+	}
+	expect := func(reference int, state gsm.SMSState) {
+		t.Helper()
+		select {
+		case got := <-changes:
+			if got.Message.Reference != reference || got.Message.State != state || got.Previous != gsm.SMSSubmitted {
+				t.Errorf("got %+v, want %d %s", got, reference, state)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no state change for %d", reference)
+		}
+		if status, ok := subject.SMSStatus(reference); !ok || status.State != state || status.Updated.Before(status.Submitted) {
+			t.Errorf("status of %d: %+v", reference, status)
+		}
+	}
+
+	// Text mode submit and +CDS
+	references, err := subject.SendSMS(ctx, "+84900000000", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, ok := subject.SMSStatus(references[0]); !ok || status.State != gsm.SMSSubmitted || status.Number != "+84900000000" {
+		t.Errorf("got %+v", status)
+	}
+	modem.DeliveryReport(references[0], "+84900000000", 0x00)
+	expect(references[0], gsm.SMSDelivered)
+
+	// PDU mode submits request a report, +CDS then carries a PDU
+	references, err = subject.SendSMS(ctx, "+84900000000", "Xin chào, tin nhắn này cần báo cáo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdu, _ := gsm.DecodePDU(modem.Submitted()[1])
+	if !pdu.(*gsm.Submit).StatusReportRequest {
+		t.Error("status report not requested")
+	}
+	if _, err := subject.Exec(gsm.Command{Line: "AT+CMGF=0"}); err != nil {
+		t.Fatal(err)
+	}
+	modem.DeliveryReport(references[0], "+84900000000", 0x41)
+	expect(references[0], gsm.SMSFailed)
+
+	// Stored report announced with +CDSI
+	references, err = subject.SendSMS(ctx, "+84900000000", "ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := &gsm.StatusReport{Reference: byte(references[0]), Recipient: gsm.ParseAddress("+84900000000"), Status: 0x46}
+	stored, length, _ := report.Encode()
+	modem.Respond("AT+CMGR=5", fmt.Sprintf("+CMGR: 0,,%d", length), stored, "OK")
+	modem.URC(`+CDSI: "SR",5`)
+	expect(references[0], gsm.SMSExpired)
+	if !modem.WaitCommand("AT+CMGD=5", time.Second) {
+		t.Error("stored report was not deleted")
+	}
+}
+
+func TestCallObserverRecordsCall(t *testing.T) {
+	subject, modem := newSubject(t)
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	modem.Ring("")
+	if !modem.WaitCommand("ATA", time.Second) {
+		t.Fatal("call was not answered")
+	}
+	if !modem.WaitCommand("AT+QAUDRD=1", 3*time.Second) {
+		t.Fatal("recording was not started")
+	}
+}
+
+func TestExecReturnsCommandError(t *testing.T) {
+	subject, modem := newSubject(t)
+	modem.Respond("AT+QFOO", "ERROR")
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := subject.Exec(gsm.Command{Line: "AT+QFOO"})
+	var commandErr *gsm.CommandError
+	if !errors.As(err, &commandErr) || commandErr.Result != "ERROR" {
+		t.Fatalf("expected CommandError, got %v", err)
+	}
+}
+
+func TestConcurrentCommandsKeepTheirResponses(t *testing.T) {
+	subject, modem := newSubject(t)
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			csq, err := subject.SendAndGetData("+CSQ", "AT+CSQ", time.Second)
+			if err != nil || csq != "+CSQ: 20,99" {
+				t.Errorf("CSQ: %q %v", csq, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			ccid, err := subject.SendAndGetData("+CCID", "AT+CCID", time.Second)
+			if err != nil || ccid != "+CCID: "+modem.ICCID {
+				t.Errorf("CCID: %q %v", ccid, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestExecDecodesModemErrors(t *testing.T) {
+	subject, modem := newSubject(t)
+	modem.Respond("AT+CPIN?", "+CME ERROR: SIM not inserted")
+	modem.Respond("AT+CMGS", "+CMS ERROR: 304")
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := subject.Exec(gsm.Command{Line: "AT+CPIN?"})
+	if !errors.Is(err, gsm.ErrSIMNotInserted) {
+		t.Errorf("expected SIM not inserted, got %v", err)
+	}
+	_, err = subject.Exec(gsm.Command{Line: "AT+CMGS=\"123\""})
+	var cms *gsm.CMSError
+	if !errors.As(err, &cms) || cms.Code != 304 || !errors.Is(err, gsm.ErrInvalidPDU) {
+		t.Errorf("expected invalid PDU, got %v", err)
+	}
+}
+
+func TestResponsesAreCorrelatedByEcho(t *testing.T) {
+	subject, modem := newSubject(t)
+	subject.SetInitProfile(gsm.InitProfile{Steps: []gsm.InitStep{{Command: "ATE1"}}})
+	modem.EchoDelay = 50 * time.Millisecond
+	modem.Respond("AT+CSQ", "+CSQ: 20,99", "OK")
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if subject.Echo() != gsm.EchoOn {
+		t.Fatalf("echo is %s after ATE1", subject.Echo())
+	}
+	result := make(chan string, 1)
+	go func() {
+		csq, _ := subject.SendAndGetData("+CSQ", "AT+CSQ", time.Second)
+		result <- csq
+	}()
+	if !modem.WaitCommand("AT+CSQ", time.Second) {
+		t.Fatal("command was not sent")
+	}
+	// Arrives before the echo, it can't be the answer
+	modem.URC("+CSQ: 5,99")
+	if csq := <-result; csq != "+CSQ: 20,99" {
+		t.Errorf("got %q", csq)
+	}
+
+	// Echo turned off behind the subject's back costs one command
+	if err := subject.Send("ATE0"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := subject.Exec(gsm.Command{Line: "AT", Timeout: 200 * time.Millisecond}); !errors.Is(err, gsm.ErrCommandTimeout) {
+		t.Fatalf("expected a timeout waiting for the echo, got %v", err)
+	}
+	if _, err := subject.Exec(gsm.Command{Line: "AT"}); err != nil || subject.Echo() != gsm.EchoUnknown {
+		t.Errorf("echo is %s after recovering: %v", subject.Echo(), err)
+	}
+	if err := subject.SetEcho(context.Background(), false); err != nil || subject.Echo() != gsm.EchoOff {
+		t.Errorf("echo is %s after ATE0: %v", subject.Echo(), err)
+	}
+}
+
+func TestLateResultAfterTimeoutIsNotTakenByNextCommand(t *testing.T) {
+	subject, modem := newSubject(t)
+	modem.Handle("AT+QSLOW", func(*sim.Modem, string) []string {
+		time.Sleep(300 * time.Millisecond)
+		return []string{"OK"}
+	})
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := subject.SetEcho(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := subject.Exec(gsm.Command{Line: "AT+QSLOW", Timeout: 100 * time.Millisecond}); !errors.Is(err, gsm.ErrCommandTimeout) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		csq, err := subject.SendAndGetData("+CSQ", "AT+CSQ", time.Second)
+		if err != nil || csq != "+CSQ: 20,99" {
+			t.Fatalf("command %d after the timeout got %q: %v", i, csq, err)
+		}
+	}
+}
+
+func TestLateResultAfterCancelIsNotTakenByNextCommand(t *testing.T) {
+	subject, modem := newSubject(t)
+	modem.Handle("AT+QSLOW", func(*sim.Modem, string) []string {
+		time.Sleep(300 * time.Millisecond)
+		return []string{"OK"}
+	})
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := subject.SetEcho(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := subject.ExecContext(ctx, gsm.Command{Line: "AT+QSLOW"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	csq, err := subject.SendAndGetData("+CSQ", "AT+CSQ", time.Second)
+	if err != nil || csq != "+CSQ: 20,99" {
+		t.Fatalf("command after the cancel got %q: %v", csq, err)
+	}
+}
+
+func TestResyncIsBoundByContext(t *testing.T) {
+	subject, modem := newSubject(t)
+	modem.Respond("AT+QSILENT")
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := subject.SetEcho(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	modem.Respond("AT+CMEE?")
+	start := time.Now()
+	if _, err := subject.Exec(gsm.Command{Line: "AT+QSILENT", Timeout: 100 * time.Millisecond}); !errors.Is(err, gsm.ErrCommandTimeout) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timeout returned after %s", elapsed)
+	}
+	// The modem never answers the resync, the caller's deadline still holds
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := subject.ExecContext(ctx, gsm.Command{Line: "AT"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("resync held the caller for %s", elapsed)
+	}
+}
+
+func TestCallCommandsEndOnCallResults(t *testing.T) {
+	subject, modem := newSubject(t)
+	subject.SetAutoAnswer(false)
+	modem.Respond("ATA", "NO CARRIER")
+	modem.Respond("ATD0900000000;", "BUSY")
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ command, result string }{
+		{"ATA", "NO CARRIER"},
+		{"ATD0900000000;", "BUSY"},
+	} {
+		_, err := subject.Exec(gsm.Command{Line: test.command, Timeout: time.Second})
+		var commandErr *gsm.CommandError
+		if !errors.As(err, &commandErr) || commandErr.Result != test.result {
+			t.Errorf("%s: expected %s, got %v", test.command, test.result, err)
+		}
+	}
+	if _, err := subject.Exec(gsm.Command{Line: "AT"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExecContextCancel(t *testing.T) {
+	subject, modem := newSubject(t)
+	modem.Respond("AT+QSILENT")
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := subject.ExecContext(ctx, gsm.Command{Line: "AT+QSILENT"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestCloseDrainsWaiters(t *testing.T) {
+	subject, modem := newSubject(t)
+	modem.Respond("AT+QSILENT")
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := subject.Exec(gsm.Command{Line: "AT+QSILENT", Timeout: time.Minute})
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := subject.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, gsm.ErrClosed) {
+				t.Errorf("expected ErrClosed, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("waiter was not released by Close")
+		}
+	}
+}
+
+func TestSupervisorReconnects(t *testing.T) {
+	subject, modem := newSubject(t)
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	replacements := make(chan *sim.Modem, 2)
+	stranger := sim.New()
+	stranger.IMEI = "860000000000999"
+	replacements <- stranger
+	replacements <- sim.New()
+	events := make(chan gsm.ConnectionEvent, 4)
+	supervisor := gsm.NewSupervisor(subject, gsm.SupervisorOptions{
+		Dial: func(ctx context.Context) (gsm.Transport, error) {
+			return (<-replacements).Transport(), nil
+		},
+		IMEI:       modem.IMEI,
+		MinBackoff: 10 * time.Millisecond,
+		OnEvent:    func(e gsm.ConnectionEvent) { events <- e },
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = supervisor.Run(ctx) }()
+
+	_ = modem.Close()
+	for _, want := range []gsm.ConnectionState{gsm.Disconnected, gsm.Connected} {
+		select {
+		case e := <-events:
+			if e.State != want {
+				t.Fatalf("expected %s, got %s", want, e.State)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("no %s event", want)
+		}
+	}
+	if _, err := subject.SendAndGetData("+CSQ", "AT+CSQ", time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSupervisorMatchesPrefixedIMEI(t *testing.T) {
+	subject, modem := newSubject(t)
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	replacement := sim.New()
+	defer replacement.Close()
+	replacement.PrefixedIdentity = true
+	events := make(chan gsm.ConnectionEvent, 4)
+	supervisor := gsm.NewSupervisor(subject, gsm.SupervisorOptions{
+		Dial: func(ctx context.Context) (gsm.Transport, error) {
+			return replacement.Transport(), nil
+		},
+		IMEI:       modem.IMEI,
+		MinBackoff: 10 * time.Millisecond,
+		OnEvent:    func(e gsm.ConnectionEvent) { events <- e },
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = supervisor.Run(ctx) }()
+
+	_ = modem.Close()
+	for _, want := range []gsm.ConnectionState{gsm.Disconnected, gsm.Connected} {
+		select {
+		case e := <-events:
+			if e.State != want {
+				t.Fatalf("expected %s, got %s: %v", want, e.State, e.Err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("no %s event", want)
+		}
+	}
+}
+
+func TestSupervisorClosesTransportWhenInitFails(t *testing.T) {
+	subject, modem := newSubject(t)
+	subject.SetInitProfile(gsm.InitProfile{Steps: []gsm.InitStep{{Command: "AT+CMEE=2", Fatal: true}}})
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	broken := sim.New()
+	broken.Respond("AT+CMEE", "ERROR")
+	replacements := make(chan *sim.Modem, 2)
+	replacements <- broken
+	replacements <- sim.New()
+	events := make(chan gsm.ConnectionEvent, 4)
+	supervisor := gsm.NewSupervisor(subject, gsm.SupervisorOptions{
+		Dial: func(ctx context.Context) (gsm.Transport, error) {
+			return (<-replacements).Transport(), nil
+		},
+		MinBackoff: 10 * time.Millisecond,
+		OnEvent:    func(e gsm.ConnectionEvent) { events <- e },
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = supervisor.Run(ctx) }()
+
+	_ = modem.Close()
+	select {
+	case <-broken.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("transport of the failed attempt was left open")
+	}
+	for _, want := range []gsm.ConnectionState{gsm.Disconnected, gsm.Connected} {
+		select {
+		case e := <-events:
+			if e.State != want {
+				t.Fatalf("expected %s, got %s", want, e.State)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("no %s event", want)
+		}
+	}
+}
+
+func TestModemPoolDiscover(t *testing.T) {
+	first, second := sim.New(), sim.New()
+	second.ICCID, second.IMEI, second.MSISDN = "8984048000000000002", "860000000000002", "+84960000002"
+	// The modem port of the first modem answers AT as well
+	firstModemPort := sim.New()
+	firstModemPort.IMEI = first.IMEI
+	silent, _ := gsm.NewPipe()
+	transports := map[string]gsm.Transport{
+		"ttyUSB2": first.Transport(),
+		"ttyUSB3": firstModemPort.Transport(),
+		"ttyUSB6": second.Transport(),
+		"ttyUSB0": silent,
+	}
+	ctx := context.Background()
+	pool := gsm.NewModemPool(&ctx, gsm.PoolOptions{
+		ProbeTimeout: 100 * time.Millisecond,
+		Ports: func() ([]string, error) {
+			return []string{"ttyUSB0", "ttyUSB2", "ttyUSB3", "ttyUSB6"}, nil
+		},
+		Open: func(name string) (gsm.Transport, error) {
+			return transports[name], nil
+		},
+	})
+	defer pool.Close()
+	added, err := pool.Discover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 2 {
+		t.Fatalf("expected 2 modems, got %d", len(added))
+	}
+	if modem, ok := pool.ByICCID("8984048000000000002"); !ok || modem.PortName != "ttyUSB6" {
+		t.Error("modem not found by ICCID")
+	}
+	if modem, ok := pool.ByIMEI(first.IMEI); !ok || modem.PortName != "ttyUSB2" {
+		t.Error("modem not found by IMEI")
+	}
+	if modem, ok := pool.ByPhone("+84960000002"); !ok || modem.IMEI != second.IMEI {
+		t.Error("modem not found by phone")
+	}
+	select {
+	case <-firstModemPort.Done():
+	case <-time.After(time.Second):
+		t.Error("second port of the same modem was left open")
+	}
+	// Identified before any init, the extra port never saw the profile
+	if commands := firstModemPort.Commands(); !reflect.DeepEqual(commands, []string{"AT", "AT+CGSN"}) {
+		t.Errorf("second port of the same modem received %q", commands)
+	}
+	if added, _ := pool.Discover(ctx); len(added) != 0 {
+		t.Errorf("rediscovered %d modems", len(added))
+	}
+}
+
+func TestModemPoolSupervisesOnlyIdentifiedModems(t *testing.T) {
+	anonymous := sim.New()
+	anonymous.Respond("AT+CGSN", "ERROR")
+	ctx := context.Background()
+	pool := gsm.NewModemPool(&ctx, gsm.PoolOptions{
+		ProbeTimeout: 100 * time.Millisecond,
+		Supervise:    true,
+		Ports: func() ([]string, error) {
+			return []string{"ttyUSB2"}, nil
+		},
+		Open: func(name string) (gsm.Transport, error) {
+			return anonymous.Transport(), nil
+		},
+	})
+	defer pool.Close()
+	added, err := pool.Discover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 0 || len(pool.Modems()) != 0 {
+		t.Errorf("supervised a modem without IMEI: %v", added)
+	}
+	select {
+	case <-anonymous.Done():
+	case <-time.After(time.Second):
+		t.Error("port of the unidentified modem was left open")
+	}
+}
+
+func TestTraceReplay(t *testing.T) {
+	subject, modem := newSubject(t)
+	modem.Signal = 17
+	var trace bytes.Buffer
+	subject.SetTrace(&trace)
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := subject.SendAndGetData("+CSQ", "AT+CSQ", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	_ = subject.Close()
+
+	replay, err := gsm.NewReplayTransport(&trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	replayed := gsm.NewSerial(&ctx, replay, "replay")
+	defer replayed.Close()
+	if err := replayed.Open(); err != nil {
+		t.Fatal(err)
+	}
+	csq, err := replayed.SendAndGetData("+CSQ", "AT+CSQ", time.Second)
+	if err != nil || csq != "+CSQ: 17,99" {
+		t.Fatalf("replayed CSQ: %q %v", csq, err)
+	}
+	if err := replay.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnableTraceReplacesFile(t *testing.T) {
+	fds := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip("no /proc/self/fd")
+		}
+		return len(entries)
+	}
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.trace"), filepath.Join(dir, "second.trace")
+	subject, _ := newSubject(t)
+	open := fds()
+	if err := subject.EnableTrace(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	// Replaced on a running subject, the current transport follows
+	if err := subject.EnableTrace(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := subject.SendAndGetData("+CSQ", "AT+CSQ", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	_ = subject.Close()
+	if leaked := fds() - open; leaked > 0 {
+		t.Errorf("%d trace files left open", leaked)
+	}
+	data, err := os.ReadFile(first)
+	if err != nil || strings.Contains(string(data), "AT+CSQ") {
+		t.Errorf("first trace got traffic after it was replaced: %v", err)
+	}
+	data, err = os.ReadFile(second)
+	if err != nil || !strings.Contains(string(data), "AT+CSQ") {
+		t.Errorf("second trace missed AT+CSQ: %v", err)
+	}
+}
+
+func TestDownloadFileIsBinarySafe(t *testing.T) {
+	subject, modem := newSubject(t)
+	data := []byte("RIFF\x00\x01\r\n+QFDWL\r\n\r\nOK\r\n\xff\xfe\r\ndata")
+	modem.SetFile("call.wav", data)
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, announced := range []bool{true, false} {
+		modem.ConnectLength = announced
+		got, err := subject.DownloadFile(context.Background(), "call.wav")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("downloaded %q, want %q", got, data)
+		}
+	}
+	if _, err := subject.DownloadFile(context.Background(), "missing.wav"); !errors.Is(err, gsm.ErrFileNotFound) {
+		t.Errorf("expected file not found, got %v", err)
+	}
+}
+
+func TestCallRecordingIsNamedAfterPortBase(t *testing.T) {
+	ctx := context.Background()
+	modem := sim.New()
+	defer modem.Close()
+	subject := gsm.NewSerial(&ctx, modem.Transport(), "/dev/ttyUSB2")
+	defer subject.Close()
+	events, _ := subject.SubscribeChan(4)
+	modem.SetFile("ttyUSB2.wav", []byte("RIFF"))
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	modem.Ring("")
+	if !modem.WaitCommand(`AT+QAUDRD=1,"ttyUSB2.wav"`, 3*time.Second) {
+		t.Fatalf("recording not started as ttyUSB2.wav: %q", modem.Commands())
+	}
+	modem.Hangup()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			ready, ok := event.(gsm.RecordingReady)
+			if !ok {
+				continue
+			}
+			if ready.Name != "ttyUSB2.wav" || string(ready.Data) != "RIFF" {
+				t.Errorf("got %s %q", ready.Name, ready.Data)
+			}
+			// Without a handler nothing is written to the working directory
+			if _, err := os.Stat("ttyUSB2.wav"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("recording written to the working directory: %v", err)
+			}
+			return
+		case <-timeout:
+			t.Fatal("RecordingReady was not published")
+		}
+	}
+}
+
+func TestCallRecordingIsHandedToHandler(t *testing.T) {
+	ctx := context.Background()
+	modem := sim.New()
+	defer modem.Close()
+	subject := gsm.NewSerial(&ctx, modem.Transport(), "rec")
+	defer subject.Close()
+	recordings := make(chan []byte, 1)
+	subject.SetRecordingHandler(func(name string, data []byte) {
+		recordings <- data
+	})
+	modem.SetFile("rec.wav", []byte("RIFF\r\nrecording"))
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	modem.Hangup()
+	select {
+	case data := <-recordings:
+		if string(data) != "RIFF\r\nrecording" {
+			t.Errorf("unexpected recording %q", data)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("recording was not handed over")
+	}
+}
+
+func TestUploadShortPayload(t *testing.T) {
+	guard := gsm.EscapeGuardTime
+	gsm.EscapeGuardTime = 20 * time.Millisecond
+	defer func() { gsm.EscapeGuardTime = guard }()
+	subject, modem := newSubject(t)
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := subject.UploadFile(ctx, "short.txt", strings.NewReader("abc"), 10); !errors.Is(err, gsm.ErrShortPayload) {
+		t.Fatalf("got %v", err)
+	}
+	if _, ok := modem.File("short.txt"); ok {
+		t.Error("short upload was stored")
+	}
+	// Back in command mode, the escape's OK is not taken for this answer
+	files, err := subject.ListFiles(ctx, "*")
+	if err != nil || len(files) != 0 {
+		t.Errorf("listing after abort %+v %v", files, err)
+	}
+}
+
+func TestModemFileSystem(t *testing.T) {
+	subject, modem := newSubject(t)
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	greeting := bytes.Repeat([]byte("RIFF\r\n\x00\xff"), 300)
+	if err := subject.UploadFile(ctx, "greeting.wav", bytes.NewReader(greeting), len(greeting)); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := modem.File("greeting.wav"); !bytes.Equal(stored, greeting) {
+		t.Fatal("uploaded file differs")
+	}
+	files, err := subject.ListFiles(ctx, "*")
+	if err != nil || len(files) != 1 || files[0].Name != "greeting.wav" || files[0].Size != int64(len(greeting)) {
+		t.Fatalf("unexpected listing %+v %v", files, err)
+	}
+	space, err := subject.FreeSpace(ctx, "UFS")
+	if err != nil || space.Total-space.Free != int64(len(greeting)) {
+		t.Fatalf("unexpected storage info %+v %v", space, err)
+	}
+
+	file, err := subject.OpenFile(ctx, "greeting.wav", gsm.FileReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Seek(8, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(file)
+	if err != nil || !bytes.Equal(rest, greeting[8:]) {
+		t.Fatalf("read %d bytes, %v", len(rest), err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var downloaded bytes.Buffer
+	if _, err := subject.DownloadFileTo(ctx, "greeting.wav", &downloaded); err != nil || !bytes.Equal(downloaded.Bytes(), greeting) {
+		t.Fatalf("download differs: %v", err)
+	}
+	if err := subject.DeleteFile(ctx, "greeting.wav"); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := subject.ListFiles(ctx, "*"); len(files) != 0 {
+		t.Fatalf("file was not deleted: %+v", files)
+	}
+}
@@ -0,0 +1,186 @@
+package gsm
+
+import (
+	"context"
+	"fmt"
+	"go-gsm/pkg/logrus"
+	"time"
+)
+
+// Dialer opens a fresh transport to a modem
+type Dialer func(ctx context.Context) (Transport, error)
+
+// ConnectionState tells whether a supervised modem is usable
+type ConnectionState int
+
+const (
+	Disconnected ConnectionState = iota
+	Connected
+)
+
+func (c ConnectionState) String() string {
+	if c == Connected {
+		return "connected"
+	}
+	return "disconnected"
+}
+
+// ConnectionEvent is emitted by a Supervisor whenever the modem drops off or
+// comes back, it is also published on the subject's event bus
+type ConnectionEvent struct {
+	PortName string
+	State    ConnectionState
+	// Err is why the connection was lost
+	Err  error
+	Time time.Time
+}
+
+// SupervisorOptions configures a Supervisor
+type SupervisorOptions struct {
+	// Dial reopens the modem, see PortDialer and USBSerialDialer
+	Dial Dialer
+	// IMEI, when set, rejects a reappeared port that belongs to another modem
+	IMEI string
+	// MinBackoff and MaxBackoff bound the delay between reopen attempts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// OnEvent receives every connection change
+	OnEvent func(ConnectionEvent)
+}
+
+// Supervisor keeps a SerialSubject connected, reopening its transport and
+// replaying the init sequence whenever the transport fails
+type Supervisor struct {
+	subject *SerialSubject
+	opts    SupervisorOptions
+}
+
+// NewSupervisor supervises an opened subject
+func NewSupervisor(subject *SerialSubject, opts SupervisorOptions) *Supervisor {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Second
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	return &Supervisor{subject: subject, opts: opts}
+}
+
+// Run blocks until ctx is done or the subject is closed
+func (sv *Supervisor) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-sv.subject.closed:
+			return ErrClosed
+		case <-sv.subject.Lost():
+		}
+		sv.emit(Disconnected, sv.subject.LostErr())
+		if err := sv.reconnect(ctx); err != nil {
+			return err
+		}
+		sv.emit(Connected, nil)
+	}
+}
+
+// reconnect retries until a transport is open, verified and initialized
+func (sv *Supervisor) reconnect(ctx context.Context) error {
+	sv.subject.dropTransport()
+	backoff := sv.opts.MinBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-sv.subject.closed:
+			return ErrClosed
+		case <-time.After(backoff):
+		}
+		err := sv.attempt(ctx)
+		if err == nil {
+			return nil
+		}
+		logrus.LogrusLoggerWithContext(sv.subject.ctx).Warnf("Reconnecting %s: %v", sv.subject.portName, err)
+		backoff *= 2
+		if backoff > sv.opts.MaxBackoff {
+			backoff = sv.opts.MaxBackoff
+		}
+	}
+}
+
+func (sv *Supervisor) attempt(ctx context.Context) error {
+	port, err := sv.opts.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	sv.subject.attachTransport(port)
+	if sv.opts.IMEI != "" {
+		response, err := sv.subject.ExecContext(ctx, imeiCommand)
+		if err != nil {
+			sv.subject.dropTransport()
+			return err
+		}
+		if imei := parseIMEI(response); imei != sv.opts.IMEI {
+			sv.subject.dropTransport()
+			return fmt.Errorf("found modem %s, expected %s", imei, sv.opts.IMEI)
+		}
+	}
+	if err := sv.subject.initModem(ctx); err != nil {
+		// Left open, the next attempt would find the port busy
+		sv.subject.dropTransport()
+		return err
+	}
+	return nil
+}
+
+func (sv *Supervisor) emit(state ConnectionState, err error) {
+	logrus.LogrusLoggerWithContext(sv.subject.ctx).Infof("Modem %s %s", sv.subject.portName, state)
+	event := ConnectionEvent{
+		PortName: sv.subject.portName,
+		State:    state,
+		Err:      err,
+		Time:     time.Now(),
+	}
+	sv.subject.publish(event)
+	if sv.opts.OnEvent != nil {
+		sv.opts.OnEvent(event)
+	}
+}
+
+// PortDialer reopens a serial port by name once it reappears
+func PortDialer(portName string, baudRate int) Dialer {
+	return func(ctx context.Context) (Transport, error) {
+		return OpenSerialTransport(portName, baudRate)
+	}
+}
+
+// USBSerialDialer finds the modem by its USB serial number, whatever port
+// name it got after re-enumeration. The identified AT port is used, unknown
+// models get the first port answering AT.
+func USBSerialDialer(serialNumber string, baudRate int) Dialer {
+	return func(ctx context.Context) (Transport, error) {
+		modems, err := DiscoverUSBModems()
+		if err != nil {
+			return nil, err
+		}
+		for _, modem := range modems {
+			if modem.SerialNumber != serialNumber {
+				continue
+			}
+			if modem.ATPort != "" {
+				return OpenSerialTransport(modem.ATPort, baudRate)
+			}
+			for _, candidate := range modem.Ports {
+				port, err := OpenSerialTransport(candidate.Name, baudRate)
+				if err != nil {
+					continue
+				}
+				if ProbeAT(port, time.Second) {
+					return port, nil
+				}
+				_ = port.Close()
+			}
+		}
+		return nil, fmt.Errorf("no AT port with USB serial %s", serialNumber)
+	}
+}
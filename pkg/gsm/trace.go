@@ -0,0 +1,248 @@
+package gsm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Trace directions, as seen from the host
+const (
+	TraceSent     = '>'
+	TraceReceived = '<'
+)
+
+// TraceEntry is one chunk of recorded traffic
+type TraceEntry struct {
+	Time      time.Time
+	Direction byte
+	Data      []byte
+}
+
+// TraceTransport records every byte going through a transport. Each chunk
+// becomes one line: RFC 3339 time, direction and the Go-quoted bytes, e.g.
+//
+//	2024-10-17T09:12:01.123456789Z > "AT+CSQ\r\n"
+type TraceTransport struct {
+	Transport
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewTraceTransport wraps t, writing its traffic to w
+func NewTraceTransport(t Transport, w io.Writer) *TraceTransport {
+	return &TraceTransport{Transport: t, w: w}
+}
+
+func (t *TraceTransport) Read(p []byte) (int, error) {
+	n, err := t.Transport.Read(p)
+	if n > 0 {
+		t.record(TraceReceived, p[:n])
+	}
+	return n, err
+}
+
+func (t *TraceTransport) Write(p []byte) (int, error) {
+	n, err := t.Transport.Write(p)
+	if n > 0 {
+		t.record(TraceSent, p[:n])
+	}
+	return n, err
+}
+
+func (t *TraceTransport) record(direction byte, data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.w == nil {
+		return
+	}
+	_, _ = fmt.Fprintf(t.w, "%s %c %s\n", time.Now().UTC().Format(time.RFC3339Nano), direction, strconv.Quote(string(data)))
+}
+
+func (t *TraceTransport) setWriter(w io.Writer) {
+	t.mu.Lock()
+	t.w = w
+	t.mu.Unlock()
+}
+
+// SetTrace records the traffic of the current and every future transport
+// of the subject to w. The current transport is only traced if it was
+// attached with tracing on, call it before Open. A nil w stops tracing.
+func (s *SerialSubject) SetTrace(w io.Writer) {
+	s.setTrace(w, nil)
+}
+
+// EnableTrace appends the traffic to a file, which is closed with the
+// subject or when the trace is replaced
+func (s *SerialSubject) EnableTrace(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.setTrace(file, file)
+	return nil
+}
+
+// setTrace switches the trace writer and closes the file of the previous
+// EnableTrace, nothing writes to it once the current transport switched
+func (s *SerialSubject) setTrace(w io.Writer, file *os.File) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	s.trace = w
+	if traced, ok := s.port.(*TraceTransport); ok {
+		traced.setWriter(w)
+	}
+	if s.traceFile != nil {
+		_ = s.traceFile.Close()
+	}
+	s.traceFile = file
+}
+
+// ReadTrace parses a recorded trace
+func ReadTrace(r io.Reader) ([]TraceEntry, error) {
+	entries := make([]TraceEntry, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, " ", 3)
+		if len(parts) != 3 || len(parts[1]) != 1 {
+			return nil, fmt.Errorf("trace line %d: malformed", line)
+		}
+		at, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("trace line %d: %w", line, err)
+		}
+		data, err := strconv.Unquote(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("trace line %d: %w", line, err)
+		}
+		direction := parts[1][0]
+		if direction != TraceSent && direction != TraceReceived {
+			return nil, fmt.Errorf("trace line %d: unknown direction %c", line, direction)
+		}
+		entries = append(entries, TraceEntry{Time: at, Direction: direction, Data: []byte(data)})
+	}
+	return entries, scanner.Err()
+}
+
+// ReplayTransport plays a recorded trace back as if it were the modem. A
+// received chunk is only delivered once the host has written as many bytes
+// as were sent before it in the recording, so responses never overtake the
+// commands they answer.
+type ReplayTransport struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	entries  []TraceEntry
+	next     int
+	expected []byte
+	written  []byte
+	pending  []byte
+	closed   bool
+	mismatch error
+	done     chan struct{}
+}
+
+// NewReplayTransport loads a trace written by TraceTransport
+func NewReplayTransport(r io.Reader) (*ReplayTransport, error) {
+	entries, err := ReadTrace(r)
+	if err != nil {
+		return nil, err
+	}
+	t := &ReplayTransport{entries: entries, done: make(chan struct{})}
+	t.cond = sync.NewCond(&t.mu)
+	t.advance()
+	return t, nil
+}
+
+// advance consumes sent entries into the expected stream, it must be
+// called with mu held
+func (t *ReplayTransport) advance() {
+	for t.next < len(t.entries) && t.entries[t.next].Direction == TraceSent {
+		t.expected = append(t.expected, t.entries[t.next].Data...)
+		t.next++
+	}
+	if t.next == len(t.entries) && len(t.pending) == 0 {
+		select {
+		case <-t.done:
+		default:
+			close(t.done)
+		}
+	}
+}
+
+func (t *ReplayTransport) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		if t.closed {
+			return 0, io.EOF
+		}
+		if len(t.pending) > 0 {
+			n := copy(p, t.pending)
+			t.pending = t.pending[n:]
+			t.advance()
+			return n, nil
+		}
+		if t.next < len(t.entries) && len(t.written) >= len(t.expected) {
+			t.pending = t.entries[t.next].Data
+			t.next++
+			continue
+		}
+		t.cond.Wait()
+	}
+}
+
+func (t *ReplayTransport) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return 0, ErrTransportClosed
+	}
+	start := len(t.written)
+	t.written = append(t.written, p...)
+	if t.mismatch == nil {
+		end := len(t.written)
+		if end > len(t.expected) {
+			end = len(t.expected)
+		}
+		if start < end && !bytes.Equal(t.written[start:end], t.expected[start:end]) {
+			t.mismatch = fmt.Errorf("replay diverged at byte %d: wrote %q, recorded %q", start, t.written[start:end], t.expected[start:end])
+		}
+	}
+	t.cond.Broadcast()
+	return len(p), nil
+}
+
+// Close ends the replay, readers get io.EOF
+func (t *ReplayTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	t.cond.Broadcast()
+	return nil
+}
+
+// Done is closed once every recorded chunk was delivered
+func (t *ReplayTransport) Done() <-chan struct{} {
+	return t.done
+}
+
+// Err reports the first difference between what the host wrote and what
+// was recorded
+func (t *ReplayTransport) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.mismatch
+}
@@ -0,0 +1,149 @@
+package gsm
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Transport is the byte stream a SerialSubject talks AT commands over.
+// serial.Port, net.Conn and *os.File all satisfy it.
+type Transport interface {
+	io.ReadWriteCloser
+}
+
+// ErrTransportClosed is returned by pipe transports after Close
+var ErrTransportClosed = errors.New("transport closed")
+
+// OpenSerialTransport opens a local serial port as a Transport
+func OpenSerialTransport(portName string, baudRate int) (Transport, error) {
+	port, err := CreatePort(portName, baudRate)
+	if err != nil {
+		return nil, err
+	}
+	return port, nil
+}
+
+// DialTCP connects to a raw TCP serial bridge such as ser2net
+func DialTCP(address string, timeout time.Duration) (Transport, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		// AT traffic is small and interactive, don't let Nagle batch it
+		_ = tcp.SetNoDelay(true)
+		_ = tcp.SetKeepAlive(true)
+		_ = tcp.SetKeepAlivePeriod(30 * time.Second)
+	}
+	return conn, nil
+}
+
+// pipeBuffer is one direction of an in-memory pipe
+type pipeBuffer struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	data     []byte
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newPipeBuffer() *pipeBuffer {
+	b := &pipeBuffer{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *pipeBuffer) read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.data) == 0 && !b.closed {
+		if !b.deadline.IsZero() && !time.Now().Before(b.deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		b.cond.Wait()
+	}
+	if len(b.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+func (b *pipeBuffer) write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, ErrTransportClosed
+	}
+	b.data = append(b.data, p...)
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+// setDeadline wakes blocked readers when the deadline passes
+func (b *pipeBuffer) setDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deadline = t
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if !t.IsZero() {
+		b.timer = time.AfterFunc(time.Until(t), func() {
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		})
+	}
+	b.cond.Broadcast()
+}
+
+func (b *pipeBuffer) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// PipeTransport is one end of an in-memory, buffered duplex pipe
+type PipeTransport struct {
+	in  *pipeBuffer
+	out *pipeBuffer
+}
+
+// NewPipe returns two connected in-memory transports. Bytes written to one
+// end are read from the other; writes never block.
+func NewPipe() (*PipeTransport, *PipeTransport) {
+	a := newPipeBuffer()
+	b := newPipeBuffer()
+	return &PipeTransport{in: a, out: b}, &PipeTransport{in: b, out: a}
+}
+
+func (p *PipeTransport) Read(buf []byte) (int, error) {
+	return p.in.read(buf)
+}
+
+func (p *PipeTransport) Write(buf []byte) (int, error) {
+	return p.out.write(buf)
+}
+
+// SetReadDeadline makes Read fail with os.ErrDeadlineExceeded once t has
+// passed and nothing is buffered. The zero time clears it.
+func (p *PipeTransport) SetReadDeadline(t time.Time) error {
+	p.in.setDeadline(t)
+	return nil
+}
+
+// Close closes both directions, the peer sees io.EOF once drained
+func (p *PipeTransport) Close() error {
+	p.in.close()
+	p.out.close()
+	return nil
+}
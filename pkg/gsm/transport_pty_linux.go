@@ -0,0 +1,40 @@
+//go:build linux
+
+package gsm
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenPTY opens a pseudo terminal (e.g. /dev/pts/3 created by socat or a
+// USB/IP bridge) in raw mode and returns it as a Transport
+func OpenPTY(path string) (Transport, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := makeRaw(int(file.Fd())); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// makeRaw is the cfmakeraw(3) equivalent, the line discipline must not
+// translate CR/LF or echo our commands back
+func makeRaw(fd int) error {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package gsm
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// OpenPTY is only implemented on Linux
+func OpenPTY(path string) (Transport, error) {
+	return nil, fmt.Errorf("pty transport is not supported on %s", runtime.GOOS)
+}
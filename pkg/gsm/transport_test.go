@@ -0,0 +1,150 @@
+package gsm_test
+
+import (
+	"context"
+	"errors"
+	"go-gsm/pkg/gsm"
+	"go-gsm/pkg/gsm/sim"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPipeTransport(t *testing.T) {
+	a, b := gsm.NewPipe()
+	if _, err := a.Write([]byte("AT\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "AT\r\n" {
+		t.Fatalf("read %q: %v", buf[:n], err)
+	}
+
+	// Written before Close is still read, then EOF
+	if _, err := b.Write([]byte("OK\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := a.Read(buf); err != nil || string(buf[:n]) != "OK\r\n" {
+		t.Fatalf("read buffered %q: %v", buf[:n], err)
+	}
+	if _, err := a.Read(buf); err != io.EOF {
+		t.Errorf("read after Close: %v", err)
+	}
+	if _, err := b.Read(buf); err != io.EOF {
+		t.Errorf("peer read after Close: %v", err)
+	}
+	if _, err := a.Write([]byte("AT\r\n")); !errors.Is(err, gsm.ErrTransportClosed) {
+		t.Errorf("write after Close: %v", err)
+	}
+	if _, err := b.Write([]byte("AT\r\n")); !errors.Is(err, gsm.ErrTransportClosed) {
+		t.Errorf("peer write after Close: %v", err)
+	}
+}
+
+func TestPipeCloseUnblocksRead(t *testing.T) {
+	a, _ := gsm.NewPipe()
+	result := make(chan error, 1)
+	go func() {
+		_, err := a.Read(make([]byte, 16))
+		result <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	_ = a.Close()
+	select {
+	case err := <-result:
+		if err != io.EOF {
+			t.Errorf("got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read still blocked after Close")
+	}
+}
+
+func TestPipeReadDeadline(t *testing.T) {
+	a, b := gsm.NewPipe()
+	buf := make([]byte, 16)
+	if err := a.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := a.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past deadline: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("deadline hit after %v", elapsed)
+	}
+
+	// Cleared, buffered data is read again
+	if err := a.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = b.Write([]byte("OK\r\n"))
+	if n, err := a.Read(buf); err != nil || string(buf[:n]) != "OK\r\n" {
+		t.Errorf("read after clearing deadline %q: %v", buf[:n], err)
+	}
+	if gsm.ProbeAT(a, 20*time.Millisecond) {
+		t.Error("probe answered by a silent peer")
+	}
+}
+
+// serveTCP bridges the first connection to an emulated modem, like ser2net
+// in front of a serial port
+func serveTCP(t *testing.T, modem *sim.Modem) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go func() { _, _ = io.Copy(conn, modem.Transport()) }()
+		_, _ = io.Copy(modem.Transport(), conn)
+	}()
+	return listener.Addr().String()
+}
+
+func TestDialTCP(t *testing.T) {
+	modem := sim.New()
+	defer modem.Close()
+	transport, err := gsm.DialTCP(serveTCP(t, modem), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	subject := gsm.NewSerial(&ctx, transport, "ser2net")
+	if err := subject.Open(); err != nil {
+		t.Fatal(err)
+	}
+	csq, err := subject.SendAndGetData("+CSQ", "AT+CSQ", time.Second)
+	if err != nil || csq != "+CSQ: 20,99" {
+		t.Errorf("CSQ over TCP: %q %v", csq, err)
+	}
+	if err := subject.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.Write([]byte("AT\r\n")); err == nil {
+		t.Error("write after Close succeeded")
+	}
+}
+
+func TestDialTCPRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	_ = listener.Close()
+	if _, err := gsm.DialTCP(address, time.Second); err == nil {
+		t.Error("dialed a closed port")
+	}
+}
@@ -0,0 +1,177 @@
+package gsm
+
+import (
+	"go-gsm/pkg/logrus"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// URCRoute maps unsolicited result codes starting with Prefix to a handler
+type URCRoute struct {
+	// Prefix such as "+CMTI:" or "RING", the longest matching prefix wins
+	Prefix string
+	// Lines is the fixed line count of a URC such as +CMT, header and
+	// message. Its lines are taken whatever they hold, even "OK".
+	Lines int
+	// Complete reports whether lines hold the whole URC when the count is
+	// not fixed, see URCQuoted. A final result code ends such a URC early.
+	// Nil with Lines unset for URCs of a single line.
+	Complete func(lines []string) bool
+	// Handler receives the lines of one URC. Handlers run one at a time on
+	// a goroutine of their own, in the order the URCs arrived.
+	Handler func(lines []string)
+}
+
+// UnknownURC is published for unsolicited lines no route handles
+type UnknownURC struct {
+	PortName string
+	Line     string
+}
+
+func (UnknownURC) EventName() string { return "unknown_urc" }
+
+// URCQuoted completes a URC once its quoted string is closed, for +CUSD
+// replies spanning several lines
+func URCQuoted(lines []string) bool {
+	quotes := strings.Count(strings.Join(lines, "\n"), "\"")
+	return quotes == 0 || quotes >= 2
+}
+
+// complete reports whether lines hold the whole URC
+func (r URCRoute) complete(lines []string) bool {
+	switch {
+	case r.Lines > 0:
+		return len(lines) >= r.Lines
+	case r.Complete != nil:
+		return r.Complete(lines)
+	}
+	return true
+}
+
+// maxURCLines ends a multi-line URC that never completes
+const maxURCLines = 32
+
+// finalResults abort a multi-line URC, they can't be part of one
+var finalResults = []string{"OK", "ERROR", "NO CARRIER", "BUSY", "NO ANSWER", "NO DIALTONE"}
+
+// RegisterURC adds a route, a route with the same prefix is replaced
+func (s *SerialSubject) RegisterURC(route URCRoute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	routes := make([]URCRoute, 0, len(s.urcs)+1)
+	for _, r := range s.urcs {
+		if r.Prefix != route.Prefix {
+			routes = append(routes, r)
+		}
+	}
+	routes = append(routes, route)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].Prefix) > len(routes[j].Prefix)
+	})
+	s.urcs = routes
+}
+
+// UnregisterURC removes the route for prefix
+func (s *SerialSubject) UnregisterURC(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	routes := make([]URCRoute, 0, len(s.urcs))
+	for _, r := range s.urcs {
+		if r.Prefix != prefix {
+			routes = append(routes, r)
+		}
+	}
+	s.urcs = routes
+}
+
+func (s *SerialSubject) findURC(line string) (URCRoute, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, route := range s.urcs {
+		if strings.HasPrefix(line, route.Prefix) {
+			return route, true
+		}
+	}
+	return URCRoute{}, false
+}
+
+// registerBuiltinURCs routes the URCs the built-in observers handle
+func (s *SerialSubject) registerBuiltinURCs() {
+	sms := NewSMSObserver(s)
+	call := NewCallObserver(s)
+	info := NewInfoObserver(s)
+	single := func(observer SerialObserver) func(lines []string) {
+		return func(lines []string) { observer.Update(lines[0]) }
+	}
+	for _, prefix := range []string{"RING", "NO CARRIER", "+CLIP:"} {
+		s.RegisterURC(URCRoute{Prefix: prefix, Handler: single(call)})
+	}
+	for _, prefix := range []string{"+CSQ:", "+CCID:", "+CREG:"} {
+		s.RegisterURC(URCRoute{Prefix: prefix, Handler: single(info)})
+	}
+	s.RegisterURC(URCRoute{Prefix: "+CMTI:", Handler: single(sms)})
+	s.RegisterURC(URCRoute{Prefix: "+CMT:", Lines: 2, Handler: sms.receive})
+	s.RegisterURC(URCRoute{Prefix: "+CDS:", Complete: completeCDS, Handler: s.handleCDS})
+	s.RegisterURC(URCRoute{Prefix: "+CDSI:", Handler: s.handleCDSI})
+	s.RegisterURC(URCRoute{Prefix: "+CUSD:", Complete: URCQuoted, Handler: s.handleCUSD})
+}
+
+// handleURC routes an unsolicited line or continues a multi-line URC, it
+// runs on the reader goroutine
+func (s *SerialSubject) handleURC(line string) {
+	if s.urcLines != nil {
+		s.urcLines = append(s.urcLines, line)
+		if s.urcRoute.complete(s.urcLines) || len(s.urcLines) >= maxURCLines {
+			s.runURC(s.urcRoute, s.urcLines)
+			s.urcLines = nil
+		}
+		return
+	}
+	route, ok := s.findURC(line)
+	if !ok {
+		if isFinalResult(line) || strings.HasPrefix(line, "CONNECT") || s.isEcho(line) {
+			// Belonged to a command that already gave up
+			logrus.LogrusLoggerWithContext(s.ctx).Debugf("Skipped: %s", line)
+			return
+		}
+		s.publish(UnknownURC{PortName: s.portName, Line: line})
+		return
+	}
+	lines := []string{line}
+	if !route.complete(lines) {
+		s.urcRoute = route
+		s.urcLines = lines
+		return
+	}
+	s.runURC(route, lines)
+}
+
+// runURC queues a handler call so slow handlers never stall the reader
+func (s *SerialSubject) runURC(route URCRoute, lines []string) {
+	s.urcHandlers.publish(func() { route.Handler(lines) })
+}
+
+func isFinalResult(line string) bool {
+	for _, final := range finalResults {
+		if line == final {
+			return true
+		}
+	}
+	return false
+}
+
+// handleCUSD parses +CUSD: <m>[,"<str>",<dcs>] and hands the reply to
+// SendUSSD
+func (s *SerialSubject) handleCUSD(lines []string) {
+	message := strings.Join(lines, "\n")
+	params := strings.TrimPrefix(message, "+CUSD:")
+	status, _ := strconv.Atoi(strings.TrimSpace(strings.SplitN(params, ",", 2)[0]))
+	text := ""
+	firstIndex := strings.Index(message, "\"")
+	lastIndex := strings.LastIndex(message, "\"")
+	if firstIndex != -1 && lastIndex > firstIndex {
+		text = message[firstIndex+1 : lastIndex]
+	}
+	s.deliverUSSD(status, strings.TrimSpace(text))
+}
@@ -0,0 +1,232 @@
+package gsm
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// PortRole is what one USB serial interface of a modem is used for
+type PortRole string
+
+const (
+	RoleUnknown PortRole = "unknown"
+	RoleDiag    PortRole = "diag"
+	RoleNMEA    PortRole = "nmea"
+	RoleAT      PortRole = "at"
+	RoleModem   PortRole = "modem"
+	RoleAudio   PortRole = "audio"
+)
+
+// ModemModel describes the USB interface layout of a modem family
+type ModemModel struct {
+	Vendor     string
+	Model      string
+	VID        string
+	PID        string
+	Interfaces map[int]PortRole
+}
+
+// qualcommLayout is shared by most Quectel and SIMCom modules
+var qualcommLayout = map[int]PortRole{0: RoleDiag, 1: RoleNMEA, 2: RoleAT, 3: RoleModem}
+
+// KnownModems maps VID/PID to interface roles, append to it for other models
+var KnownModems = []ModemModel{
+	{Vendor: "Quectel", Model: "EC25/EG25", VID: "2c7c", PID: "0125", Interfaces: qualcommLayout},
+	{Vendor: "Quectel", Model: "EC21", VID: "2c7c", PID: "0121", Interfaces: qualcommLayout},
+	{Vendor: "Quectel", Model: "EG91", VID: "2c7c", PID: "0191", Interfaces: qualcommLayout},
+	{Vendor: "Quectel", Model: "EG95", VID: "2c7c", PID: "0195", Interfaces: qualcommLayout},
+	{Vendor: "Quectel", Model: "BG96", VID: "2c7c", PID: "0296", Interfaces: qualcommLayout},
+	{Vendor: "Quectel", Model: "EP06/EG06/EM06", VID: "2c7c", PID: "0306", Interfaces: qualcommLayout},
+	{Vendor: "Quectel", Model: "EG12/EM12", VID: "2c7c", PID: "0512", Interfaces: qualcommLayout},
+	{Vendor: "Quectel", Model: "RM500Q", VID: "2c7c", PID: "0800", Interfaces: qualcommLayout},
+	{Vendor: "Quectel", Model: "EC20", VID: "05c6", PID: "9215", Interfaces: qualcommLayout},
+	{Vendor: "Quectel", Model: "UC20", VID: "05c6", PID: "9003", Interfaces: qualcommLayout},
+	{Vendor: "SIMCom", Model: "SIM7500/SIM7600", VID: "1e0e", PID: "9001", Interfaces: map[int]PortRole{
+		0: RoleDiag, 1: RoleNMEA, 2: RoleAT, 3: RoleModem, 4: RoleAudio,
+	}},
+	{Vendor: "SIMCom", Model: "SIM5320", VID: "05c6", PID: "9000", Interfaces: qualcommLayout},
+}
+
+// USBPort is one serial interface of a USB modem
+type USBPort struct {
+	Name string
+	// Interface is the USB interface number, or the position among the
+	// modem's ports when the OS doesn't expose it
+	Interface int
+	Role      PortRole
+}
+
+// USBModem is one physical modem with its serial interfaces identified
+type USBModem struct {
+	Vendor       string
+	Model        string
+	VID          string
+	PID          string
+	SerialNumber string
+	Ports        []USBPort
+	// ATPort, NMEAPort and ModemPort are empty when not identified
+	ATPort    string
+	NMEAPort  string
+	ModemPort string
+}
+
+// DiscoverUSBModems groups USB serial ports by physical device and
+// identifies their roles from KnownModems. Unknown devices are returned
+// with RoleUnknown ports.
+func DiscoverUSBModems() ([]USBModem, error) {
+	details, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return nil, err
+	}
+	return groupUSBModems(details, usbInterfaceNumber, usbLocation), nil
+}
+
+// USBATPorts lists the AT port of every known modem, it can be used as
+// PoolOptions.Ports
+func USBATPorts() ([]string, error) {
+	modems, err := DiscoverUSBModems()
+	if err != nil {
+		return nil, err
+	}
+	ports := make([]string, 0, len(modems))
+	for _, modem := range modems {
+		if modem.ATPort != "" {
+			ports = append(ports, modem.ATPort)
+		}
+	}
+	return ports, nil
+}
+
+func groupUSBModems(details []*enumerator.PortDetails, iface func(string) int, location func(string) string) []USBModem {
+	groups := make(map[string]*USBModem)
+	keys := make([]string, 0)
+	for _, d := range details {
+		if !d.IsUSB {
+			continue
+		}
+		vid, pid := strings.ToLower(d.VID), strings.ToLower(d.PID)
+		// Identical modems without a serial number are told apart by bus
+		// position, without one each port stands alone rather than merging
+		id := d.SerialNumber
+		if id == "" {
+			id = location(d.Name)
+		}
+		if id == "" {
+			id = d.Name
+		}
+		key := vid + ":" + pid + ":" + id
+		modem, ok := groups[key]
+		if !ok {
+			modem = &USBModem{VID: vid, PID: pid, SerialNumber: d.SerialNumber}
+			if model := lookupModemModel(vid, pid); model != nil {
+				modem.Vendor, modem.Model = model.Vendor, model.Model
+			}
+			groups[key] = modem
+			keys = append(keys, key)
+		}
+		modem.Ports = append(modem.Ports, USBPort{
+			Name:      d.Name,
+			Interface: iface(d.Name),
+			Role:      roleFromProduct(d.Product),
+		})
+	}
+	sort.Strings(keys)
+
+	modems := make([]USBModem, 0, len(keys))
+	for _, key := range keys {
+		modem := groups[key]
+		sort.Slice(modem.Ports, func(i, j int) bool {
+			return naturalLess(modem.Ports[i].Name, modem.Ports[j].Name)
+		})
+		model := lookupModemModel(modem.VID, modem.PID)
+		for i := range modem.Ports {
+			port := &modem.Ports[i]
+			if port.Interface < 0 {
+				port.Interface = i
+			}
+			if port.Role == RoleUnknown && model != nil {
+				if role, ok := model.Interfaces[port.Interface]; ok {
+					port.Role = role
+				}
+			}
+			switch port.Role {
+			case RoleAT:
+				modem.ATPort = port.Name
+			case RoleNMEA:
+				modem.NMEAPort = port.Name
+			case RoleModem:
+				modem.ModemPort = port.Name
+			}
+		}
+		modems = append(modems, *modem)
+	}
+	return modems
+}
+
+func lookupModemModel(vid, pid string) *ModemModel {
+	for i := range KnownModems {
+		if strings.EqualFold(KnownModems[i].VID, vid) && strings.EqualFold(KnownModems[i].PID, pid) {
+			return &KnownModems[i]
+		}
+	}
+	return nil
+}
+
+// roleFromProduct reads the role from driver descriptions such as Windows'
+// "Quectel USB AT Port" or "SimTech HS-USB NMEA 9001"
+func roleFromProduct(product string) PortRole {
+	product = strings.ToLower(product)
+	switch {
+	case strings.Contains(product, "at port"), strings.Contains(product, "at interface"):
+		return RoleAT
+	case strings.Contains(product, "nmea"), strings.Contains(product, "gps"):
+		return RoleNMEA
+	case strings.Contains(product, "diagnostic"), strings.Contains(product, " dm "), strings.HasSuffix(product, " dm"), strings.Contains(product, "diag"):
+		return RoleDiag
+	case strings.Contains(product, "audio"):
+		return RoleAudio
+	case strings.Contains(product, "modem"):
+		return RoleModem
+	}
+	return RoleUnknown
+}
+
+// naturalLess orders ttyUSB2 before ttyUSB10 and COM9 before COM20
+func naturalLess(a, b string) bool {
+	ta, na := splitTrailingNumber(a)
+	tb, nb := splitTrailingNumber(b)
+	if ta != tb {
+		return ta < tb
+	}
+	return na < nb
+}
+
+func splitTrailingNumber(s string) (string, int) {
+	i := len(s)
+	for i > 0 && s[i-1] >= '0' && s[i-1] <= '9' {
+		i--
+	}
+	n := 0
+	for _, c := range s[i:] {
+		n = n*10 + int(c-'0')
+	}
+	return s[:i], n
+}
+
+// splitLocationPath splits a Windows location path such as
+// "PCIROOT(0)#PCI(1400)#USBROOT(0)#USB(3)#USBMI(2)" into the path of the
+// USB device and the interface number, -1 for devices with one interface
+func splitLocationPath(path string) (string, int) {
+	i := strings.LastIndex(path, "#USBMI(")
+	if i == -1 || !strings.HasSuffix(path, ")") {
+		return path, -1
+	}
+	n, err := strconv.Atoi(path[i+len("#USBMI(") : len(path)-1])
+	if err != nil {
+		return path, -1
+	}
+	return path[:i], n
+}
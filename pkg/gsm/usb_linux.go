@@ -0,0 +1,43 @@
+//go:build linux
+
+package gsm
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// usbInterfaceNumber reads bInterfaceNumber from sysfs, -1 when unknown
+func usbInterfaceNumber(portName string) int {
+	device := filepath.Join("/sys/class/tty", filepath.Base(portName), "device")
+	// ttyACM devices are the interface, ttyUSB devices sit below it
+	for _, dir := range []string{device, filepath.Join(device, "..")} {
+		data, err := os.ReadFile(filepath.Join(dir, "bInterfaceNumber"))
+		if err != nil {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 16, 32)
+		if err == nil {
+			return int(n)
+		}
+	}
+	return -1
+}
+
+// usbLocation returns the USB bus path (e.g. "1-1.4") of a port
+func usbLocation(portName string) string {
+	device, err := filepath.EvalSymlinks(filepath.Join("/sys/class/tty", filepath.Base(portName), "device"))
+	if err != nil {
+		return ""
+	}
+	// .../usb1/1-1/1-1.4/1-1.4:1.2/ttyUSB2, the interface is "<bus path>:<config>.<iface>"
+	for dir := device; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		base := filepath.Base(dir)
+		if i := strings.Index(base, ":"); i > 0 {
+			return base[:i]
+		}
+	}
+	return ""
+}
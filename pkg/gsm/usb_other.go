@@ -0,0 +1,13 @@
+//go:build !linux && !windows
+
+package gsm
+
+// usbInterfaceNumber is only available from sysfs, other platforms fall
+// back to port order
+func usbInterfaceNumber(portName string) int {
+	return -1
+}
+
+func usbLocation(portName string) string {
+	return ""
+}
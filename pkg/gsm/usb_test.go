@@ -0,0 +1,79 @@
+package gsm
+
+import (
+	"testing"
+
+	"go.bug.st/serial/enumerator"
+)
+
+func TestGroupUSBModems(t *testing.T) {
+	details := []*enumerator.PortDetails{
+		{Name: "/dev/ttyS0"},
+		{Name: "/dev/ttyUSB10", IsUSB: true, VID: "2C7C", PID: "0125", SerialNumber: "B"},
+		{Name: "/dev/ttyUSB3", IsUSB: true, VID: "2c7c", PID: "0125", SerialNumber: "A"},
+		{Name: "/dev/ttyUSB2", IsUSB: true, VID: "2c7c", PID: "0125", SerialNumber: "A"},
+		{Name: "/dev/ttyUSB1", IsUSB: true, VID: "2c7c", PID: "0125", SerialNumber: "A"},
+		{Name: "/dev/ttyUSB0", IsUSB: true, VID: "2c7c", PID: "0125", SerialNumber: "A"},
+		{Name: "/dev/ttyUSB8", IsUSB: true, VID: "2c7c", PID: "0125", SerialNumber: "B"},
+		{Name: "COM21", IsUSB: true, VID: "1E0E", PID: "9001", Product: "SimTech HS-USB AT Port 9001"},
+	}
+	interfaces := map[string]int{"/dev/ttyUSB8": 2, "/dev/ttyUSB10": 3}
+	iface := func(name string) int {
+		if n, ok := interfaces[name]; ok {
+			return n
+		}
+		return -1
+	}
+	modems := groupUSBModems(details, iface, func(string) string { return "" })
+	if len(modems) != 3 {
+		t.Fatalf("expected 3 modems, got %d", len(modems))
+	}
+	if modems[1].SerialNumber != "A" || modems[1].ATPort != "/dev/ttyUSB2" || modems[1].NMEAPort != "/dev/ttyUSB1" {
+		t.Errorf("unexpected ports for A: %+v", modems[1])
+	}
+	if modems[2].ATPort != "/dev/ttyUSB8" || modems[2].ModemPort != "/dev/ttyUSB10" {
+		t.Errorf("unexpected ports for B: %+v", modems[2])
+	}
+	if modems[0].Vendor != "SIMCom" || modems[0].ATPort != "COM21" {
+		t.Errorf("unexpected SIMCom modem: %+v", modems[0])
+	}
+}
+
+func TestGroupUSBModemsWithoutSerialNumber(t *testing.T) {
+	details := []*enumerator.PortDetails{
+		{Name: "COM3", IsUSB: true, VID: "2c7c", PID: "0125"},
+		{Name: "COM4", IsUSB: true, VID: "2c7c", PID: "0125"},
+		{Name: "COM7", IsUSB: true, VID: "2c7c", PID: "0125"},
+		{Name: "COM8", IsUSB: true, VID: "2c7c", PID: "0125"},
+	}
+	iface := func(string) int { return -1 }
+
+	// Unknown position, ports are not merged into one modem
+	if modems := groupUSBModems(details, iface, func(string) string { return "" }); len(modems) != 4 {
+		t.Errorf("expected 4 modems, got %d", len(modems))
+	}
+
+	locations := map[string]string{"COM3": "USB(3)", "COM4": "USB(3)", "COM7": "USB(4)", "COM8": "USB(4)"}
+	modems := groupUSBModems(details, iface, func(name string) string { return locations[name] })
+	if len(modems) != 2 || len(modems[0].Ports) != 2 || modems[1].Ports[0].Name != "COM7" {
+		t.Errorf("unexpected grouping %+v", modems)
+	}
+}
+
+func TestSplitLocationPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		location string
+		iface    int
+	}{
+		{"PCIROOT(0)#PCI(1400)#USBROOT(0)#USB(3)#USBMI(2)", "PCIROOT(0)#PCI(1400)#USBROOT(0)#USB(3)", 2},
+		{"PCIROOT(0)#PCI(1400)#USBROOT(0)#USB(3)#USB(1)", "PCIROOT(0)#PCI(1400)#USBROOT(0)#USB(3)#USB(1)", -1},
+		{"", "", -1},
+	}
+	for _, test := range tests {
+		location, iface := splitLocationPath(test.path)
+		if location != test.location || iface != test.iface {
+			t.Errorf("%q: got %q %d", test.path, location, iface)
+		}
+	}
+}
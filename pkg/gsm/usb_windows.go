@@ -0,0 +1,73 @@
+//go:build windows
+
+package gsm
+
+import (
+	"strings"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+// guidDevClassPorts is the setup class of COM ports
+var guidDevClassPorts = windows.GUID{
+	Data1: 0x4d36e978, Data2: 0xe325, Data3: 0x11ce,
+	Data4: [8]byte{0xbf, 0xc1, 0x08, 0x00, 0x2b, 0xe1, 0x03, 0x18},
+}
+
+// usbInterfaceNumber reads USBMI(n) from the location path, -1 when unknown
+func usbInterfaceNumber(portName string) int {
+	_, iface := splitLocationPath(locationPath(portName))
+	return iface
+}
+
+// usbLocation returns the location path of the USB device a port belongs to
+func usbLocation(portName string) string {
+	location, _ := splitLocationPath(locationPath(portName))
+	return location
+}
+
+// locationPath looks the COM port up among present ports and returns its
+// first location path, "" when not found
+func locationPath(portName string) string {
+	devices, err := windows.SetupDiGetClassDevsEx(&guidDevClassPorts, "", 0, windows.DIGCF_PRESENT, 0, "")
+	if err != nil {
+		return ""
+	}
+	defer devices.Close()
+	for i := 0; ; i++ {
+		device, err := devices.EnumDeviceInfo(i)
+		if err == windows.ERROR_NO_MORE_ITEMS {
+			return ""
+		}
+		if err != nil {
+			continue
+		}
+		if !strings.EqualFold(comPortName(devices, device), portName) {
+			continue
+		}
+		value, err := devices.DeviceRegistryProperty(device, windows.SPDRP_LOCATION_PATHS)
+		if err != nil {
+			return ""
+		}
+		if paths, ok := value.([]string); ok && len(paths) > 0 {
+			return paths[0]
+		}
+		return ""
+	}
+}
+
+// comPortName reads PortName from the device's hardware key
+func comPortName(devices windows.DevInfo, device *windows.DevInfoData) string {
+	handle, err := devices.OpenDevRegKey(device, windows.DICS_FLAG_GLOBAL, 0, windows.DIREG_DEV, windows.KEY_READ)
+	if err != nil {
+		return ""
+	}
+	key := registry.Key(handle)
+	defer key.Close()
+	name, _, err := key.GetStringValue("PortName")
+	if err != nil {
+		return ""
+	}
+	return name
+}
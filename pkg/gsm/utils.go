@@ -29,3 +29,33 @@ func extractNetwork(cops string) string {
 	}
 	return network
 }
+
+// extractNumber returns the number of a +CNUM line
+func extractNumber(cnum string) string {
+	// +CNUM: "","+84912345678",145
+	parts := strings.Split(cnum, ",")
+	if len(parts) < 2 {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(parts[1]), "\"")
+}
+
+// splitFields splits the parameters of a response line on commas outside
+// quotes and strips the quotes
+func splitFields(params string) []string {
+	var fields []string
+	var field strings.Builder
+	quoted := false
+	for _, r := range strings.TrimSpace(params) {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			fields = append(fields, strings.TrimSpace(field.String()))
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	return append(fields, strings.TrimSpace(field.String()))
+}
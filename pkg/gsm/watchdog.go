@@ -0,0 +1,199 @@
+package gsm
+
+import (
+	"context"
+	"fmt"
+	"go-gsm/pkg/logrus"
+	"time"
+)
+
+// RecoveryStep is one escalation level of the Watchdog
+type RecoveryStep int
+
+const (
+	// RecoveryReset sends ATZ
+	RecoveryReset RecoveryStep = iota
+	// RecoveryRadio turns the radio off and on, AT+CFUN=0 then AT+CFUN=1
+	RecoveryRadio
+	// RecoveryReboot restarts the module, AT+CFUN=1,1
+	RecoveryReboot
+	// RecoveryReopen closes the port and opens it again
+	RecoveryReopen
+)
+
+func (r RecoveryStep) String() string {
+	switch r {
+	case RecoveryReset:
+		return "reset"
+	case RecoveryRadio:
+		return "radio off/on"
+	case RecoveryReboot:
+		return "reboot"
+	case RecoveryReopen:
+		return "reopen port"
+	}
+	return "unknown"
+}
+
+// ModemRecovery is published for every recovery step the Watchdog tries
+type ModemRecovery struct {
+	PortName string
+	Step     RecoveryStep
+	// Reason is why the modem was considered hung
+	Reason string
+	// Recovered is whether the modem answered after this step
+	Recovered bool
+	Err       error
+	Time      time.Time
+}
+
+func (ModemRecovery) EventName() string { return "modem_recovery" }
+
+// WatchdogOptions configures a Watchdog, zero values take the defaults
+type WatchdogOptions struct {
+	// MaxTimeouts consecutive command timeouts trigger recovery, 3 by
+	// default
+	MaxTimeouts int
+	// Interval between liveness probes while idle, one minute by default
+	Interval time.Duration
+	// ProbeTimeout bounds liveness probes and recovery commands, 5s by
+	// default
+	ProbeTimeout time.Duration
+	// Settle is the pause after ATZ and CFUN before probing, 2s by default
+	Settle time.Duration
+	// RebootWait is the pause after AT+CFUN=1,1, 30s by default
+	RebootWait time.Duration
+	// Dial reopens the port in the last step. Leave it nil when a
+	// Supervisor runs, the port is then only closed and the Supervisor
+	// reopens it.
+	Dial Dialer
+}
+
+// Watchdog detects a modem that stopped answering while its port stays
+// open and escalates through the recovery steps until it answers again
+type Watchdog struct {
+	subject *SerialSubject
+	opts    WatchdogOptions
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// StartWatchdog watches the subject until ctx is done, Stop is called or
+// the subject is closed
+func (s *SerialSubject) StartWatchdog(ctx context.Context, opts WatchdogOptions) *Watchdog {
+	if opts.MaxTimeouts <= 0 {
+		opts.MaxTimeouts = 3
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+	if opts.ProbeTimeout <= 0 {
+		opts.ProbeTimeout = 5 * time.Second
+	}
+	if opts.Settle <= 0 {
+		opts.Settle = 2 * time.Second
+	}
+	if opts.RebootWait <= 0 {
+		opts.RebootWait = 30 * time.Second
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	w := &Watchdog{subject: s, opts: opts, cancel: cancel, done: make(chan struct{})}
+	go w.run(ctx)
+	return w
+}
+
+// Stop ends watching and waits for a recovery in progress
+func (w *Watchdog) Stop() {
+	w.cancel()
+	<-w.done
+}
+
+func (w *Watchdog) run(ctx context.Context) {
+	defer close(w.done)
+	s := w.subject
+	ticker := time.NewTicker(w.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.closed:
+			return
+		case <-s.timedOut:
+		case <-ticker.C:
+			// Idle modems only time out when asked something
+			_, _ = s.ExecContext(ctx, Command{Line: "AT", Timeout: w.opts.ProbeTimeout})
+		}
+		if timeouts := int(s.timeouts.Load()); timeouts >= w.opts.MaxTimeouts {
+			w.recover(ctx, fmt.Sprintf("%d consecutive command timeouts", timeouts))
+		}
+	}
+}
+
+// recover escalates until a step brings the modem back
+func (w *Watchdog) recover(ctx context.Context, reason string) {
+	s := w.subject
+	logrus.LogrusLoggerWithContext(s.ctx).Warnf("Modem %s is hung: %s", s.portName, reason)
+	for step := RecoveryReset; step <= RecoveryReopen; step++ {
+		err := w.attempt(ctx, step)
+		if ctx.Err() != nil {
+			return
+		}
+		recovered := err == nil
+		if recovered {
+			logrus.LogrusLoggerWithContext(s.ctx).Infof("Modem %s recovered by %s", s.portName, step)
+		} else {
+			logrus.LogrusLoggerWithContext(s.ctx).Warnf("Modem %s not recovered by %s: %v", s.portName, step, err)
+		}
+		s.publish(ModemRecovery{
+			PortName:  s.portName,
+			Step:      step,
+			Reason:    reason,
+			Recovered: recovered,
+			Err:       err,
+			Time:      time.Now(),
+		})
+		if recovered {
+			s.timeouts.Store(0)
+			if errInit := s.initModem(ctx); errInit != nil {
+				logrus.LogrusLoggerWithContext(s.ctx).Errorf("Init after recovery: %v", errInit)
+			}
+			return
+		}
+	}
+}
+
+// attempt runs one step and probes the modem afterwards
+func (w *Watchdog) attempt(ctx context.Context, step RecoveryStep) error {
+	s := w.subject
+	settle := w.opts.Settle
+	// Errors are expected, a hung modem rarely answers the step itself
+	switch step {
+	case RecoveryReset:
+		_, _ = s.ExecContext(ctx, Command{Line: "ATZ", Timeout: w.opts.ProbeTimeout})
+	case RecoveryRadio:
+		_, _ = s.ExecContext(ctx, Command{Line: "AT+CFUN=0", Timeout: w.opts.ProbeTimeout})
+		_, _ = s.ExecContext(ctx, Command{Line: "AT+CFUN=1", Timeout: w.opts.ProbeTimeout})
+	case RecoveryReboot:
+		_, _ = s.ExecContext(ctx, Command{Line: "AT+CFUN=1,1", Timeout: w.opts.ProbeTimeout})
+		settle = w.opts.RebootWait
+	case RecoveryReopen:
+		s.dropTransport()
+		if w.opts.Dial == nil {
+			// The Supervisor sees the lost transport and reopens it
+			return fmt.Errorf("port closed, reopening left to the supervisor")
+		}
+		port, err := w.opts.Dial(ctx)
+		if err != nil {
+			return err
+		}
+		s.attachTransport(port)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(settle):
+	}
+	_, err := s.ExecContext(ctx, Command{Line: "AT", Timeout: w.opts.ProbeTimeout})
+	return err
+}